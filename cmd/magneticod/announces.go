@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+const (
+	// ANNOUNCES_FLUSH_INTERVAL is how often the announces are written to the database.
+	ANNOUNCES_FLUSH_INTERVAL = time.Minute
+	// MAX_AGGREGATED_ANNOUNCES is the number of distinct infohashes after which the announces are
+	// written to the database before the interval is over, so that memory usage stays bounded.
+	MAX_AGGREGATED_ANNOUNCES = 50000
+)
+
+// announceCounter aggregates the announces of torrents in memory, so that they are written to the
+// database in batches instead of one by one. It is not thread-safe.
+type announceCounter struct {
+	announces map[[20]byte]*persistence.Announces
+}
+
+func newAnnounceCounter() *announceCounter {
+	return &announceCounter{announces: make(map[[20]byte]*persistence.Announces)}
+}
+
+// add counts an announce of the torrent, and reports whether the announces should be flushed.
+func (ac *announceCounter) add(infoHash [20]byte, seenOn time.Time) bool {
+	announce, exists := ac.announces[infoHash]
+	if !exists {
+		announce = &persistence.Announces{InfoHash: append([]byte{}, infoHash[:]...)}
+		ac.announces[infoHash] = announce
+	}
+
+	announce.Count++
+	if seenOn.Unix() > announce.LastSeenOn {
+		announce.LastSeenOn = seenOn.Unix()
+	}
+
+	return len(ac.announces) >= MAX_AGGREGATED_ANNOUNCES
+}
+
+// flush returns the announces aggregated so far, and starts over.
+func (ac *announceCounter) flush() []persistence.Announces {
+	announces := make([]persistence.Announces, 0, len(ac.announces))
+	for _, announce := range ac.announces {
+		announces = append(announces, *announce)
+	}
+
+	ac.announces = make(map[[20]byte]*persistence.Announces)
+	return announces
+}
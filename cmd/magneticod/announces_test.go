@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnnounceCounter(t *testing.T) {
+	ac := newAnnounceCounter()
+	ac.add([20]byte{1}, time.Unix(2000, 0))
+	ac.add([20]byte{1}, time.Unix(1000, 0))
+	ac.add([20]byte{2}, time.Unix(3000, 0))
+
+	announces := ac.flush()
+	if len(announces) != 2 {
+		t.Fatalf("Expected announces of 2 torrents, got %d", len(announces))
+	}
+	for _, announce := range announces {
+		switch announce.InfoHash[0] {
+		case 1:
+			if announce.Count != 2 || announce.LastSeenOn != 2000 {
+				t.Errorf("Unexpected announces %+v", announce)
+			}
+		case 2:
+			if announce.Count != 1 || announce.LastSeenOn != 3000 {
+				t.Errorf("Unexpected announces %+v", announce)
+			}
+		}
+	}
+
+	if announces = ac.flush(); len(announces) != 0 {
+		t.Errorf("Expected no announces after flush, got %d", len(announces))
+	}
+}
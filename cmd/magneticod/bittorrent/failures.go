@@ -0,0 +1,92 @@
+package bittorrent
+
+import (
+	"fmt"
+	"net"
+)
+
+// FailureReason is the reason why fetching the metadata of a torrent from a peer has failed.
+type FailureReason uint8
+
+const (
+	// ConnectFailed means that a TCP connection to the peer could not be established.
+	ConnectFailed FailureReason = iota
+	// ConnectionLost means that the peer has closed (or reset) the connection before the
+	// metadata is complete.
+	ConnectionLost
+	// Timeout means that the metadata could not be fetched within the deadline.
+	Timeout
+	// NoExtensionSupport means that the peer does not support the extension protocol (BEP 10) or
+	// the metadata extension (BEP 9).
+	NoExtensionSupport
+	// Rejected means that the peer has rejected sending (a piece of) the metadata.
+	Rejected
+	// SizeLimit means that the metadata size the peer has advertised is unacceptable.
+	SizeLimit
+	// ProtocolViolation means that the peer has sent a malformed or an unexpected message.
+	ProtocolViolation
+	// HashMismatch means that the metadata received does not match the infohash.
+	HashMismatch
+	// InvalidInfo means that the metadata matches the infohash but it is not a valid info
+	// dictionary.
+	InvalidInfo
+
+	nFailureReasons
+)
+
+func (r FailureReason) String() string {
+	switch r {
+	case ConnectFailed:
+		return "connect_failed"
+	case ConnectionLost:
+		return "connection_lost"
+	case Timeout:
+		return "timeout"
+	case NoExtensionSupport:
+		return "no_extension_support"
+	case Rejected:
+		return "rejected"
+	case SizeLimit:
+		return "size_limit"
+	case ProtocolViolation:
+		return "protocol_violation"
+	case HashMismatch:
+		return "hash_mismatch"
+	case InvalidInfo:
+		return "invalid_info"
+	default:
+		return fmt.Sprintf("FailureReason(%d)", r)
+	}
+}
+
+// fetchError is the error returned by the steps of fetching metadata, which carries the reason of
+// the failure along with the error itself.
+type fetchError struct {
+	reason FailureReason
+	err    error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err.Error())
+}
+
+func fail(reason FailureReason, format string, args ...interface{}) error {
+	return &fetchError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// failIO categorises the errors occurred while reading from or writing to the peer.
+func failIO(err error, doing string) error {
+	reason := ConnectionLost
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		reason = Timeout
+	}
+	return &fetchError{reason: reason, err: fmt.Errorf("%s: %s", doing, err.Error())}
+}
+
+// reasonOf returns the FailureReason of an error returned by the steps of fetching metadata.
+func reasonOf(err error) FailureReason {
+	if fErr, ok := err.(*fetchError); ok {
+		return fErr.reason
+	}
+	return ProtocolViolation
+}
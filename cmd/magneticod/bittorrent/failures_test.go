@@ -0,0 +1,100 @@
+package bittorrent
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// fakePeer listens on localhost, and serves a single connection with the given function.
+func fakePeer(t *testing.T, serve func(conn net.Conn)) *net.TCPAddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s", err.Error())
+	}
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+
+	return listener.Addr().(*net.TCPAddr)
+}
+
+func TestFetchMetadata_Failures(t *testing.T) {
+	ms := NewMetadataSink(2*time.Second, 0, false)
+
+	// An address that nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s", err.Error())
+	}
+	closedAddr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	handshake := func(reserved byte) func(conn net.Conn) {
+		return func(conn net.Conn) {
+			buf := make([]byte, 68)
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			rHandshake := make([]byte, 68)
+			copy(rHandshake, "\x13BitTorrent protocol")
+			rHandshake[25] = reserved
+			conn.Write(rHandshake)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// A peer that announces a message of (almost) 4 GiB right after the handshakes.
+	oversized := func(conn net.Conn) {
+		handshake(0x10)(conn)
+		extHandshake := []byte("d1:md11:ut_metadatai1ee13:metadata_sizei22528ee")
+		conn.Write(append([]byte{0x00, 0x00, 0x00, byte(2 + len(extHandshake)), 0x14, 0x00}, extHandshake...))
+		conn.Write([]byte{0xff, 0xff, 0xff, 0xf0})
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name   string
+		addr   *net.TCPAddr
+		reason FailureReason
+	}{
+		{"nothing listening", closedAddr, ConnectFailed},
+		{"immediate close", fakePeer(t, func(conn net.Conn) {}), ConnectionLost},
+		{"no extension bit", fakePeer(t, handshake(0x00)), NoExtensionSupport},
+		{"oversized message", fakePeer(t, oversized), SizeLimit},
+		{"silent peer", fakePeer(t, func(conn net.Conn) { time.Sleep(3 * time.Second) }), Timeout},
+	}
+
+	for _, test := range tests {
+		_, err := ms.fetchMetadata(metainfo.Hash{}, Peer{Addr: test.addr})
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if reason := reasonOf(err); reason != test.reason {
+			t.Errorf("%s: expected reason %s, got %s (%s)", test.name, test.reason, reason, err.Error())
+		}
+	}
+}
+
+func TestReasonOf(t *testing.T) {
+	if reason := reasonOf(fail(SizeLimit, "%d", 1)); reason != SizeLimit {
+		t.Errorf("expected %s, got %s", SizeLimit, reason)
+	}
+	if reason := reasonOf(errors.New("unknown")); reason != ProtocolViolation {
+		t.Errorf("expected %s, got %s", ProtocolViolation, reason)
+	}
+	if s := InvalidInfo.String(); s != "invalid_info" {
+		t.Errorf("expected invalid_info, got %s", s)
+	}
+}
@@ -0,0 +1,142 @@
+package bittorrent
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/anacrolix/torrent/bencode"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// maxVersionLength is the maximum length of the `v` field we record, so that peers cannot fill up
+// the database with arbitrary strings.
+const maxVersionLength = 64
+
+// maxDistinctNames is the maximum number of distinct versions, request queues, and extensions we
+// count between two flushes of the PeerStatistics, beyond which the peers are counted as
+// otherName, so that peers cannot grow them in memory without bound either. (The database stores
+// at most persistence.MAX_PEER_NAMES of them across the flushes.)
+const maxDistinctNames = persistence.MAX_PEER_NAMES
+
+const otherName = persistence.OTHER_PEER_NAME
+
+// peerFingerprint is what we learn about the client of a peer from its BitTorrent handshake and
+// (if it supports the extension protocol) its extension handshake.
+type peerFingerprint struct {
+	Client string
+
+	hasExtHandshake bool
+	Version         string
+	RequestQueue    string
+	YourIP          string
+	Extensions      []string
+}
+
+// peerIDClient returns the client prefix of a peer ID, which is the two characters between the
+// dashes of Azureus-style peer IDs (e.g. "-qB4150-..."), or the first character of Shadow-style and
+// Mainline-style peer IDs (e.g. "S58B-----..." and "M4-3-6--..."), or "unknown" if the peer ID is
+// of neither of them.
+func peerIDClient(peerID []byte) string {
+	isPrintable := func(b []byte) bool {
+		for _, c := range b {
+			if c > unicode.MaxASCII || !unicode.IsPrint(rune(c)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(peerID) >= 8 && peerID[0] == '-' && peerID[7] == '-' && isPrintable(peerID[1:3]) {
+		return string(peerID[1:3])
+	}
+	if len(peerID) >= 1 && (unicode.IsLetter(rune(peerID[0])) || unicode.IsDigit(rune(peerID[0]))) &&
+		peerID[0] <= unicode.MaxASCII {
+		return string(peerID[:1])
+	}
+	return "unknown"
+}
+
+// parseExtHandshake records the fields of the (bencoded) extension handshake of the peer. It is
+// deliberately lenient, as the fingerprint is not essential to fetching the metadata.
+func (fp *peerFingerprint) parseExtHandshake(dump []byte) {
+	var dict map[string]interface{}
+	if err := bencode.Unmarshal(dump, &dict); err != nil {
+		return
+	}
+	fp.hasExtHandshake = true
+
+	fp.Version = "none"
+	if v, ok := dict["v"].(string); ok {
+		if v = sanitizeName(v); v != "" {
+			fp.Version = v
+		}
+	}
+
+	fp.RequestQueue = "none"
+	if reqq, ok := dict["reqq"].(int64); ok {
+		fp.RequestQueue = strconv.FormatInt(reqq, 10)
+	}
+
+	fp.YourIP = "none"
+	if yourIP, ok := dict["yourip"].(string); ok {
+		switch len(yourIP) {
+		case net.IPv4len:
+			fp.YourIP = "ipv4"
+		case net.IPv6len:
+			fp.YourIP = "ipv6"
+		}
+	}
+
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for extension, id := range m {
+			// An ID of zero means that the extension is disabled.
+			if id, ok := id.(int64); ok && id != 0 && len(extension) <= maxVersionLength {
+				if extension = sanitizeName(extension); extension != "" {
+					fp.Extensions = append(fp.Extensions, extension)
+				}
+			}
+		}
+	}
+}
+
+// addTo counts the peer in the PeerStatistics.
+func (fp *peerFingerprint) addTo(stats persistence.PeerStatistics) {
+	stats.Clients[fp.Client]++
+	if !fp.hasExtHandshake {
+		return
+	}
+
+	countName(stats.Versions, fp.Version)
+	countName(stats.RequestQueues, fp.RequestQueue)
+	stats.YourIPs[fp.YourIP]++
+	for _, extension := range fp.Extensions {
+		countName(stats.Extensions, extension)
+	}
+}
+
+// countName counts the name in the map, or as otherName if the map already has maxDistinctNames
+// names.
+func countName(names map[string]uint64, name string) {
+	if _, ok := names[name]; !ok && len(names) >= maxDistinctNames {
+		name = otherName
+	}
+	names[name]++
+}
+
+// sanitizeName drops the invalid UTF-8 of a name sent by a peer, and truncates it to
+// maxVersionLength bytes without splitting a rune, as the names are stored as they are.
+func sanitizeName(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	if len(name) <= maxVersionLength {
+		return name
+	}
+	end := maxVersionLength
+	for end > 0 && !utf8.RuneStart(name[end]) {
+		end--
+	}
+	return name[:end]
+}
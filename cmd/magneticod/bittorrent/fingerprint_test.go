@@ -0,0 +1,81 @@
+package bittorrent
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestPeerIDClient(t *testing.T) {
+	tests := map[string]string{
+		"-qB4150-abcdefghijkl": "qB",
+		"-UT355S-abcdefghijkl": "UT",
+		"S58B-----abcdefghijk": "S",
+		"M4-3-6--abcdefghijkl": "M",
+		"\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13": "unknown",
+	}
+
+	for peerID, expected := range tests {
+		if client := peerIDClient([]byte(peerID)); client != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, peerID, client)
+		}
+	}
+}
+
+func TestPeerFingerprint_ParseExtHandshake(t *testing.T) {
+	fp := &peerFingerprint{Client: "qB"}
+	fp.parseExtHandshake([]byte("d1:md11:ut_metadatai3e6:ut_pexi1e8:disabledi0ee13:metadata_sizei22528e4:reqqi500e1:v17:qBittorrent/4.1.56:yourip4:\x7f\x00\x00\x01e"))
+
+	if fp.Version != "qBittorrent/4.1.5" || fp.RequestQueue != "500" || fp.YourIP != "ipv4" {
+		t.Errorf("Unexpected fingerprint %+v", *fp)
+	}
+	sort.Strings(fp.Extensions)
+	if len(fp.Extensions) != 2 || fp.Extensions[0] != "ut_metadata" || fp.Extensions[1] != "ut_pex" {
+		t.Errorf("Unexpected extensions %v", fp.Extensions)
+	}
+
+	stats := persistence.NewPeerStatistics()
+	fp.addTo(stats)
+	(&peerFingerprint{Client: "qB"}).addTo(stats)
+	if stats.Clients["qB"] != 2 || stats.Versions["qBittorrent/4.1.5"] != 1 || stats.Extensions["ut_pex"] != 1 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := map[string]string{
+		"qBittorrent/4.1.5":                 "qBittorrent/4.1.5",
+		"µTorrent\xff\xfe 3.5":              "µTorrent 3.5",
+		strings.Repeat("a", 63) + "é":       strings.Repeat("a", 63),
+		strings.Repeat("a", 62) + "é" + "b": strings.Repeat("a", 62) + "é",
+		"\xff\xfe":                          "",
+	}
+
+	for name, expected := range tests {
+		sanitized := sanitizeName(name)
+		if sanitized != expected || !utf8.ValidString(sanitized) || len(sanitized) > maxVersionLength {
+			t.Errorf("Expected %q for %q, got %q", expected, name, sanitized)
+		}
+	}
+}
+
+func TestPeerFingerprint_AddToCapsDistinctNames(t *testing.T) {
+	stats := persistence.NewPeerStatistics()
+	for i := 0; i < maxDistinctNames+10; i++ {
+		fp := &peerFingerprint{Client: "qB", hasExtHandshake: true, Version: "v" + strconv.Itoa(i),
+			RequestQueue: "250", YourIP: "none", Extensions: []string{"ut_metadata"}}
+		fp.addTo(stats)
+	}
+
+	if len(stats.Versions) != maxDistinctNames+1 || stats.Versions[otherName] != 10 {
+		t.Errorf("Expected %d versions with %d others, got %d with %d others", maxDistinctNames+1, 10,
+			len(stats.Versions), stats.Versions[otherName])
+	}
+	if stats.Versions["v0"] != 1 || stats.RequestQueues["250"] != maxDistinctNames+10 {
+		t.Errorf("Expected the known names to be counted, got %+v", stats)
+	}
+}
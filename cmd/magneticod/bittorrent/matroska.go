@@ -0,0 +1,223 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// Matroska (and WebM, which is a subset of it) files are made of nested EBML elements, each of
+// which starts with its ID and size, both of which are variable-length integers. We parse only the
+// elements that describe the segment and its tracks:
+//
+//   EBML (DocType)
+//   Segment
+//   ├── Info (TimestampScale & Duration)
+//   └── Tracks
+//       └── TrackEntry (TrackType & CodecID)
+//           └── Video (PixelWidth & PixelHeight)
+
+const (
+	ebmlHeaderID     = 0x1A45DFA3
+	ebmlDocTypeID    = 0x4282
+	segmentID        = 0x18538067
+	infoID           = 0x1549A966
+	timestampScaleID = 0x2AD7B1
+	durationID       = 0x4489
+	tracksID         = 0x1654AE6B
+	trackEntryID     = 0xAE
+	trackTypeID      = 0x83
+	codecIDID        = 0x86
+	videoID          = 0xE0
+	pixelWidthID     = 0xB0
+	pixelHeightID    = 0xBA
+	clusterID        = 0x1F43B675
+
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+)
+
+// errStopParsing is returned by the callbacks of ebmlElements to stop parsing (successfully).
+var errStopParsing = errors.New("stop parsing")
+
+// ebmlVint reads an EBML variable-length integer, and returns its value (with or without the
+// length marker) and its length.
+func ebmlVint(data []byte, keepMarker bool) (uint64, int, error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, errors.New("invalid variable-length integer")
+	}
+
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(data) < length {
+		return 0, 0, errors.New("truncated variable-length integer")
+	}
+
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> uint(length))
+	}
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, length, nil
+}
+
+// ebmlElements calls fn for each of the elements in data, in order. Like mp4Boxes, the last element
+// might be truncated (and elements of unknown size extend to the end of data).
+func ebmlElements(data []byte, fn func(id uint64, body []byte) error) error {
+	for len(data) > 0 {
+		id, idLength, err := ebmlVint(data, true)
+		if err != nil {
+			return err
+		}
+		size, sizeLength, err := ebmlVint(data[idLength:], false)
+		if err != nil {
+			return err
+		}
+
+		headerSize := uint64(idLength + sizeLength)
+		// All ones denote an unknown size.
+		if size == uint64(1)<<(7*uint(sizeLength))-1 || size > uint64(len(data))-headerSize {
+			size = uint64(len(data)) - headerSize
+		}
+
+		if err = fn(id, data[headerSize:headerSize+size]); err != nil {
+			return err
+		}
+		data = data[headerSize+size:]
+	}
+
+	return nil
+}
+
+func ebmlUint(body []byte) uint64 {
+	var value uint64
+	for _, b := range body {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func ebmlFloat(body []byte) float64 {
+	switch len(body) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(body)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(body))
+	default:
+		return 0
+	}
+}
+
+func probeMatroska(data []byte) (persistence.MediaInfo, error) {
+	var mediaInfo persistence.MediaInfo
+	timestampScale := uint64(1000000) // in nanoseconds
+	var duration float64              // in timestampScale
+	foundTracks := false
+
+	err := ebmlElements(data, func(id uint64, body []byte) error {
+		switch id {
+		case ebmlHeaderID:
+			return ebmlElements(body, func(id uint64, body []byte) error {
+				if id == ebmlDocTypeID {
+					mediaInfo.Format = string(body)
+				}
+				return nil
+			})
+
+		case segmentID:
+			if mediaInfo.Format != "matroska" && mediaInfo.Format != "webm" {
+				return fmt.Errorf("unknown document type `%s`", mediaInfo.Format)
+			}
+			return ebmlElements(body, func(id uint64, body []byte) error {
+				switch id {
+				case infoID:
+					return ebmlElements(body, func(id uint64, body []byte) error {
+						switch id {
+						case timestampScaleID:
+							timestampScale = ebmlUint(body)
+						case durationID:
+							duration = ebmlFloat(body)
+						}
+						return nil
+					})
+				case tracksID:
+					foundTracks = true
+					return ebmlElements(body, func(id uint64, body []byte) error {
+						if id == trackEntryID {
+							return probeMatroskaTrack(body, &mediaInfo)
+						}
+						return nil
+					})
+				case clusterID: // The media data follows, hence no more headers.
+					return errStopParsing
+				}
+				return nil
+			})
+
+		default:
+			return nil
+		}
+	})
+	if err != nil && err != errStopParsing {
+		return mediaInfo, err
+	}
+	if mediaInfo.Format == "" {
+		return mediaInfo, errors.New("not a Matroska file")
+	}
+	if !foundTracks {
+		return mediaInfo, fmt.Errorf("no Tracks element in the first %d bytes", len(data))
+	}
+
+	mediaInfo.Duration = duration * float64(timestampScale) / 1e9
+	return mediaInfo, nil
+}
+
+func probeMatroskaTrack(trackEntry []byte, mediaInfo *persistence.MediaInfo) error {
+	var trackType uint64
+	var codec string
+	var width, height uint
+
+	err := ebmlElements(trackEntry, func(id uint64, body []byte) error {
+		switch id {
+		case trackTypeID:
+			trackType = ebmlUint(body)
+		case codecIDID:
+			codec = string(body)
+		case videoID:
+			return ebmlElements(body, func(id uint64, body []byte) error {
+				switch id {
+				case pixelWidthID:
+					width = uint(ebmlUint(body))
+				case pixelHeightID:
+					height = uint(ebmlUint(body))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch trackType {
+	case trackTypeVideo:
+		if mediaInfo.VideoCodec == "" {
+			mediaInfo.VideoCodec = codec
+			mediaInfo.Width, mediaInfo.Height = width, height
+		}
+	case trackTypeAudio:
+		if mediaInfo.AudioCodec == "" {
+			mediaInfo.AudioCodec = codec
+		}
+	}
+
+	return nil
+}
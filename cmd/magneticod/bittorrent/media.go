@@ -0,0 +1,119 @@
+package bittorrent
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	// Register the decoders of the image formats we probe.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// MEDIA_PROBE_SIZE is the number of bytes we download from the beginning of a media file to probe
+// it. It is enough for the headers of images, and of videos that are prepared for streaming (i.e.
+// whose MP4 `moov` box or Matroska `Tracks` element precede the media data).
+const MEDIA_PROBE_SIZE = 1024 * 1024
+
+type mediaKind uint8
+
+const (
+	mediaNone mediaKind = iota
+	mediaImage
+	mediaVideo
+)
+
+func mediaKindOf(filePath string) mediaKind {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".mp4", ".m4v", ".mov", ".mkv", ".webm":
+		return mediaVideo
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return mediaImage
+	default:
+		return mediaNone
+	}
+}
+
+// findMedia chooses the file of a v1 (or hybrid) torrent to be probed, which is its largest video
+// file if there is any, else its largest image file.
+func findMedia(files []persistence.File) (torrentFile, bool) {
+	var media torrentFile
+	bestKind := mediaNone
+	var offset int64
+
+	for _, file := range files {
+		kind := mediaKindOf(file.Path)
+		if kind != mediaNone && !file.IsPadding() && file.SymlinkPath == "" && file.Size != 0 &&
+			(kind > bestKind || (kind == bestKind && int64(file.Size) > media.Size)) {
+			media = torrentFile{Path: file.Path, Offset: offset, Size: int64(file.Size)}
+			bestKind = kind
+		}
+		offset += int64(file.Size)
+	}
+
+	return media, bestKind != mediaNone
+}
+
+// probeMedia is an optional step of fetching metadata, in which we download the beginning of the
+// largest media file of the torrent from the same peer, and probe its container for the duration,
+// the resolution, and the codecs. Like fetchReadme, failing to probe is not a failure of the whole.
+func probeMedia(f *fetcher) (fetchStep, error) {
+	if !f.probeMedia {
+		return nil, nil
+	}
+	file, found := findMedia(f.result.Files)
+	if !found {
+		return nil, nil
+	}
+
+	length := file.Size
+	if length > MEDIA_PROBE_SIZE {
+		length = MEDIA_PROBE_SIZE
+	}
+	data, err := f.download(file.Offset, length)
+	if err == nil {
+		var mediaInfo persistence.MediaInfo
+		if mediaInfo, err = probe(file.Path, data); err == nil {
+			f.result.MediaInfo = &mediaInfo
+			return nil, nil
+		}
+	}
+
+	zap.L().Debug(
+		"Couldn't probe the media file!",
+		zap.String("infoHash", f.infoHash.String()),
+		zap.String("remotePeerAddr", f.peer.Addr.String()),
+		zap.String("path", file.Path),
+		zap.Error(err),
+	)
+	return nil, nil
+}
+
+// probe probes the beginning of a media file, by its extension.
+func probe(filePath string, data []byte) (persistence.MediaInfo, error) {
+	var mediaInfo persistence.MediaInfo
+	var err error
+
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".mp4", ".m4v", ".mov":
+		mediaInfo, err = probeMP4(data)
+	case ".mkv", ".webm":
+		mediaInfo, err = probeMatroska(data)
+	default:
+		var config image.Config
+		config, mediaInfo.Format, err = image.DecodeConfig(bytes.NewReader(data))
+		if config.Width < 0 || config.Height < 0 {
+			return mediaInfo, fmt.Errorf("invalid image size %dx%d", config.Width, config.Height)
+		}
+		mediaInfo.Width, mediaInfo.Height = uint(config.Width), uint(config.Height)
+	}
+
+	mediaInfo.Path = filePath
+	return mediaInfo, err
+}
@@ -0,0 +1,158 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+	"testing"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func mp4Box(boxType string, body ...[]byte) []byte {
+	content := bytes.Join(body, nil)
+	box := make([]byte, 8)
+	binary.BigEndian.PutUint32(box, uint32(8+len(content)))
+	copy(box[4:], boxType)
+	return append(box, content...)
+}
+
+func ebmlElement(id uint32, body ...[]byte) []byte {
+	content := bytes.Join(body, nil)
+	var element []byte
+	for shift := uint(24); ; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(element) != 0 {
+			element = append(element, b)
+		}
+		if shift == 0 {
+			break
+		}
+	}
+	// 8 bytes long size
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(content)))
+	size[0] = 0x01
+	return append(append(element, size...), content...)
+}
+
+func TestProbeMP4(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)  // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 90500) // duration
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1920<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 1080<<16)
+	stsd := func(codec string) []byte {
+		return append(make([]byte, 8), mp4Box(codec, make([]byte, 16))...)
+	}
+	hdlr := func(handlerType string) []byte {
+		return append(append(make([]byte, 8), handlerType...), make([]byte, 12)...)
+	}
+
+	data := bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom")),
+		mp4Box("moov",
+			mp4Box("mvhd", mvhd),
+			mp4Box("trak",
+				mp4Box("tkhd", tkhd),
+				mp4Box("mdia", mp4Box("hdlr", hdlr("vide")), mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd("avc1"))))),
+			),
+			mp4Box("trak",
+				mp4Box("tkhd", make([]byte, 84)),
+				mp4Box("mdia", mp4Box("hdlr", hdlr("soun")), mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd("mp4a"))))),
+			),
+		),
+		// Truncated mdat
+		mp4Box("mdat", make([]byte, 1000))[:100],
+	}, nil)
+
+	mediaInfo, err := probe("movie.mp4", data)
+	if err != nil {
+		t.Fatalf("Couldn't probe: %s", err.Error())
+	}
+	expected := persistence.MediaInfo{Path: "movie.mp4", Format: "mp4", Duration: 90.5, Width: 1920,
+		Height: 1080, VideoCodec: "avc1", AudioCodec: "mp4a"}
+	if mediaInfo != expected {
+		t.Errorf("Expected %+v, got %+v", expected, mediaInfo)
+	}
+
+	// moov at the end of the file
+	if _, err = probe("movie.mp4", data[:len(mp4Box("ftyp", []byte("isom")))]); err == nil {
+		t.Error("Expected an error for an MP4 file without moov")
+	}
+}
+
+func TestProbeMatroska(t *testing.T) {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(5400000))
+
+	data := bytes.Join([][]byte{
+		ebmlElement(ebmlHeaderID, ebmlElement(ebmlDocTypeID, []byte("matroska"))),
+		ebmlElement(segmentID,
+			ebmlElement(infoID,
+				ebmlElement(timestampScaleID, []byte{0x0F, 0x42, 0x40}),
+				ebmlElement(durationID, duration),
+			),
+			ebmlElement(tracksID,
+				ebmlElement(trackEntryID,
+					ebmlElement(trackTypeID, []byte{trackTypeVideo}),
+					ebmlElement(codecIDID, []byte("V_MPEG4/ISO/AVC")),
+					ebmlElement(videoID,
+						ebmlElement(pixelWidthID, []byte{0x05, 0x00}),
+						ebmlElement(pixelHeightID, []byte{0x02, 0xD0}),
+					),
+				),
+				ebmlElement(trackEntryID,
+					ebmlElement(trackTypeID, []byte{trackTypeAudio}),
+					ebmlElement(codecIDID, []byte("A_AAC")),
+				),
+			),
+			ebmlElement(clusterID, make([]byte, 1000)),
+		),
+	}, nil)
+
+	mediaInfo, err := probe("movie.mkv", data[:len(data)-500])
+	if err != nil {
+		t.Fatalf("Couldn't probe: %s", err.Error())
+	}
+	expected := persistence.MediaInfo{Path: "movie.mkv", Format: "matroska", Duration: 5400, Width: 1280,
+		Height: 720, VideoCodec: "V_MPEG4/ISO/AVC", AudioCodec: "A_AAC"}
+	if mediaInfo != expected {
+		t.Errorf("Expected %+v, got %+v", expected, mediaInfo)
+	}
+}
+
+func TestProbeImage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 640, 480))); err != nil {
+		t.Fatalf("Couldn't encode: %s", err.Error())
+	}
+
+	mediaInfo, err := probe("cover.PNG", buf.Bytes())
+	if err != nil {
+		t.Fatalf("Couldn't probe: %s", err.Error())
+	}
+	if mediaInfo.Format != "png" || mediaInfo.Width != 640 || mediaInfo.Height != 480 {
+		t.Errorf("Unexpected %+v", mediaInfo)
+	}
+}
+
+func TestFindMedia(t *testing.T) {
+	files := []persistence.File{
+		{Path: "cover.jpg", Size: 1 << 30},
+		{Path: "sample.mkv", Size: 1 << 20},
+		{Path: "movie.mkv", Size: 1 << 28},
+		{Path: "movie.nfo", Size: 100},
+	}
+
+	media, found := findMedia(files)
+	if !found || media.Path != "movie.mkv" || media.Offset != 1<<30+1<<20 {
+		t.Errorf("Unexpected %+v", media)
+	}
+
+	if media, found = findMedia(files[:1]); !found || media.Path != "cover.jpg" {
+		t.Errorf("Unexpected %+v", media)
+	}
+}
@@ -0,0 +1,103 @@
+package bittorrent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// BEP 52 (The BitTorrent Protocol Specification v2) introduces a new info dictionary format, in
+// which the files are described in a `file tree` instead of the `files` list, and the infohash is
+// the SHA-256 (instead of SHA-1) sum of the info dictionary. In the DHT and in the BitTorrent
+// handshake, v2 infohashes are truncated to 20 bytes.
+//
+// Hybrid torrents carry both the v1 and the v2 fields in the same info dictionary, and hence are
+// announced with both infohashes.
+
+// metaVersionV2 is the value of the `meta version` field of v2 (and hybrid) info dictionaries.
+const metaVersionV2 = 2
+
+type v2File struct {
+	Path   []string
+	Length int64
+}
+
+// walkFileTree flattens the `file tree` of a v2 info dictionary into a list of files, ordered by
+// their paths.
+func walkFileTree(tree map[string]interface{}, parents []string) ([]v2File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []v2File
+	for _, name := range names {
+		if name == "" {
+			return nil, errors.New("empty path component in file tree")
+		}
+
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file tree node `%s` is not a dictionary", name)
+		}
+		path := append(append([]string{}, parents...), name)
+
+		// A file is a node with a single key of zero length, whose value is the dictionary that
+		// describes the file.
+		if leaf, exists := node[""]; exists {
+			attrs, ok := leaf.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("file `%s` is not a dictionary", name)
+			}
+			length, ok := attrs["length"].(int64)
+			if !ok || length < 0 {
+				return nil, fmt.Errorf("file `%s` has an invalid length", name)
+			}
+
+			files = append(files, v2File{Path: path, Length: length})
+			continue
+		}
+
+		children, err := walkFileTree(node, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, children...)
+	}
+
+	return files, nil
+}
+
+// validateInfoV2 checks the fields of a v2 info dictionary, and returns its files.
+func validateInfoV2(pieceLength int64, tree map[string]interface{}) ([]v2File, error) {
+	// > It must be a power of two and at least 16KiB.
+	if pieceLength < 16*1024 || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("invalid piece length %d", pieceLength)
+	}
+	if len(tree) == 0 {
+		return nil, errors.New("empty file tree")
+	}
+
+	return walkFileTree(tree, nil)
+}
+
+// v2PersistenceFiles converts the files of a v2-only torrent, and returns them together with the
+// number of pieces, since each file in a v2 torrent starts on a piece boundary.
+func v2PersistenceFiles(pieceLength int64, files []v2File) ([]persistence.File, uint) {
+	var pFiles []persistence.File
+	var nPieces uint
+
+	for _, file := range files {
+		pFiles = append(pFiles, persistence.File{
+			Size: uint64(file.Length),
+			Path: strings.Join(file.Path, "/"),
+		})
+		nPieces += uint((file.Length + pieceLength - 1) / pieceLength)
+	}
+
+	return pFiles, nPieces
+}
@@ -0,0 +1,94 @@
+package bittorrent
+
+import (
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+var metainfoV2Test_fileTrees = []struct {
+	dump  []byte
+	paths []string
+	valid bool
+}{
+	// Single file
+	{
+		dump:  []byte("d8:file.txtd0:d6:lengthi1024e11:pieces root32:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaeee"),
+		paths: []string{"file.txt"},
+		valid: true,
+	},
+	// Nested directories, ordered by their paths
+	{
+		dump:  []byte("d1:bd1:cd0:d6:lengthi2eee1:ad0:d6:lengthi1eeee1:zd0:d6:lengthi3eeee"),
+		paths: []string{"b/a", "b/c", "z"},
+		valid: true,
+	},
+	// Negative length
+	{
+		dump:  []byte("d1:ad0:d6:lengthi-1eeee"),
+		valid: false,
+	},
+	// Node is not a dictionary
+	{
+		dump:  []byte("d1:ai1ee"),
+		valid: false,
+	},
+}
+
+func TestWalkFileTree(t *testing.T) {
+	for i, instance := range metainfoV2Test_fileTrees {
+		var tree map[string]interface{}
+		if err := bencode.Unmarshal(instance.dump, &tree); err != nil {
+			t.Fatalf("Couldn't unmarshal the file tree #%d! %s", i+1, err.Error())
+		}
+
+		files, err := walkFileTree(tree, nil)
+		if !instance.valid {
+			if err == nil {
+				t.Errorf("File tree #%d is invalid but no error is returned!", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Couldn't walk the file tree #%d! %s", i+1, err.Error())
+			continue
+		}
+
+		if len(files) != len(instance.paths) {
+			t.Errorf("File tree #%d has %d files instead of %d!", i+1, len(files), len(instance.paths))
+			continue
+		}
+		pFiles, _ := v2PersistenceFiles(16*1024, files)
+		for j, file := range pFiles {
+			if file.Path != instance.paths[j] {
+				t.Errorf("File #%d of the file tree #%d is `%s` instead of `%s`!", j+1, i+1, file.Path, instance.paths[j])
+			}
+		}
+	}
+}
+
+func TestValidateInfoV2(t *testing.T) {
+	tree := map[string]interface{}{
+		"a": map[string]interface{}{
+			"": map[string]interface{}{"length": int64(40 * 1024)},
+		},
+	}
+
+	for _, pieceLength := range []int64{0, 1024, 24 * 1024} {
+		if _, err := validateInfoV2(pieceLength, tree); err == nil {
+			t.Errorf("Piece length %d is invalid but no error is returned!", pieceLength)
+		}
+	}
+
+	if _, err := validateInfoV2(16*1024, map[string]interface{}{}); err == nil {
+		t.Error("File tree is empty but no error is returned!")
+	}
+
+	files, err := validateInfoV2(16*1024, tree)
+	if err != nil {
+		t.Fatalf("Couldn't validate the info dictionary! %s", err.Error())
+	}
+	if _, nPieces := v2PersistenceFiles(16*1024, files); nPieces != 3 {
+		t.Errorf("Number of pieces is %d instead of 3!", nPieces)
+	}
+}
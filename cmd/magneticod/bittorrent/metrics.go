@@ -0,0 +1,44 @@
+package bittorrent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fetchesStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "magneticod",
+		Subsystem: "metadata",
+		Name:      "fetches_started_total",
+		Help:      "Number of attempts to fetch the metadata of a torrent from a peer.",
+	})
+	fetchesSucceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "magneticod",
+		Subsystem: "metadata",
+		Name:      "fetches_succeeded_total",
+		Help:      "Number of attempts to fetch the metadata of a torrent from a peer that have succeeded.",
+	})
+	fetchesFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "magneticod",
+			Subsystem: "metadata",
+			Name:      "fetches_failed_total",
+			Help:      "Number of attempts to fetch the metadata of a torrent from a peer that have failed, by reason.",
+		},
+		[]string{"reason"},
+	)
+	sinkInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "magneticod",
+		Subsystem: "metadata",
+		Name:      "sink_in_flight",
+		Help:      "Number of torrents whose metadata are being fetched.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(fetchesStarted, fetchesSucceeded, fetchesFailed, sinkInFlight)
+
+	// Initialise all the reasons so that they are exported even before any failures.
+	for reason := FailureReason(0); reason < nFailureReasons; reason++ {
+		fetchesFailed.WithLabelValues(reason.String())
+	}
+}
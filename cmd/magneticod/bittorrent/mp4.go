@@ -0,0 +1,156 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// ISO base media file format (ISO/IEC 14496-12), a.k.a. MP4, files are made of nested boxes, each
+// of which starts with its (32 bits) size and (4 characters) type. We parse only the boxes in the
+// `moov` box that describe the tracks:
+//
+//   moov
+//   ├── mvhd (timescale & duration)
+//   └── trak
+//       ├── tkhd (width & height)
+//       └── mdia
+//           ├── hdlr (handler type: vide or soun)
+//           └── minf
+//               └── stbl
+//                   └── stsd (codec)
+
+// mp4Boxes calls fn for each of the boxes in data, in order. The last box might be truncated, as
+// we have only the beginning of the file, in which case fn is called with whatever there is of it.
+func mp4Boxes(data []byte, fn func(boxType string, body []byte) error) error {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+
+		switch size {
+		case 0: // The box extends to the end of the file.
+			size = uint64(len(data))
+		case 1: // The size is in the 64 bits that follow the type.
+			if len(data) < 16 {
+				return nil
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize {
+			return fmt.Errorf("box `%s` has an invalid size %d", boxType, size)
+		}
+		if size > uint64(len(data)) {
+			size = uint64(len(data))
+		}
+
+		if err := fn(boxType, data[headerSize:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+
+	return nil
+}
+
+func probeMP4(data []byte) (persistence.MediaInfo, error) {
+	mediaInfo := persistence.MediaInfo{Format: "mp4"}
+
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return mediaInfo, errors.New("not an MP4 file")
+	}
+
+	foundMoov := false
+	err := mp4Boxes(data, func(boxType string, body []byte) error {
+		if boxType != "moov" || foundMoov {
+			return nil
+		}
+		foundMoov = true
+		return mp4Boxes(body, func(boxType string, body []byte) error {
+			switch boxType {
+			case "mvhd":
+				mediaInfo.Duration = mvhdDuration(body)
+			case "trak":
+				return probeMP4Track(body, &mediaInfo)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return mediaInfo, err
+	}
+	if !foundMoov {
+		return mediaInfo, fmt.Errorf("no moov box in the first %d bytes", len(data))
+	}
+
+	return mediaInfo, nil
+}
+
+func mvhdDuration(body []byte) float64 {
+	var timescale uint32
+	var duration uint64
+
+	if len(body) >= 32 && body[0] == 1 { // version 1
+		timescale = binary.BigEndian.Uint32(body[20:24])
+		duration = binary.BigEndian.Uint64(body[24:32])
+	} else if len(body) >= 20 { // version 0
+		timescale = binary.BigEndian.Uint32(body[12:16])
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	}
+
+	if timescale == 0 {
+		return 0
+	}
+	return float64(duration) / float64(timescale)
+}
+
+func probeMP4Track(trak []byte, mediaInfo *persistence.MediaInfo) error {
+	var width, height uint
+	var handlerType, codec string
+
+	var walk func(boxType string, body []byte) error
+	walk = func(boxType string, body []byte) error {
+		switch boxType {
+		case "tkhd":
+			// Width and height are the last two fields, in 16.16 fixed point.
+			if len(body) >= 84 {
+				width = uint(binary.BigEndian.Uint32(body[len(body)-8:]) >> 16)
+				height = uint(binary.BigEndian.Uint32(body[len(body)-4:]) >> 16)
+			}
+		case "mdia", "minf", "stbl":
+			return mp4Boxes(body, walk)
+		case "hdlr":
+			if len(body) >= 12 {
+				handlerType = string(body[8:12])
+			}
+		case "stsd":
+			// version & flags (4), entry count (4), and then the first sample entry, which is a box
+			// whose type is the codec.
+			if len(body) >= 16 {
+				codec = strings.TrimSpace(string(body[12:16]))
+			}
+		}
+		return nil
+	}
+	if err := mp4Boxes(trak, walk); err != nil {
+		return err
+	}
+
+	switch handlerType {
+	case "vide":
+		if mediaInfo.VideoCodec == "" {
+			mediaInfo.VideoCodec = codec
+			mediaInfo.Width, mediaInfo.Height = width, height
+		}
+	case "soun":
+		if mediaInfo.AudioCodec == "" {
+			mediaInfo.AudioCodec = codec
+		}
+	}
+
+	return nil
+}
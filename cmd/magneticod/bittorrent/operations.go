@@ -3,13 +3,14 @@ package bittorrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/anacrolix/torrent/bencode"
@@ -21,9 +22,29 @@ import (
 
 const MAX_METADATA_SIZE = 10 * 1024 * 1024
 
+// CLIENT_VERSION is the client name and version we advertise in our extension handshakes.
+const CLIENT_VERSION = "magneticod 0.7.0"
+
+// DEFAULT_REQQ is the number of outstanding requests we assume a peer allows if it does not
+// advertise its `reqq`, which is the default of libtorrent (as noted by BEP 10).
+const DEFAULT_REQQ = 250
+
+// utMetadataID is the extended message ID we assign to ut_metadata (BEP 9) messages, i.e. the ID
+// the remote peer is to use while sending us ut_metadata messages.
+const utMetadataID = 1
+
+// lExtHandshake is our (local) extension handshake (BEP 10).
+type lExtHandshake struct {
+	M      map[string]int `bencode:"m"`
+	V      string         `bencode:"v"`
+	YourIP string         `bencode:"yourip,omitempty"`
+}
+
+// rootDict is the extension handshake of the remote peer.
 type rootDict struct {
 	M            mDict `bencode:"m"`
 	MetadataSize int   `bencode:"metadata_size"`
+	Reqq         int   `bencode:"reqq"`
 }
 
 type mDict struct {
@@ -35,376 +56,591 @@ type extDict struct {
 	Piece   int `bencode:"piece"`
 }
 
-func (ms *MetadataSink) awaitMetadata(infoHash metainfo.Hash, peer Peer) {
-	// this one will be used often, so save it in a variable
-	infoHashString := infoHash.String()
-	conn, err := net.DialTCP("tcp", nil, peer.Addr)
-	if err != nil {
+// infoExtensions holds the fields of the info dictionary that metainfo.Info is not aware of.
+type infoExtensions struct {
+	// See BEP 47 (Padding files and extended file attributes)
+	Attr        string     `bencode:"attr,omitempty"`
+	SymlinkPath []string   `bencode:"symlink path,omitempty"`
+	Files       []fileDict `bencode:"files,omitempty"`
+	// See BEP 52 (The BitTorrent Protocol Specification v2) and metainfoV2.go
+	MetaVersion int                    `bencode:"meta version,omitempty"`
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
+}
+
+type fileDict struct {
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+}
+
+// fetcher holds the state of fetching the metadata of a torrent from a single peer.
+type fetcher struct {
+	clientID      []byte
+	deadline      time.Duration
+	readmeMaxSize uint64
+	probeMedia    bool
+
+	infoHash metainfo.Hash
+	peer     Peer
+	conn     *net.TCPConn
+
+	// reqq is the number of outstanding requests the peer allows.
+	reqq             int
+	utMetadata       int
+	metadataSize     int
+	metadataReceived int
+	metadata         []byte
+	// nPieces is the number of the pieces of the metadata, of which nRequested are requested and
+	// nReceived are received (as recorded in pieceReceived, so that duplicates are not counted).
+	nPieces       int
+	nRequested    int
+	nReceived     int
+	pieceReceived []bool
+
+	// pieces are the SHA-1 sums of the (v1) pieces; interested and unchoked are the states of our
+	// connection to the peer for downloading them (see pieces.go), and peerPieces are those the
+	// peer has (unless peerHasAll), if peerPiecesKnown.
+	pieces          []byte
+	interested      bool
+	unchoked        bool
+	peerPieces      []byte
+	peerHasAll      bool
+	peerPiecesKnown bool
+	// expiry is the deadline of the connection, and downloadTimeout is that of each download.
+	expiry          time.Time
+	downloadTimeout time.Duration
+
+	// fingerprint is what we learn about the client of the peer, if it has sent its handshake.
+	fingerprint *peerFingerprint
+
+	result Metadata
+}
+
+// fetchStep is a single step of fetching the metadata of a torrent, which returns the next step to
+// proceed with (or nil if the fetching is complete), or an error with a FailureReason (see
+// failures.go) if the fetching has failed.
+//
+// The steps are, in order: connect, handshake, extensionHandshake, receiveMetadata, verifyMetadata,
+// parseInfo, and (optionally) fetchReadme and probeMedia.
+type fetchStep func(f *fetcher) (fetchStep, error)
+
+// awaitMetadata tries to fetch the metadata of the torrent from each of the peers in turn, until it
+// is fetched from one of them.
+func (ms *MetadataSink) awaitMetadata(infoHash metainfo.Hash, peers []Peer) {
+	var reason FailureReason
+	for _, peer := range peers {
+		fetchesStarted.Inc()
+		result, err := ms.fetchMetadata(infoHash, peer)
+		if err != nil {
+			reason = reasonOf(err)
+			ms.countFailure(reason)
+			zap.L().Debug(
+				"Couldn't fetch metadata!",
+				zap.String("infoHash", infoHash.String()),
+				zap.String("remotePeerAddr", peer.Addr.String()),
+				zap.Stringer("reason", reason),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		ms.countSuccess()
 		zap.L().Debug(
-			"awaitMetadata couldn't connect to the peer!",
-			zap.String("infoHash", infoHashString),
-			zap.String("remotePeerAddr", peer.Addr.String()),
-			zap.Error(err),
+			"Flushing metadata...",
+			zap.String("infoHash", infoHash.String()),
 		)
+		ms.flush(infoHash, result)
 		return
 	}
-	defer conn.Close()
+
+	ms.fail(Failure{InfoHash: infoHash, Peers: peers, Reason: reason})
+}
+
+// fetchMetadata runs the steps of fetching the metadata of the torrent from the peer, one after
+// the other, until either the metadata is fetched or a step fails.
+func (ms *MetadataSink) fetchMetadata(infoHash metainfo.Hash, peer Peer) (Metadata, error) {
+	f := &fetcher{
+		clientID:        ms.clientID,
+		deadline:        ms.deadline,
+		downloadTimeout: DOWNLOAD_TIMEOUT,
+		readmeMaxSize:   ms.readmeMaxSize,
+		probeMedia:      ms.probeMedia,
+		infoHash:        infoHash,
+		peer:            peer,
+	}
+	defer func() {
+		if f.conn != nil {
+			f.conn.Close()
+		}
+		if f.fingerprint != nil {
+			ms.recordPeer(f.fingerprint)
+		}
+	}()
+
+	var err error
+	for step := fetchStep(connect); step != nil; {
+		if step, err = step(f); err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	return f.result, nil
+}
+
+func connect(f *fetcher) (fetchStep, error) {
+	conn, err := net.DialTCP("tcp", nil, f.peer.Addr)
+	if err != nil {
+		return nil, fail(ConnectFailed, "%s", err.Error())
+	}
+	f.conn = conn
 
 	err = conn.SetNoDelay(true)
 	if err != nil {
 		zap.L().Panic(
 			"Couldn't set NODELAY!",
-			zap.String("infoHash", infoHashString),
-			zap.String("remotePeerAddr", peer.Addr.String()),
+			zap.String("infoHash", f.infoHash.String()),
+			zap.String("remotePeerAddr", f.peer.Addr.String()),
 			zap.Error(err),
 		)
-		return
 	}
-	err = conn.SetDeadline(time.Now().Add(ms.deadline))
+	f.expiry = time.Now().Add(f.deadline)
+	err = conn.SetDeadline(f.expiry)
 	if err != nil {
 		zap.L().Panic(
 			"Couldn't set the deadline!",
-			zap.String("infoHash", infoHashString),
-			zap.String("remotePeerAddr", peer.Addr.String()),
+			zap.String("infoHash", f.infoHash.String()),
+			zap.String("remotePeerAddr", f.peer.Addr.String()),
 			zap.Error(err),
 		)
-		return
 	}
 
-	// State Variables
-	var isExtHandshakeDone, done bool
-	var ut_metadata, metadataReceived, metadataSize int
-	var metadata []byte
+	return handshake, nil
+}
 
+func handshake(f *fetcher) (fetchStep, error) {
 	lHandshake := []byte(fmt.Sprintf(
 		"\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x01%s%s",
-		infoHash[:],
-		ms.clientID,
+		f.infoHash[:],
+		f.clientID,
 	))
 	if len(lHandshake) != 68 {
 		zap.L().Panic(
 			"Generated BitTorrent handshake is not of length 68!",
-			zap.String("infoHash", infoHashString),
+			zap.String("infoHash", f.infoHash.String()),
 			zap.Int("len_lHandshake", len(lHandshake)),
 		)
 	}
-	err = writeAll(conn, lHandshake)
-	if err != nil {
-		zap.L().Debug(
-			"Couldn't write BitTorrent handshake!",
-			zap.String("infoHash", infoHashString),
-			zap.String("remotePeerAddr", peer.Addr.String()),
-			zap.Error(err),
-		)
-		return
+	if err := writeAll(f.conn, lHandshake); err != nil {
+		return nil, failIO(err, "couldn't write BitTorrent handshake")
 	}
 
 	zap.L().Debug("BitTorrent handshake sent, waiting for the remote's...")
 
-	rHandshake, err := readExactly(conn, 68)
+	rHandshake, err := readExactly(f.conn, 68)
 	if err != nil {
-		zap.L().Debug(
-			"Couldn't read remote BitTorrent handshake!",
-			zap.String("infoHash", infoHashString),
-			zap.String("remotePeerAddr", peer.Addr.String()),
-			zap.Error(err),
-		)
-		return
+		return nil, failIO(err, "couldn't read remote BitTorrent handshake")
 	}
 	if !bytes.HasPrefix(rHandshake, []byte("\x13BitTorrent protocol")) {
-		zap.L().Debug(
-			"Remote BitTorrent handshake is not what it is supposed to be!",
-			zap.String("infoHash", infoHashString),
-			zap.String("remotePeerAddr", peer.Addr.String()),
-			zap.ByteString("rHandshake[:20]", rHandshake[:20]),
-		)
-		return
+		return nil, fail(ProtocolViolation, "remote BitTorrent handshake is not what it is supposed to be: %q", rHandshake[:20])
 	}
+	f.fingerprint = &peerFingerprint{Client: peerIDClient(rHandshake[48:68])}
 
 	// __on_bt_handshake
 	// ================
-	if rHandshake[25] != 16 { // TODO (later): do *not* compare the whole byte, check the bit instead! (0x10)
-		zap.L().Debug(
-			"Peer does not support the extension protocol!",
-			zap.String("infoHash", infoHashString),
-			zap.String("remotePeerAddr", peer.Addr.String()),
-		)
-		return
+	// The 20th bit from the right of the 8 reserved bytes (that follow the protocol string) is set
+	// by the peers who support the extension protocol.
+	if rHandshake[20+5]&0x10 == 0 {
+		return nil, fail(NoExtensionSupport, "peer does not support the extension protocol")
 	}
 
-	writeAll(conn, []byte("\x00\x00\x00\x1a\x14\x00d1:md11:ut_metadatai1eee"))
+	return extensionHandshake, nil
+}
+
+func extensionHandshake(f *fetcher) (fetchStep, error) {
+	handshake := lExtHandshake{
+		M: map[string]int{"ut_metadata": utMetadataID},
+		V: CLIENT_VERSION,
+	}
+	// BEP 10 suggests telling the peer its IP address (in the compact form), as seen by us.
+	if ip4 := f.peer.Addr.IP.To4(); ip4 != nil {
+		handshake.YourIP = string(ip4)
+	} else {
+		handshake.YourIP = string(f.peer.Addr.IP.To16())
+	}
+	handshakeDump, err := bencode.Marshal(handshake)
+	if err != nil {
+		zap.L().Panic("Couldn't marshal our extension handshake!", zap.Error(err))
+	}
+
+	if err = f.writeExtMessage(0, handshakeDump); err != nil {
+		return nil, failIO(err, "couldn't write extension handshake")
+	}
 	zap.L().Debug(
 		"Extension handshake sent, waiting for the remote's...",
-		zap.String("infoHash", infoHashString),
-		zap.String("remotePeerAddr", peer.Addr.String()),
+		zap.String("infoHash", f.infoHash.String()),
+		zap.String("remotePeerAddr", f.peer.Addr.String()),
 	)
 
-	// the loop!
-	// =========
-	for !done {
-		rLengthB, err := readExactly(conn, 4)
+	return receiveMetadata, nil
+}
+
+// receiveMetadata is the loop in which we wait for the extension handshake of the remote peer, and
+// then request and receive the pieces of the metadata.
+func receiveMetadata(f *fetcher) (fetchStep, error) {
+	isExtHandshakeDone := false
+
+	for {
+		rLengthB, err := readExactly(f.conn, 4)
 		if err != nil {
-			zap.L().Debug(
-				"Couldn't read the first 4 bytes from the remote peer in the loop!",
-				zap.String("infoHash", infoHashString),
-				zap.String("remotePeerAddr", peer.Addr.String()),
-				zap.Error(err),
-			)
-			return
+			return nil, failIO(err, "couldn't read the length of the message")
 		}
 
-		// The messages we are interested in have the length of AT LEAST two bytes
-		// (TODO: actually a bit more than that but SURELY when it's less than two bytes, the
-		//        program panics)
 		rLength := bigEndianToInt(rLengthB)
-		if rLength < 2 {
+		if rLength == 0 { // keep-alive
 			continue
 		}
+		// No message we are interested in is bigger than the metadata and the two bytes of the
+		// header of extension messages.
+		if rLength > MAX_METADATA_SIZE+2 {
+			return nil, fail(SizeLimit, "message is too big (%d bytes)", rLength)
+		}
 
-		rMessage, err := readExactly(conn, rLength)
+		// Messages of a single byte (e.g. choke, unchoke, and interested) are read too, so that
+		// the next message is read from its beginning.
+		rMessage, err := readExactly(f.conn, rLength)
 		if err != nil {
-			zap.L().Debug(
-				"Couldn't read the rest of the message from the remote peer in the loop!",
-				zap.String("infoHash", infoHashString),
-				zap.String("remotePeerAddr", peer.Addr.String()),
-				zap.Error(err),
-			)
-			return
+			return nil, failIO(err, "couldn't read the rest of the message")
 		}
 
 		// __on_message
 		// ------------
 		if rMessage[0] != 0x14 { // We are interested only in extension messages, whose first byte is always 0x14
+			// ... and in the pieces the peer has, in case we download some of them afterwards.
+			f.onPeerPieces(rMessage)
 			zap.L().Debug(
 				"Ignoring the non-extension message.",
-				zap.String("infoHash", infoHashString),
+				zap.String("infoHash", f.infoHash.String()),
 			)
 			continue
 		}
+		if len(rMessage) < 2 {
+			return nil, fail(ProtocolViolation, "received an extension message without an extended message ID")
+		}
 
 		if rMessage[1] == 0x00 { // Extension Handshake has the Extension Message ID = 0x00
 			// __on_ext_handshake_message(message[2:])
 			// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
-
-			// TODO: continue editing log messages from here
-
 			if isExtHandshakeDone {
-				return
+				return nil, fail(ProtocolViolation, "received a second extension handshake")
 			}
 
+			f.fingerprint.parseExtHandshake(rMessage[2:])
+
 			rRootDict := new(rootDict)
 			err := bencode.Unmarshal(rMessage[2:], rRootDict)
 			if err != nil {
-				zap.L().Debug("Couldn't unmarshal extension handshake!", zap.Error(err))
-				return
+				return nil, fail(ProtocolViolation, "couldn't unmarshal extension handshake: %s", err.Error())
 			}
 
-			if rRootDict.MetadataSize <= 0 || rRootDict.MetadataSize > MAX_METADATA_SIZE {
-				zap.L().Debug("Unacceptable metadata size!", zap.Int("metadata_size", rRootDict.MetadataSize))
-				return
+			// Extended message IDs are a single byte, and zero means that the extension is not
+			// supported (or disabled).
+			if rRootDict.M.UTMetadata <= 0 || rRootDict.M.UTMetadata > 255 {
+				return nil, fail(NoExtensionSupport, "peer does not support the metadata extension")
+			}
+			// An info dictionary of a torrent of a single file (with a name of a single byte) and
+			// a single piece is at least 50 bytes long.
+			if rRootDict.MetadataSize < 50 || rRootDict.MetadataSize > MAX_METADATA_SIZE {
+				return nil, fail(SizeLimit, "unacceptable metadata size %d", rRootDict.MetadataSize)
+			}
+			if rRootDict.Reqq < 0 {
+				return nil, fail(ProtocolViolation, "invalid reqq %d", rRootDict.Reqq)
 			}
 
-			ut_metadata = rRootDict.M.UTMetadata // Save the ut_metadata code the remote peer uses
-			metadataSize = rRootDict.MetadataSize
-			metadata = make([]byte, metadataSize)
+			f.utMetadata = rRootDict.M.UTMetadata // Save the ut_metadata code the remote peer uses
+			f.metadataSize = rRootDict.MetadataSize
+			f.metadata = make([]byte, f.metadataSize)
+			f.nPieces = (f.metadataSize + 16*1024 - 1) / (16 * 1024)
+			f.pieceReceived = make([]bool, f.nPieces)
+			f.reqq = rRootDict.Reqq
+			if f.reqq == 0 {
+				f.reqq = DEFAULT_REQQ
+			}
 			isExtHandshakeDone = true
 
-			zap.L().Debug("GOT EXTENSION HANDSHAKE!", zap.Int("ut_metadata", ut_metadata), zap.Int("metadata_size", metadataSize))
-
-			// Request all the pieces of metadata
-			n_pieces := int(math.Ceil(float64(metadataSize) / math.Pow(2, 14)))
-			for piece := 0; piece < n_pieces; piece++ {
-				// __request_metadata_piece(piece)
-				// ...............................
-				extDictDump, err := bencode.Marshal(extDict{
-					MsgType: 0,
-					Piece:   piece,
-				})
-				if err != nil {
-					zap.L().Warn("Couldn't marshal extDictDump!", zap.Error(err))
-					return
-				}
-				writeAll(conn, []byte(fmt.Sprintf(
-					"%s\x14%s%s",
-					intToBigEndian(2+len(extDictDump), 4),
-					intToBigEndian(ut_metadata, 1),
-					extDictDump,
-				)))
-			}
+			zap.L().Debug("GOT EXTENSION HANDSHAKE!", zap.Int("ut_metadata", f.utMetadata),
+				zap.Int("metadata_size", f.metadataSize), zap.Int("reqq", f.reqq))
 
-			zap.L().Warn("requested all metadata pieces!")
+			if err = f.requestPieces(); err != nil {
+				return nil, err
+			}
 
-		} else if rMessage[1] == 0x01 {
+		} else if rMessage[1] == utMetadataID {
 			// __on_ext_message(message[2:])
 			// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+			if !isExtHandshakeDone {
+				return nil, fail(ProtocolViolation, "received an ut_metadata message before the extension handshake")
+			}
 
-			// Run TestDecoder() function in operations_test.go in case you have any doubts.
-			rMessageBuf := bytes.NewBuffer(rMessage[2:])
-			rExtDict := new(extDict)
-			err := bencode.NewDecoder(rMessageBuf).Decode(rExtDict)
+			done, err := f.onExtMessage(rMessage)
 			if err != nil {
-				zap.L().Warn("Couldn't decode extension message in the loop!", zap.Error(err))
-				return
+				return nil, err
 			}
-
-			if rExtDict.MsgType == 1 { // data
-				// Get the unread bytes!
-				metadataPiece := rMessageBuf.Bytes()
-				piece := rExtDict.Piece
-				// metadata[piece * 2**14: piece * 2**14 + len(metadataPiece)] = metadataPiece is how it'd be done in Python
-				copy(metadata[piece*int(math.Pow(2, 14)):piece*int(math.Pow(2, 14))+len(metadataPiece)], metadataPiece)
-				metadataReceived += len(metadataPiece)
-				done = metadataReceived == metadataSize
-
-				// BEP 9 explicitly states:
-				//   > If the piece is the last piece of the metadata, it may be less than 16kiB. If
-				//   > it is not the last piece of the metadata, it MUST be 16kiB.
-				//
-				// Hence...
-				//   ... if the length of @metadataPiece is more than 16kiB, we err.
-				if len(metadataPiece) > 16*1024 {
-					zap.L().Debug(
-						"metadataPiece is bigger than 16kiB!",
-						zap.Int("len_metadataPiece", len(metadataPiece)),
-						zap.Int("metadataReceived", metadataReceived),
-						zap.Int("metadataSize", metadataSize),
-						zap.Int("metadataPieceIndex", bytes.Index(rMessage, metadataPiece)),
-					)
-					return
-				}
-
-				// ... if the length of @metadataPiece is less than 16kiB AND metadata is NOT
-				// complete (!done) then we err.
-				if len(metadataPiece) < 16*1024 && !done {
-					zap.L().Debug(
-						"metadataPiece is less than 16kiB and metadata is incomplete!",
-						zap.Int("len_metadataPiece", len(metadataPiece)),
-						zap.Int("metadataReceived", metadataReceived),
-						zap.Int("metadataSize", metadataSize),
-						zap.Int("metadataPieceIndex", bytes.Index(rMessage, metadataPiece)),
-					)
-					return
-				}
-
-				if metadataReceived > metadataSize {
-					zap.L().Debug(
-						"metadataReceived is greater than metadataSize!",
-						zap.Int("len_metadataPiece", len(metadataPiece)),
-						zap.Int("metadataReceived", metadataReceived),
-						zap.Int("metadataSize", metadataSize),
-						zap.Int("metadataPieceIndex", bytes.Index(rMessage, metadataPiece)),
-					)
-					return
-				}
-
-				zap.L().Debug(
-					"Fetching...",
-					zap.String("infoHash", infoHashString),
-					zap.String("remotePeerAddr", conn.RemoteAddr().String()),
-					zap.Int("metadataReceived", metadataReceived),
-					zap.Int("metadataSize", metadataSize),
-				)
-			} else if rExtDict.MsgType == 2 { // reject
-				zap.L().Debug(
-					"Remote peer rejected sending metadata!",
-					zap.String("infoHash", infoHashString),
-					zap.String("remotePeerAddr", conn.RemoteAddr().String()),
-				)
-				return
+			if done {
+				return verifyMetadata, nil
 			}
 
 		} else {
+			if len(rMessage) > 100 {
+				rMessage = rMessage[:100]
+			}
 			zap.L().Debug(
 				"Message is not an ut_metadata message! (ignoring)",
-				zap.ByteString("msg", rMessage[:100]),
+				zap.ByteString("msg", rMessage),
 			)
 			// no return!
 		}
 	}
+}
+
+// requestPieces requests the pieces of the metadata that are not requested yet, as many as the peer
+// allows to be outstanding.
+func (f *fetcher) requestPieces() error {
+	for ; f.nRequested < f.nPieces && f.nRequested-f.nReceived < f.reqq; f.nRequested++ {
+		// __request_metadata_piece(piece)
+		// ...............................
+		extDictDump, err := bencode.Marshal(extDict{
+			MsgType: 0,
+			Piece:   f.nRequested,
+		})
+		if err != nil {
+			zap.L().Panic("Couldn't marshal extDictDump!", zap.Error(err))
+		}
+		if err = f.writeExtMessage(f.utMetadata, extDictDump); err != nil {
+			return failIO(err, "couldn't request metadata piece")
+		}
+	}
+
+	return nil
+}
+
+// writeExtMessage writes an extension message (BEP 10) of the given extended message ID.
+func (f *fetcher) writeExtMessage(id int, payload []byte) error {
+	return writeAll(f.conn, []byte(fmt.Sprintf(
+		"%s\x14%s%s",
+		intToBigEndian(2+len(payload), 4),
+		intToBigEndian(id, 1),
+		payload,
+	)))
+}
+
+// onExtMessage handles an ut_metadata message, and reports whether the metadata is complete.
+func (f *fetcher) onExtMessage(rMessage []byte) (bool, error) {
+	// Run TestDecoder() function in operations_test.go in case you have any doubts.
+	rMessageBuf := bytes.NewBuffer(rMessage[2:])
+	rExtDict := new(extDict)
+	err := bencode.NewDecoder(rMessageBuf).Decode(rExtDict)
+	if err != nil {
+		return false, fail(ProtocolViolation, "couldn't decode extension message: %s", err.Error())
+	}
+
+	if rExtDict.MsgType == 2 { // reject
+		return false, fail(Rejected, "remote peer rejected sending metadata piece %d", rExtDict.Piece)
+	} else if rExtDict.MsgType != 1 { // not data
+		return false, nil
+	}
+
+	// Get the unread bytes!
+	metadataPiece := rMessageBuf.Bytes()
+	piece := rExtDict.Piece
+	pieceStart := piece * 16 * 1024
+	if piece < 0 || piece >= f.nPieces || pieceStart+len(metadataPiece) > f.metadataSize {
+		return false, fail(ProtocolViolation, "metadata piece %d (of %d bytes) is out of bounds", piece, len(metadataPiece))
+	}
+
+	// BEP 9 explicitly states:
+	//   > If the piece is the last piece of the metadata, it may be less than 16kiB. If
+	//   > it is not the last piece of the metadata, it MUST be 16kiB.
+	//
+	// Hence...
+	//   ... if the length of @metadataPiece is more than 16kiB, we err.
+	if len(metadataPiece) > 16*1024 {
+		return false, fail(ProtocolViolation, "metadata piece is bigger than 16kiB (%d bytes)", len(metadataPiece))
+	}
+
+	// A piece that is received again is ignored, so that it is not counted twice.
+	if f.pieceReceived[piece] {
+		return false, nil
+	}
+	f.pieceReceived[piece] = true
+
+	// metadata[piece * 2**14: piece * 2**14 + len(metadataPiece)] = metadataPiece is how it'd be done in Python
+	copy(f.metadata[pieceStart:pieceStart+len(metadataPiece)], metadataPiece)
+	f.metadataReceived += len(metadataPiece)
+	done := f.metadataReceived == f.metadataSize
+
+	// ... if the length of @metadataPiece is less than 16kiB AND metadata is NOT
+	// complete (!done) then we err.
+	if len(metadataPiece) < 16*1024 && !done {
+		return false, fail(ProtocolViolation, "metadata piece is less than 16kiB (%d bytes) and metadata is incomplete", len(metadataPiece))
+	}
+
+	if f.metadataReceived > f.metadataSize {
+		return false, fail(ProtocolViolation, "received %d bytes of metadata of size %d", f.metadataReceived, f.metadataSize)
+	}
+
+	zap.L().Debug(
+		"Fetching...",
+		zap.String("infoHash", f.infoHash.String()),
+		zap.String("remotePeerAddr", f.peer.Addr.String()),
+		zap.Int("metadataReceived", f.metadataReceived),
+		zap.Int("metadataSize", f.metadataSize),
+	)
+
+	f.nReceived++
+	if err = f.requestPieces(); err != nil {
+		return false, err
+	}
+
+	return done, nil
+}
 
+func verifyMetadata(f *fetcher) (fetchStep, error) {
 	zap.L().Debug(
 		"Metadata is complete, verifying the checksum...",
-		zap.String("infoHash", infoHashString),
+		zap.String("infoHash", f.infoHash.String()),
 	)
 
-	sha1Sum := sha1.Sum(metadata)
-	if !bytes.Equal(sha1Sum[:], infoHash[:]) {
-		zap.L().Debug(
-			"Info-hash mismatch!",
-			zap.String("expectedInfoHash", infoHash.String()),
-			zap.String("actualInfoHash", hex.EncodeToString(sha1Sum[:])),
-		)
-		return
+	// The infohash we have been looking for is either the SHA-1 sum of the info dictionary (v1 and
+	// hybrid torrents), or its SHA-256 sum truncated to 20 bytes (v2 and hybrid torrents).
+	sha1Sum := sha1.Sum(f.metadata)
+	sha256Sum := sha256.Sum256(f.metadata)
+	if !bytes.Equal(sha1Sum[:], f.infoHash[:]) && !bytes.Equal(sha256Sum[:20], f.infoHash[:]) {
+		return nil, fail(HashMismatch, "expected %s, got %s (v1) and %s (v2)", f.infoHash.String(),
+			hex.EncodeToString(sha1Sum[:]), hex.EncodeToString(sha256Sum[:]))
 	}
 
+	return parseInfo, nil
+}
+
+func parseInfo(f *fetcher) (fetchStep, error) {
 	zap.L().Debug(
 		"Checksum verified, checking the info dictionary...",
-		zap.String("infoHash", infoHashString),
+		zap.String("infoHash", f.infoHash.String()),
 	)
 
+	sha1Sum := sha1.Sum(f.metadata)
+	sha256Sum := sha256.Sum256(f.metadata)
+	isV1InfoHash := bytes.Equal(sha1Sum[:], f.infoHash[:])
+	isV2InfoHash := bytes.Equal(sha256Sum[:20], f.infoHash[:])
+
 	info := new(metainfo.Info)
-	err = bencode.Unmarshal(metadata, info)
+	err := bencode.Unmarshal(f.metadata, info)
 	if err != nil {
-		zap.L().Debug(
-			"Couldn't unmarshal info bytes!",
-			zap.String("infoHash", infoHashString),
-			zap.Error(err),
-		)
-		return
+		return nil, fail(InvalidInfo, "couldn't unmarshal info bytes: %s", err.Error())
 	}
-	err = validateInfo(info)
+
+	infoExt := new(infoExtensions)
+	err = bencode.Unmarshal(f.metadata, infoExt)
 	if err != nil {
-		zap.L().Debug(
-			"Bad info dictionary!",
-			zap.String("infoHash", infoHashString),
-			zap.Error(err),
-		)
-		return
+		return nil, fail(InvalidInfo, "couldn't unmarshal the extensions of info bytes: %s", err.Error())
+	}
+
+	// A v1 info dictionary is recognised by its `pieces`, and a v2 one by its `meta version`;
+	// hybrid ones have both.
+	hasV1 := len(info.Pieces) != 0
+	hasV2 := infoExt.MetaVersion == metaVersionV2
+	if (isV1InfoHash && !hasV1) || (isV2InfoHash && !hasV2) {
+		return nil, fail(InvalidInfo, "info dictionary does not match the version of the infohash (v1: %t, v2: %t)", hasV1, hasV2)
+	}
+
+	if hasV1 {
+		if err = validateInfo(info); err != nil {
+			return nil, fail(InvalidInfo, "bad info dictionary: %s", err.Error())
+		}
+	}
+	var v2Files []v2File
+	if hasV2 {
+		if v2Files, err = validateInfoV2(info.PieceLength, infoExt.FileTree); err != nil {
+			return nil, fail(InvalidInfo, "bad v2 info dictionary: %s", err.Error())
+		}
+	}
+
+	if len(infoExt.Files) != len(info.Files) {
+		return nil, fail(InvalidInfo, "number of files in the info dictionary is at odds (%d and %d)", len(info.Files), len(infoExt.Files))
 	}
 
 	var files []persistence.File
-	// If there is only one file, there won't be a Files slice. That's why we need to add it here
-	if len(info.Files) == 0 {
+	nPieces := uint(info.NumPieces())
+	// v2-only torrents have neither `length` nor `files` but a `file tree`, whereas hybrid torrents
+	// describe the same files in both (but with padding files in the v1 part), so prefer the latter
+	// for the sake of BEP 47 attributes.
+	if !hasV1 {
+		files, nPieces = v2PersistenceFiles(info.PieceLength, v2Files)
+	} else if len(info.Files) == 0 {
+		// If there is only one file, there won't be a Files slice. That's why we need to add it here
 		files = append(files, persistence.File{
-			Size: uint64(info.Length),
-			Path: info.Name,
+			Size:        uint64(info.Length),
+			Path:        info.Name,
+			Attributes:  infoExt.Attr,
+			SymlinkPath: strings.Join(infoExt.SymlinkPath, "/"),
 		})
 	}
 
-	for _, file := range info.Files {
+	for i, file := range info.Files {
 		if file.Length < 0 {
-			zap.L().Debug(
-				"File size is less than zero!",
-				zap.String("infoHash", infoHashString),
-				zap.String("filePath", file.DisplayPath(info)),
-				zap.Int64("fileSize", file.Length),
-			)
-			return
+			return nil, fail(InvalidInfo, "size of file `%s` is less than zero (%d)", file.DisplayPath(info), file.Length)
 		}
 
 		files = append(files, persistence.File{
-			Size: uint64(file.Length),
-			Path: file.DisplayPath(info),
+			Size:        uint64(file.Length),
+			Path:        file.DisplayPath(info),
+			Attributes:  infoExt.Files[i].Attr,
+			SymlinkPath: strings.Join(infoExt.Files[i].SymlinkPath, "/"),
 		})
 	}
 
 	var totalSize uint64
 	for _, file := range files {
-		totalSize += uint64(file.Size)
+		if !file.IsPadding() {
+			totalSize += uint64(file.Size)
+		}
 	}
 
-	zap.L().Debug(
-		"Flushing metadata...",
-		zap.String("infoHash", infoHashString),
-	)
+	// Torrents are keyed by their v1 infohash whenever they have one, so that a hybrid torrent is
+	// stored only once regardless of the infohash it is discovered by.
+	var storedInfoHash, infoHashV2 []byte
+	if hasV1 {
+		storedInfoHash = sha1Sum[:]
+	} else {
+		storedInfoHash = sha256Sum[:20]
+	}
+	if hasV2 {
+		infoHashV2 = sha256Sum[:]
+	}
 
-	ms.flush(Metadata{
-		InfoHash:     infoHash[:],
+	f.result = Metadata{
+		InfoHash:     storedInfoHash,
 		Name:         info.Name,
 		TotalSize:    totalSize,
 		DiscoveredOn: time.Now().Unix(),
 		Files:        files,
-	})
+		Info:         f.metadata,
+		InfoMetadata: persistence.InfoMetadata{
+			PieceLength: uint64(info.PieceLength),
+			NPieces:     nPieces,
+			Private:     info.Private != nil && *info.Private,
+			Source:      info.Source,
+			InfoHashV2:  infoHashV2,
+		},
+	}
+
+	// Files can be downloaded only from torrents with v1 pieces, since v2 torrents do not carry the
+	// hashes of their pieces in the info dictionary.
+	if hasV1 {
+		f.pieces = info.Pieces
+		return fetchReadme, nil
+	}
+
+	return nil, nil
 }
 
 // COPIED FROM anacrolix/torrent
@@ -2,9 +2,15 @@ package bittorrent
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
 )
 
 var operationsTest_instances = []struct {
@@ -42,3 +48,166 @@ func TestDecoder(t *testing.T) {
 		}
 	}
 }
+
+// metadataPeer is a fake peer that serves the given metadata, and reports (through the returned
+// channel) whether we have ever exceeded its reqq or sent an invalid extension handshake. The
+// preamble is written before its extension handshake, and if duplicatePieces is set, it sends
+// every piece twice.
+func metadataPeer(t *testing.T, metadata []byte, reqq int, preamble []byte, duplicatePieces bool) (*net.TCPAddr, <-chan string) {
+	violations := make(chan string, 16)
+	const utMetadata = 3
+
+	readMessage := func(conn net.Conn) ([]byte, error) {
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		message := make([]byte, binary.BigEndian.Uint32(length))
+		_, err := io.ReadFull(conn, message)
+		return message, err
+	}
+	writeExtMessage := func(conn net.Conn, id byte, payload []byte) {
+		message := make([]byte, 6)
+		binary.BigEndian.PutUint32(message, uint32(2+len(payload)))
+		message[4], message[5] = 0x14, id
+		conn.Write(append(message, payload...))
+	}
+
+	addr := fakePeer(t, func(conn net.Conn) {
+		defer close(violations)
+
+		lHandshake := make([]byte, 68)
+		if _, err := io.ReadFull(conn, lHandshake); err != nil {
+			return
+		}
+		if lHandshake[25]&0x10 == 0 {
+			violations <- "extension bit is not set"
+		}
+		rHandshake := append([]byte{}, lHandshake...)
+		copy(rHandshake[48:], "-qB4150-abcdefghijkl")
+		rHandshake[20+7] |= 0x04 // Fast extension, which shall not confuse the extension bit test.
+		conn.Write(rHandshake)
+
+		extHandshake, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		var handshake struct {
+			M map[string]int `bencode:"m"`
+			V string         `bencode:"v"`
+		}
+		if err = bencode.Unmarshal(extHandshake[2:], &handshake); err != nil || handshake.M["ut_metadata"] == 0 ||
+			handshake.V != CLIENT_VERSION {
+			violations <- fmt.Sprintf("invalid extension handshake %q", extHandshake)
+			return
+		}
+		dump, _ := bencode.Marshal(map[string]int{
+			"metadata_size": len(metadata),
+			"reqq":          reqq,
+		})
+		// Insert the `m` dictionary by hand, as maps of different value types cannot be marshalled
+		// together.
+		dump = append([]byte(fmt.Sprintf("d1:md11:ut_metadatai%dee", utMetadata)), dump[1:]...)
+		conn.Write(preamble)
+		writeExtMessage(conn, 0, dump)
+
+		var pending []int
+		for {
+			// Collect the requests that arrive in a short while, which are outstanding.
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			message, err := readMessage(conn)
+			if err == nil {
+				if message[0] != 0x14 || message[1] != utMetadata {
+					violations <- fmt.Sprintf("unexpected message %q", message)
+					return
+				}
+				request := new(extDict)
+				if err = bencode.Unmarshal(message[2:], request); err != nil {
+					return
+				}
+				pending = append(pending, request.Piece)
+				if len(pending) > reqq {
+					violations <- fmt.Sprintf("%d outstanding requests", len(pending))
+				}
+				continue
+			} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				return
+			}
+
+			for _, piece := range pending {
+				start := piece * 16 * 1024
+				end := start + 16*1024
+				if end > len(metadata) {
+					end = len(metadata)
+				}
+				dump, _ := bencode.Marshal(extDict{MsgType: 1, Piece: piece})
+				writeExtMessage(conn, utMetadataID, append(dump, metadata[start:end]...))
+				if duplicatePieces {
+					writeExtMessage(conn, utMetadataID, append(dump, metadata[start:end]...))
+				}
+			}
+			pending = nil
+		}
+	})
+
+	return addr, violations
+}
+
+// testInfo returns an info dictionary whose metadata is a few pieces long.
+func testInfo(t *testing.T) (metainfo.Info, []byte) {
+	const nPieces = 2000
+	info := metainfo.Info{
+		Name:        "magnetico.iso",
+		PieceLength: 16 * 1024,
+		Length:      nPieces * 16 * 1024,
+		Pieces:      make([]byte, nPieces*20),
+	}
+	metadata, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("Couldn't marshal info: %s", err.Error())
+	}
+	return info, metadata
+}
+
+func TestFetchMetadata(t *testing.T) {
+	info, metadata := testInfo(t)
+	infoHash := metainfo.HashBytes(metadata)
+
+	addr, violations := metadataPeer(t, metadata, 1, nil, false)
+	ms := NewMetadataSink(5*time.Second, 0, false)
+	result, err := ms.fetchMetadata(infoHash, Peer{Addr: addr})
+	if err != nil {
+		t.Fatalf("Couldn't fetch metadata: %s", err.Error())
+	}
+
+	if result.Name != info.Name || result.TotalSize != uint64(info.Length) || !bytes.Equal(result.Info, metadata) {
+		t.Errorf("Unexpected metadata %s of %d bytes", result.Name, result.TotalSize)
+	}
+	if client := ms.FlushPeerStatistics().Clients["qB"]; client != 1 {
+		t.Errorf("Expected the peer to be counted once, got %d", client)
+	}
+	for violation := range violations {
+		t.Error(violation)
+	}
+}
+
+func TestFetchMetadata_OtherMessages(t *testing.T) {
+	info, metadata := testInfo(t)
+	infoHash := metainfo.HashBytes(metadata)
+
+	// A keep-alive, an unchoke, an interested (both of which are a single byte long), and a have.
+	preamble := []byte("\x00\x00\x00\x00\x00\x00\x00\x01\x01\x00\x00\x00\x01\x02\x00\x00\x00\x05\x04\x00\x00\x00\x07")
+	addr, violations := metadataPeer(t, metadata, 4, preamble, true)
+	ms := NewMetadataSink(5*time.Second, 0, false)
+	result, err := ms.fetchMetadata(infoHash, Peer{Addr: addr})
+	if err != nil {
+		t.Fatalf("Couldn't fetch metadata: %s", err.Error())
+	}
+
+	if result.Name != info.Name || !bytes.Equal(result.Info, metadata) {
+		t.Errorf("Unexpected metadata %s of %d bytes", result.Name, result.TotalSize)
+	}
+	for violation := range violations {
+		t.Error(violation)
+	}
+}
@@ -0,0 +1,239 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// MAX_DOWNLOAD_SIZE is the maximum number of bytes we download from a peer to fetch (a part of) a
+// file of a torrent. Since we can verify only whole pieces, the pieces a file spans might be much
+// bigger than the part of the file we are interested in.
+const MAX_DOWNLOAD_SIZE = 8 * 1024 * 1024
+
+// blockSize is the size of the blocks pieces are requested in, as virtually all clients reject
+// requests of bigger blocks.
+const blockSize = 16 * 1024
+
+// DOWNLOAD_TIMEOUT is how long we wait for (a part of) a file to be downloaded from a peer, which
+// might never unchoke us, before giving up on it and returning the metadata without it.
+const DOWNLOAD_TIMEOUT = 15 * time.Second
+
+// Message IDs of the BitTorrent protocol (BEP 3), and of the Fast Extension (BEP 6).
+const (
+	msgChoke         = 0
+	msgUnchoke       = 1
+	msgInterested    = 2
+	msgHave          = 4
+	msgBitfield      = 5
+	msgRequest       = 6
+	msgPiece         = 7
+	msgHaveAll       = 0x0e
+	msgHaveNone      = 0x0f
+	msgRejectRequest = 0x10
+)
+
+// torrentFile is a file of a torrent that is chosen to be (partially) downloaded.
+type torrentFile struct {
+	Path string
+	// Offset is the offset of the file in the concatenation of all the files of the torrent (i.e.
+	// in the v1 piece space).
+	Offset int64
+	Size   int64
+}
+
+// download downloads the bytes [offset, offset + length) of a v1 (or hybrid) torrent from the peer,
+// after the metadata is fetched, by downloading and verifying the pieces they span.
+func (f *fetcher) download(offset int64, length int64) ([]byte, error) {
+	pieceLength := int64(f.result.PieceLength)
+	firstPiece := offset / pieceLength
+	lastPiece := (offset + length - 1) / pieceLength
+	if (lastPiece-firstPiece+1)*pieceLength > MAX_DOWNLOAD_SIZE {
+		return nil, fmt.Errorf("pieces are too big to download (%d pieces of %d bytes)",
+			lastPiece-firstPiece+1, pieceLength)
+	}
+	if int64(len(f.pieces)) < (lastPiece+1)*20 {
+		return nil, fmt.Errorf("torrent has fewer pieces than its files span")
+	}
+
+	// The last piece of a torrent might be shorter than the others.
+	var torrentLength int64
+	for _, file := range f.result.Files {
+		torrentLength += int64(file.Size)
+	}
+	downloadStart := firstPiece * pieceLength
+	downloadEnd := (lastPiece + 1) * pieceLength
+	if downloadEnd > torrentLength {
+		downloadEnd = torrentLength
+	}
+	for piece := firstPiece; piece <= lastPiece; piece++ {
+		if f.peerLacks(piece) {
+			return nil, fmt.Errorf("peer does not have piece %d", piece)
+		}
+	}
+
+	// The download has a deadline of its own, shorter than that of the connection, after which the
+	// connection is given its deadline back.
+	if f.downloadTimeout != 0 {
+		deadline := time.Now().Add(f.downloadTimeout)
+		if !f.expiry.IsZero() && f.expiry.Before(deadline) {
+			deadline = f.expiry
+		}
+		if err := f.conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("couldn't set the deadline: %s", err.Error())
+		}
+		defer f.conn.SetDeadline(f.expiry)
+	}
+
+	download := make([]byte, downloadEnd-downloadStart)
+	nBlocks := (int64(len(download)) + blockSize - 1) / blockSize
+	received := make(map[int64]bool) // offsets of the blocks received, relative to downloadStart
+
+	if !f.interested {
+		if err := writeAll(f.conn, []byte{0, 0, 0, 1, msgInterested}); err != nil {
+			return nil, fmt.Errorf("couldn't write interested: %s", err.Error())
+		}
+		f.interested = true
+	}
+
+	var nRequested int64
+	for int64(len(received)) < nBlocks {
+		// Keep as many requests outstanding as the peer allows.
+		for ; f.unchoked && nRequested < nBlocks && nRequested-int64(len(received)) < int64(f.reqq); nRequested++ {
+			if err := f.requestBlock(downloadStart, nRequested*blockSize, int64(len(download))); err != nil {
+				return nil, err
+			}
+		}
+
+		rLengthB, err := readExactly(f.conn, 4)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the length of the message: %s", err.Error())
+		}
+		rLength := bigEndianToInt(rLengthB)
+		if rLength == 0 { // keep-alive
+			continue
+		}
+		if rLength > MAX_METADATA_SIZE {
+			return nil, fmt.Errorf("message is too big (%d bytes)", rLength)
+		}
+		rMessage, err := readExactly(f.conn, rLength)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the rest of the message: %s", err.Error())
+		}
+
+		switch rMessage[0] {
+		case msgChoke:
+			f.unchoked = false
+			return nil, fmt.Errorf("choked by the peer")
+
+		case msgUnchoke:
+			f.unchoked = true
+
+		case msgHave, msgBitfield, msgHaveAll, msgHaveNone:
+			f.onPeerPieces(rMessage)
+			for piece := firstPiece; piece <= lastPiece; piece++ {
+				if f.peerLacks(piece) {
+					return nil, fmt.Errorf("peer does not have piece %d", piece)
+				}
+			}
+
+		case msgRejectRequest:
+			return nil, fmt.Errorf("request rejected by the peer")
+
+		case msgPiece:
+			if len(rMessage) < 9 {
+				return nil, fmt.Errorf("piece message is too short (%d bytes)", len(rMessage))
+			}
+			piece := int64(binary.BigEndian.Uint32(rMessage[1:5]))
+			pieceBegin := int64(binary.BigEndian.Uint32(rMessage[5:9]))
+			block := rMessage[9:]
+			begin := piece*pieceLength + pieceBegin - downloadStart
+			// Blocks that we have not requested (e.g. of an earlier download) are ignored.
+			if begin < 0 || begin%blockSize != 0 || begin+int64(len(block)) > int64(len(download)) {
+				continue
+			}
+			copy(download[begin:], block)
+			received[begin] = true
+		}
+	}
+
+	for piece := firstPiece; piece <= lastPiece; piece++ {
+		start := (piece - firstPiece) * pieceLength
+		end := start + pieceLength
+		if end > int64(len(download)) {
+			end = int64(len(download))
+		}
+		sum := sha1.Sum(download[start:end])
+		if !bytes.Equal(sum[:], f.pieces[piece*20:piece*20+20]) {
+			return nil, fmt.Errorf("piece %d does not match its hash", piece)
+		}
+	}
+
+	return download[offset-downloadStart : offset-downloadStart+length], nil
+}
+
+// onPeerPieces records the pieces the peer has, as told by its have, bitfield, have all, and have
+// none messages (which are sent while the metadata is being fetched too).
+func (f *fetcher) onPeerPieces(rMessage []byte) {
+	switch rMessage[0] {
+	case msgBitfield:
+		f.peerPieces = append([]byte{}, rMessage[1:]...)
+		f.peerHasAll = false
+
+	case msgHave:
+		if len(rMessage) < 5 {
+			return
+		}
+		piece := int64(binary.BigEndian.Uint32(rMessage[1:5]))
+		// A torrent cannot have more pieces than its metadata can hold the hashes of.
+		if piece >= MAX_METADATA_SIZE/20 {
+			return
+		}
+		for int64(len(f.peerPieces)) <= piece/8 {
+			f.peerPieces = append(f.peerPieces, 0)
+		}
+		f.peerPieces[piece/8] |= 0x80 >> uint(piece%8)
+
+	case msgHaveAll:
+		f.peerHasAll = true
+
+	case msgHaveNone:
+		f.peerPieces = nil
+		f.peerHasAll = false
+
+	default:
+		return
+	}
+	f.peerPiecesKnown = true
+}
+
+// peerLacks reports whether the peer is known not to have the piece.
+func (f *fetcher) peerLacks(piece int64) bool {
+	if !f.peerPiecesKnown || f.peerHasAll {
+		return false
+	}
+	return piece/8 >= int64(len(f.peerPieces)) || f.peerPieces[piece/8]&(0x80>>uint(piece%8)) == 0
+}
+
+// requestBlock requests the block at the given offset of a range that starts at a piece boundary.
+func (f *fetcher) requestBlock(start int64, begin int64, length int64) error {
+	pieceLength := int64(f.result.PieceLength)
+
+	blockLength := int64(blockSize)
+	if begin+blockLength > length {
+		blockLength = length - begin
+	}
+	request := make([]byte, 17)
+	binary.BigEndian.PutUint32(request[0:], 13)
+	request[4] = msgRequest
+	binary.BigEndian.PutUint32(request[5:], uint32((start+begin)/pieceLength))
+	binary.BigEndian.PutUint32(request[9:], uint32((start+begin)%pieceLength))
+	binary.BigEndian.PutUint32(request[13:], uint32(blockLength))
+	if err := writeAll(f.conn, request); err != nil {
+		return fmt.Errorf("couldn't request block: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package bittorrent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestDownload_Unavailable(t *testing.T) {
+	const pieceLength = 32 * 1024
+
+	tests := []struct {
+		name  string
+		serve func(conn net.Conn)
+	}{
+		{"never unchokes", func(conn net.Conn) {
+			io.Copy(ioutil.Discard, conn)
+		}},
+		{"chokes", func(conn net.Conn) {
+			conn.Write([]byte{0, 0, 0, 1, msgChoke})
+			io.Copy(ioutil.Discard, conn)
+		}},
+		{"lacks the pieces", func(conn net.Conn) {
+			// A bitfield of the first piece only, and then an unchoke that would be waited for.
+			conn.Write([]byte{0, 0, 0, 2, msgBitfield, 0x80, 0, 0, 0, 1, msgUnchoke})
+			io.Copy(ioutil.Discard, conn)
+		}},
+		{"rejects", func(conn net.Conn) {
+			conn.Write([]byte{0, 0, 0, 1, msgUnchoke})
+			// Our interested message, and then a request.
+			request := make([]byte, 5+17)
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			request = request[5:]
+			request[4] = msgRejectRequest
+			conn.Write(request)
+			io.Copy(ioutil.Discard, conn)
+		}},
+	}
+
+	for _, test := range tests {
+		addr := fakePeer(t, test.serve)
+		conn, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			t.Fatalf("Couldn't connect: %s", err.Error())
+		}
+		expiry := time.Now().Add(10 * time.Second)
+		conn.SetDeadline(expiry)
+
+		f := &fetcher{
+			conn:            conn,
+			peer:            Peer{Addr: addr},
+			reqq:            2,
+			pieces:          make([]byte, 2*20),
+			expiry:          expiry,
+			downloadTimeout: 500 * time.Millisecond,
+			result: Metadata{
+				Files:        []persistence.File{{Path: "a.bin", Size: 2 * pieceLength}},
+				InfoMetadata: persistence.InfoMetadata{PieceLength: pieceLength},
+			},
+		}
+
+		start := time.Now()
+		_, err = f.download(pieceLength, 100)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if elapsed := time.Since(start); elapsed > 2*time.Second ||
+			(test.name != "never unchokes" && elapsed >= f.downloadTimeout) {
+			t.Errorf("%s: expected the download to be given up on soon, took %s (%s)", test.name, elapsed,
+				err.Error())
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package bittorrent
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// readmePriority returns how good a description of the torrent the file at the given path might
+// be (the smaller the better), or -1 if the file is not a readme at all.
+func readmePriority(filePath string) int {
+	base := strings.ToLower(path.Base(filePath))
+	ext := path.Ext(base)
+
+	switch {
+	case strings.TrimSuffix(base, ext) == "readme":
+		return 0
+	case ext == ".nfo":
+		return 1
+	case ext == ".txt":
+		return 2
+	default:
+		return -1
+	}
+}
+
+// findReadme chooses the readme of a v1 (or hybrid) torrent among its files, which should be of at
+// most maxSize bytes.
+func findReadme(files []persistence.File, maxSize uint64) (torrentFile, bool) {
+	var readme torrentFile
+	bestPriority := -1
+	var offset int64
+
+	for _, file := range files {
+		priority := readmePriority(file.Path)
+		if priority != -1 && !file.IsPadding() && file.SymlinkPath == "" &&
+			file.Size != 0 && file.Size <= maxSize && (bestPriority == -1 || priority < bestPriority) {
+			readme = torrentFile{Path: file.Path, Offset: offset, Size: int64(file.Size)}
+			bestPriority = priority
+		}
+		offset += int64(file.Size)
+	}
+
+	return readme, bestPriority != -1
+}
+
+// readmeText converts the content of a readme into text, or returns false if the content is not
+// text. Files that are not valid UTF-8 (e.g. .nfo files are traditionally in CP437) are read as if
+// they are in Latin-1, which is good enough for the ASCII parts of them.
+func readmeText(content []byte) (string, bool) {
+	if bytes.IndexByte(content, 0) != -1 {
+		return "", false
+	}
+	if utf8.Valid(content) {
+		return string(content), true
+	}
+
+	runes := make([]rune, len(content))
+	for i, b := range content {
+		runes[i] = rune(b)
+	}
+	return string(runes), true
+}
+
+// fetchReadme is an optional step of fetching metadata, in which we download the pieces the readme
+// of the torrent spans from the same peer. Since the metadata is already fetched, failing to fetch
+// the readme is not a failure of the whole.
+func fetchReadme(f *fetcher) (fetchStep, error) {
+	if f.readmeMaxSize == 0 {
+		return probeMedia, nil
+	}
+	file, found := findReadme(f.result.Files, f.readmeMaxSize)
+	if !found {
+		return probeMedia, nil
+	}
+
+	readme, err := f.downloadReadme(file)
+	if err != nil {
+		zap.L().Debug(
+			"Couldn't fetch the readme!",
+			zap.String("infoHash", f.infoHash.String()),
+			zap.String("remotePeerAddr", f.peer.Addr.String()),
+			zap.String("path", file.Path),
+			zap.Error(err),
+		)
+		// The peer might not have the pieces of the readme, and is not likely to have the others.
+		return nil, nil
+	}
+
+	f.result.Readme = readme
+	return probeMedia, nil
+}
+
+func (f *fetcher) downloadReadme(file torrentFile) (*persistence.Readme, error) {
+	data, err := f.download(file.Offset, file.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	content, ok := readmeText(data)
+	if !ok {
+		return nil, fmt.Errorf("readme is not a text file")
+	}
+
+	return &persistence.Readme{Path: file.Path, Content: content}, nil
+}
@@ -0,0 +1,123 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestFindReadme(t *testing.T) {
+	files := []persistence.File{
+		{Path: "movie/movie.mkv", Size: 1 << 30},
+		{Path: "movie/notes.txt", Size: 100},
+		{Path: "movie/.pad/1000", Size: 1000, Attributes: "p"},
+		{Path: "movie/movie.nfo", Size: 200},
+		{Path: "movie/README", Size: 1 << 20},
+	}
+
+	readme, found := findReadme(files, 64*1024)
+	if !found {
+		t.Fatal("expected a readme to be found")
+	}
+	// README is too big, and .nfo files are preferred over .txt files.
+	if readme.Path != "movie/movie.nfo" || readme.Offset != 1<<30+100+1000 || readme.Size != 200 {
+		t.Errorf("unexpected readme %+v", readme)
+	}
+
+	if _, found = findReadme(files[:1], 64*1024); found {
+		t.Error("expected no readme to be found")
+	}
+}
+
+func TestReadmeText(t *testing.T) {
+	if text, ok := readmeText([]byte("héllo")); !ok || text != "héllo" {
+		t.Errorf("expected UTF-8 text to be kept as is, got %q", text)
+	}
+	if text, ok := readmeText([]byte{'h', 0xe9}); !ok || text != "hé" {
+		t.Errorf("expected Latin-1 text to be converted, got %q", text)
+	}
+	if _, ok := readmeText([]byte{'M', 'Z', 0, 0}); ok {
+		t.Error("expected binary content to be rejected")
+	}
+}
+
+func TestDownloadReadme(t *testing.T) {
+	const pieceLength = 32 * 1024
+	data := make([]byte, 2*pieceLength+100)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	var pieces []byte
+	for start := 0; start < len(data); start += pieceLength {
+		end := start + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[start:end])
+		pieces = append(pieces, sum[:]...)
+	}
+
+	// A peer that unchokes us and then serves the blocks we request.
+	addr := fakePeer(t, func(conn net.Conn) {
+		interested := make([]byte, 5)
+		if _, err := io.ReadFull(conn, interested); err != nil {
+			return
+		}
+		conn.Write([]byte{0, 0, 0, 1, msgUnchoke})
+
+		request := make([]byte, 17)
+		for {
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			index := binary.BigEndian.Uint32(request[5:])
+			begin := binary.BigEndian.Uint32(request[9:])
+			length := binary.BigEndian.Uint32(request[13:])
+			offset := index*pieceLength + begin
+
+			message := make([]byte, 13)
+			binary.BigEndian.PutUint32(message[0:], 9+length)
+			message[4] = msgPiece
+			binary.BigEndian.PutUint32(message[5:], index)
+			binary.BigEndian.PutUint32(message[9:], begin)
+			conn.Write(append(message, data[offset:offset+length]...))
+		}
+	})
+
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	f := &fetcher{
+		conn:   conn,
+		peer:   Peer{Addr: addr},
+		reqq:   2,
+		pieces: pieces,
+		result: Metadata{
+			Files: []persistence.File{
+				{Path: "a.bin", Size: pieceLength + 10},
+				{Path: "README.txt", Size: pieceLength + 50},
+				{Path: "b.bin", Size: 40},
+			},
+			InfoMetadata: persistence.InfoMetadata{PieceLength: pieceLength},
+		},
+	}
+
+	// README.txt spans the last two pieces.
+	readme, err := f.downloadReadme(torrentFile{Path: "README.txt", Offset: pieceLength + 10, Size: pieceLength + 50})
+	if err != nil {
+		t.Fatalf("Couldn't download readme: %s", err.Error())
+	}
+	if readme.Path != "README.txt" || !bytes.Equal([]byte(readme.Content), data[pieceLength+10:2*pieceLength+60]) {
+		t.Errorf("unexpected readme %s of %d bytes", readme.Path, len(readme.Content))
+	}
+}
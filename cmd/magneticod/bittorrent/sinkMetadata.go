@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -14,6 +16,8 @@ import (
 )
 
 type Metadata struct {
+	// InfoHash is the v1 infohash of the torrent if it has one (i.e. it is a v1 or a hybrid
+	// torrent), else its truncated v2 infohash. See metainfoV2.go
 	InfoHash []byte
 	// Name should be thought of "Title" of the torrent. For single-file torrents, it is the name
 	// of the file, and for multi-file torrents, it is the name of the root directory.
@@ -22,22 +26,71 @@ type Metadata struct {
 	DiscoveredOn int64
 	// Files must be populated for both single-file and multi-file torrents!
 	Files []persistence.File
+	// Info is the raw (bencoded) info dictionary whose SHA-1 sum is the InfoHash.
+	Info []byte
+	persistence.InfoMetadata
+	// Readme is the content of a descriptor file of the torrent, if it is fetched.
+	Readme *persistence.Readme
+	// MediaInfo is the information probed from a video or an image file of the torrent, if any.
+	MediaInfo *persistence.MediaInfo
 }
 
 type Peer struct {
 	Addr *net.TCPAddr
 }
 
+// Failure is reported when the metadata of a torrent could not be fetched from any of the peers.
+type Failure struct {
+	InfoHash [20]byte
+	Peers    []Peer
+	// Reason is why fetching the metadata from the last of the peers has failed.
+	Reason FailureReason
+}
+
 type MetadataSink struct {
 	clientID           []byte
 	deadline           time.Duration
+	readmeMaxSize      uint64
+	probeMedia         bool
 	drain              chan Metadata
+	failures           chan Failure
 	incomingInfoHashes map[[20]byte]struct{}
-	terminated         bool
-	termination        chan interface{}
+	// incomingInfoHashesMx guards incomingInfoHashes, as the infohashes are deleted by the
+	// awaitMetadata goroutines.
+	incomingInfoHashesMx sync.Mutex
+	// stopped is set once the sink stops accepting new infohashes (see Stop and Terminate), and is
+	// guarded by incomingInfoHashesMx as well.
+	stopped bool
+	// inFlight counts the awaitMetadata goroutines.
+	inFlight sync.WaitGroup
+	// terminated is set by Terminate; it is written under incomingInfoHashesMx too, but it is read
+	// without it only by the methods that are called by the same goroutine as Terminate.
+	terminated  bool
+	termination chan interface{}
+
+	// nSucceeded and nFailed count the metadata fetching attempts by their outcome, and are
+	// accessed atomically as they are updated by the awaitMetadata goroutines.
+	nSucceeded uint64
+	nFailed    [nFailureReasons]uint64
+
+	// peerStatistics are the fingerprints of the peers (see fingerprint.go) since the last time
+	// they are flushed.
+	peerStatistics      persistence.PeerStatistics
+	peerStatisticsMutex sync.Mutex
 }
 
-func NewMetadataSink(deadline time.Duration) *MetadataSink {
+// FetchStatistics are the numbers of succeeded and failed (by FailureReason) metadata fetching
+// attempts since the MetadataSink is created.
+type FetchStatistics struct {
+	Succeeded uint64
+	Failed    map[FailureReason]uint64
+}
+
+// NewMetadataSink creates a MetadataSink which fetches the metadata of each torrent within the
+// deadline, and also its readme (see readme.go) if it is of at most readmeMaxSize bytes (0 disables
+// fetching readmes), and the information of its largest video or image file if probeMedia is true
+// (see media.go).
+func NewMetadataSink(deadline time.Duration, readmeMaxSize uint64, probeMedia bool) *MetadataSink {
 	ms := new(MetadataSink)
 
 	ms.clientID = make([]byte, 20)
@@ -46,9 +99,13 @@ func NewMetadataSink(deadline time.Duration) *MetadataSink {
 		zap.L().Panic("sinkMetadata couldn't read 20 random bytes for client ID!", zap.Error(err))
 	}
 	ms.deadline = deadline
+	ms.readmeMaxSize = readmeMaxSize
+	ms.probeMedia = probeMedia
 	ms.drain = make(chan Metadata)
+	ms.failures = make(chan Failure)
 	ms.incomingInfoHashes = make(map[[20]byte]struct{})
 	ms.termination = make(chan interface{})
+	ms.peerStatistics = persistence.NewPeerStatistics()
 	return ms
 }
 
@@ -57,15 +114,6 @@ func (ms *MetadataSink) Sink(res mainline.TrawlingResult) {
 		zap.L().Panic("Trying to Sink() an already closed MetadataSink!")
 	}
 
-	if _, exists := ms.incomingInfoHashes[res.InfoHash]; exists {
-		return
-	}
-	// BEWARE!
-	// Although not crucial, the assumption is that MetadataSink.Sink() will be called by only one
-	// goroutine (i.e. it's not thread-safe), lest there might be a race condition between where we
-	// check whether res.infoHash exists in the ms.incomingInfoHashes, and where we add the infoHash
-	// to the incomingInfoHashes at the end of this function.
-
 	IPs := res.PeerIP.String()
 	var rhostport string
 	if IPs == "<nil>" {
@@ -86,9 +134,40 @@ func (ms *MetadataSink) Sink(res mainline.TrawlingResult) {
 		return
 	}
 
-	go ms.awaitMetadata(res.InfoHash, Peer{Addr: raddr})
+	ms.start(res.InfoHash, []Peer{{Addr: raddr}})
+}
+
+// Retry tries to fetch the metadata of a torrent (that could not be fetched before) from the given
+// peers in turn, unless it is already being fetched. As the retries are scheduled by the database
+// writer goroutine, Retry is safe to call concurrently, and does nothing once the sink is stopped or
+// terminated.
+func (ms *MetadataSink) Retry(infoHash [20]byte, peers []Peer) {
+	if len(peers) == 0 {
+		return
+	}
 
-	ms.incomingInfoHashes[res.InfoHash] = struct{}{}
+	ms.start(infoHash, peers)
+}
+
+func (ms *MetadataSink) start(infoHash [20]byte, peers []Peer) {
+	ms.incomingInfoHashesMx.Lock()
+	defer ms.incomingInfoHashesMx.Unlock()
+
+	if ms.stopped {
+		return
+	}
+	if _, exists := ms.incomingInfoHashes[infoHash]; exists {
+		return
+	}
+	ms.incomingInfoHashes[infoHash] = struct{}{}
+
+	ms.inFlight.Add(1)
+	sinkInFlight.Inc()
+	go func() {
+		defer ms.inFlight.Done()
+		defer sinkInFlight.Dec()
+		ms.awaitMetadata(infoHash, peers)
+	}()
 }
 
 func (ms *MetadataSink) Drain() <-chan Metadata {
@@ -98,19 +177,106 @@ func (ms *MetadataSink) Drain() <-chan Metadata {
 	return ms.drain
 }
 
+// Failures returns the channel on which the torrents whose metadata could not be fetched are
+// reported.
+func (ms *MetadataSink) Failures() <-chan Failure {
+	if ms.terminated {
+		zap.L().Panic("Trying to Failures() an already closed MetadataSink!")
+	}
+	return ms.failures
+}
+
+// Stop makes the sink ignore the new infohashes from then on, so that it can be terminated
+// gracefully. The returned channel is closed once the metadata of all the torrents that are still
+// being fetched are either drained or failed; meanwhile, Drain and Failures must be kept received.
+func (ms *MetadataSink) Stop() <-chan struct{} {
+	ms.incomingInfoHashesMx.Lock()
+	ms.stopped = true
+	ms.incomingInfoHashesMx.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		ms.inFlight.Wait()
+		close(idle)
+	}()
+	return idle
+}
+
+// Terminate discards the results of the torrents that are still being fetched (if any). The sink
+// must not be used afterwards.
 func (ms *MetadataSink) Terminate() {
+	ms.incomingInfoHashesMx.Lock()
+	ms.stopped = true
 	ms.terminated = true
+	ms.incomingInfoHashesMx.Unlock()
+
 	close(ms.termination)
-	close(ms.drain)
 }
 
-func (ms *MetadataSink) flush(result Metadata) {
-	if !ms.terminated {
-		ms.drain <- result
-		// Delete the infoHash from ms.incomingInfoHashes ONLY AFTER once we've flushed the
-		// metadata!
-		var infoHash [20]byte
-		copy(infoHash[:], result.InfoHash)
-		delete(ms.incomingInfoHashes, infoHash)
+// flush is called with the infoHash that was sunk, which might differ from the InfoHash of the
+// result (e.g. a hybrid torrent discovered by its v2 infohash).
+func (ms *MetadataSink) flush(infoHash [20]byte, result Metadata) {
+	select {
+	case ms.drain <- result:
+	case <-ms.termination:
+	}
+	// Delete the infoHash from ms.incomingInfoHashes ONLY AFTER once we've flushed the metadata!
+	ms.forget(infoHash)
+}
+
+// fail is called when the metadata could not be fetched from any of the peers.
+func (ms *MetadataSink) fail(failure Failure) {
+	select {
+	case ms.failures <- failure:
+	case <-ms.termination:
+	}
+	ms.forget(failure.InfoHash)
+}
+
+func (ms *MetadataSink) forget(infoHash [20]byte) {
+	ms.incomingInfoHashesMx.Lock()
+	defer ms.incomingInfoHashesMx.Unlock()
+
+	delete(ms.incomingInfoHashes, infoHash)
+}
+
+func (ms *MetadataSink) Statistics() FetchStatistics {
+	stats := FetchStatistics{
+		Succeeded: atomic.LoadUint64(&ms.nSucceeded),
+		Failed:    make(map[FailureReason]uint64),
+	}
+	for reason := FailureReason(0); reason < nFailureReasons; reason++ {
+		if n := atomic.LoadUint64(&ms.nFailed[reason]); n != 0 {
+			stats.Failed[reason] = n
+		}
 	}
+	return stats
+}
+
+func (ms *MetadataSink) countSuccess() {
+	atomic.AddUint64(&ms.nSucceeded, 1)
+	fetchesSucceeded.Inc()
+}
+
+func (ms *MetadataSink) countFailure(reason FailureReason) {
+	atomic.AddUint64(&ms.nFailed[reason], 1)
+	fetchesFailed.WithLabelValues(reason.String()).Inc()
+}
+
+// FlushPeerStatistics returns the numbers of peers by their fingerprints since the last time it is
+// called.
+func (ms *MetadataSink) FlushPeerStatistics() persistence.PeerStatistics {
+	ms.peerStatisticsMutex.Lock()
+	defer ms.peerStatisticsMutex.Unlock()
+
+	stats := ms.peerStatistics
+	ms.peerStatistics = persistence.NewPeerStatistics()
+	return stats
+}
+
+func (ms *MetadataSink) recordPeer(fp *peerFingerprint) {
+	ms.peerStatisticsMutex.Lock()
+	defer ms.peerStatisticsMutex.Unlock()
+
+	fp.addTo(ms.peerStatistics)
 }
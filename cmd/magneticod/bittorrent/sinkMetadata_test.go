@@ -0,0 +1,64 @@
+package bittorrent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetadataSink_Stop(t *testing.T) {
+	ms := NewMetadataSink(time.Second, 0, false)
+
+	// The peer closes the connection right away, so the fetch fails soon.
+	addr := fakePeer(t, func(conn net.Conn) {})
+	ms.Retry([20]byte{1}, []Peer{{Addr: addr}})
+
+	idle := ms.Stop()
+	// Ignored, as the sink is stopped.
+	ms.Retry([20]byte{2}, []Peer{{Addr: addr}})
+
+	select {
+	case <-idle:
+		t.Fatal("Expected the sink not to be idle before the failure is received")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case failure := <-ms.Failures():
+		if failure.InfoHash != [20]byte{1} {
+			t.Errorf("Unexpected failure of %x", failure.InfoHash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the fetch to fail")
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the sink to be idle")
+	}
+}
+
+func TestMetadataSink_Terminate(t *testing.T) {
+	ms := NewMetadataSink(time.Second, 0, false)
+
+	addr := fakePeer(t, func(conn net.Conn) {})
+	ms.Retry([20]byte{1}, []Peer{{Addr: addr}})
+	idle := ms.Stop()
+
+	// The failure is discarded instead of blocking forever as it is never received.
+	ms.Terminate()
+	select {
+	case <-idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the sink to be idle after it is terminated")
+	}
+
+	// A retry that is still scheduled when the sink is terminated is ignored.
+	ms.Retry([20]byte{2}, []Peer{{Addr: addr}})
+	select {
+	case <-ms.Stop():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the retry to be ignored after the sink is terminated")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/izolight/magnetico/cmd/magneticod/bittorrent"
+	"github.com/izolight/magnetico/pkg/config"
+)
+
+// fileConfig is the (optional) configuration file of magneticod, e.g.
+//
+//	database: postgres://magnetico@localhost/magnetico
+//	search_index: file:///var/lib/magnetico/index
+//	bind: ["0.0.0.0:6881", "0.0.0.0:6882"]
+//	log:
+//	  level: info
+//	rate_limits:
+//	  max_fetch_rate: 50
+//	filters:
+//	  min_size: 1048576
+//	  exclude_names: ["(?i)\\bsample\\b"]
+//
+// Only the logging level, the rate limits, and the filters are reloaded on SIGHUP.
+type fileConfig struct {
+	Database    string   `yaml:"database"`
+	SearchIndex string   `yaml:"search_index"`
+	Bind        []string `yaml:"bind"`
+	Log         struct {
+		Level string `yaml:"level"`
+	} `yaml:"log"`
+	RateLimits struct {
+		// MaxFetchRate is the maximum number of torrents to start fetching the metadata of per
+		// second, or 0 for unlimited.
+		MaxFetchRate *uint `yaml:"max_fetch_rate"`
+	} `yaml:"rate_limits"`
+	Filters struct {
+		// MinSize and MaxSize are in bytes, and MaxSize is ignored if it is 0.
+		MinSize      uint64   `yaml:"min_size"`
+		MaxSize      uint64   `yaml:"max_size"`
+		ExcludeNames []string `yaml:"exclude_names"`
+	} `yaml:"filters"`
+}
+
+// runtimeConfig are the settings that can be changed while magneticod is running, by reloading
+// the configuration file.
+type runtimeConfig struct {
+	LogLevel     zapcore.Level
+	MaxFetchRate uint
+	Filter       torrentFilter
+}
+
+func loadFileConfig(path string) (*fileConfig, error) {
+	fc := new(fileConfig)
+	if err := config.Load(path, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// reloadConfig reads the configuration file again, and returns its runtime settings.
+func reloadConfig(opF *opFlags) (runtimeConfig, error) {
+	fc, err := loadFileConfig(opF.ConfigPath)
+	if err != nil {
+		return runtimeConfig{}, err
+	}
+	return makeRuntimeConfig(opF, fc)
+}
+
+// makeRuntimeConfig merges the configuration file (which might be nil) into the operational flags,
+// the latter taking precedence if they are given explicitly.
+func makeRuntimeConfig(opF *opFlags, fc *fileConfig) (runtimeConfig, error) {
+	rc := runtimeConfig{
+		LogLevel:     verbosityLevel(opF.Verbosity),
+		MaxFetchRate: opF.MaxFetchRate,
+	}
+	if fc == nil {
+		return rc, nil
+	}
+
+	if fc.Log.Level != "" && !opF.explicitVerbosity {
+		level, err := config.ParseLogLevel(fc.Log.Level)
+		if err != nil {
+			return rc, err
+		}
+		rc.LogLevel = level
+	}
+
+	if fc.RateLimits.MaxFetchRate != nil && !opF.explicitMaxFetchRate {
+		rc.MaxFetchRate = *fc.RateLimits.MaxFetchRate
+	}
+
+	rc.Filter.minSize = fc.Filters.MinSize
+	rc.Filter.maxSize = fc.Filters.MaxSize
+	for _, pattern := range fc.Filters.ExcludeNames {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return rc, fmt.Errorf("invalid name filter `%s`: %s", pattern, err.Error())
+		}
+		rc.Filter.excludeNames = append(rc.Filter.excludeNames, re)
+	}
+
+	return rc, nil
+}
+
+func verbosityLevel(verbosity int) zapcore.Level {
+	switch verbosity {
+	case 0:
+		return zapcore.WarnLevel
+	case 1:
+		return zapcore.InfoLevel
+	default: // Default: i.e. in case of 2 or more.
+		return zapcore.DebugLevel
+	}
+}
+
+// torrentFilter decides which of the torrents whose metadata are fetched are stored.
+type torrentFilter struct {
+	minSize      uint64
+	maxSize      uint64
+	excludeNames []*regexp.Regexp
+}
+
+// allows reports whether the torrent passes the filter, and if not, why.
+func (tf torrentFilter) allows(metadata bittorrent.Metadata) (bool, string) {
+	if metadata.TotalSize < tf.minSize {
+		return false, "too small"
+	}
+	if tf.maxSize != 0 && metadata.TotalSize > tf.maxSize {
+		return false, "too large"
+	}
+	for _, re := range tf.excludeNames {
+		if re.MatchString(metadata.Name) {
+			return false, "excluded name"
+		}
+	}
+	return true, ""
+}
+
+// rateLimiter is a token bucket that allows at most rate events per second (with bursts of up to
+// rate events), or any number of events if rate is 0. It is not thread-safe.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (rl *rateLimiter) setRate(rate uint) {
+	rl.rate = float64(rate)
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+}
+
+// allow reports whether an event is allowed at @now, consuming a token if so.
+func (rl *rateLimiter) allow(now time.Time) bool {
+	if rl.rate == 0 {
+		return true
+	}
+
+	if !rl.last.IsZero() {
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.tokens > rl.rate {
+			rl.tokens = rl.rate
+		}
+	} else {
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
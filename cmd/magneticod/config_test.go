@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/izolight/magnetico/cmd/magneticod/bittorrent"
+)
+
+func TestMakeRuntimeConfig(t *testing.T) {
+	rate := uint(10)
+	fc := new(fileConfig)
+	fc.Log.Level = "debug"
+	fc.RateLimits.MaxFetchRate = &rate
+	fc.Filters.MinSize = 100
+	fc.Filters.ExcludeNames = []string{"(?i)sample"}
+
+	rc, err := makeRuntimeConfig(&opFlags{MaxFetchRate: 5}, fc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rc.LogLevel != zapcore.DebugLevel || rc.MaxFetchRate != 10 {
+		t.Errorf("Expected the configuration file to take precedence over the defaults, got %+v", rc)
+	}
+
+	rc, err = makeRuntimeConfig(&opFlags{Verbosity: 1, explicitVerbosity: true, MaxFetchRate: 5, explicitMaxFetchRate: true}, fc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rc.LogLevel != zapcore.InfoLevel || rc.MaxFetchRate != 5 {
+		t.Errorf("Expected the explicit options to take precedence over the configuration file, got %+v", rc)
+	}
+
+	tests := []struct {
+		metadata bittorrent.Metadata
+		allowed  bool
+	}{
+		{bittorrent.Metadata{Name: "ubuntu.iso", TotalSize: 1000}, true},
+		{bittorrent.Metadata{Name: "ubuntu.iso", TotalSize: 10}, false},
+		{bittorrent.Metadata{Name: "Sample.mkv", TotalSize: 1000}, false},
+	}
+	for _, test := range tests {
+		if allowed, _ := rc.Filter.allows(test.metadata); allowed != test.allowed {
+			t.Errorf("Expected %s of %d bytes to be allowed: %t", test.metadata.Name, test.metadata.TotalSize, test.allowed)
+		}
+	}
+
+	fc.Filters.ExcludeNames = []string{"("}
+	if _, err = makeRuntimeConfig(&opFlags{}, fc); err == nil {
+		t.Error("Expected an error for the invalid regular expression")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := new(rateLimiter)
+	now := time.Unix(1000000, 0)
+	if !rl.allow(now) {
+		t.Fatal("Expected an unlimited rate limiter to allow")
+	}
+
+	rl.setRate(2)
+	if !rl.allow(now) || !rl.allow(now) {
+		t.Fatal("Expected a burst of 2 to be allowed")
+	}
+	if rl.allow(now) {
+		t.Fatal("Expected the third event to be limited")
+	}
+	if !rl.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("Expected an event to be allowed after half a second")
+	}
+}
@@ -0,0 +1,63 @@
+package mainline
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	packetsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "magneticod",
+			Subsystem: "dht",
+			Name:      "packets_total",
+			Help:      "Number of KRPC messages received and sent, by their types and methods.",
+		},
+		[]string{"direction", "type", "method"},
+	)
+	routingTableSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "magneticod",
+			Subsystem: "dht",
+			Name:      "routing_table_size",
+			Help:      "Number of nodes in the routing table of the trawling service before it is renewed.",
+		},
+		[]string{"address"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(packetsTotal, routingTableSize)
+}
+
+// countPacket counts the message in the given direction ("in" or "out").
+func countPacket(direction string, msg *Message) {
+	msgType, method := krpcLabels(msg)
+	packetsTotal.WithLabelValues(direction, msgType, method).Inc()
+}
+
+// krpcLabels returns the type and the method of the message, which is inferred for the responses
+// as they do not contain their methods. Unknown methods are not used as labels as-is, so that the
+// cardinality of the metrics stays bounded.
+func krpcLabels(msg *Message) (string, string) {
+	switch msg.Y {
+	case "q":
+		switch msg.Q {
+		case "ping", "find_node", "get_peers", "announce_peer", "vote":
+			return "query", msg.Q
+		default:
+			return "query", "unknown"
+		}
+	case "r":
+		// get_peers > find_node > ping / announce_peer (see Protocol.onMessage)
+		if len(msg.R.Token) != 0 {
+			return "response", "get_peers"
+		} else if len(msg.R.Nodes) != 0 {
+			return "response", "find_node"
+		}
+		return "response", "ping_or_announce_peer"
+	case "e":
+		return "error", ""
+	default:
+		return "invalid", ""
+	}
+}
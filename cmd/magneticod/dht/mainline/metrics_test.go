@@ -0,0 +1,29 @@
+package mainline
+
+import (
+	"testing"
+)
+
+func TestKRPCLabels(t *testing.T) {
+	tests := []struct {
+		msg    Message
+		type_  string
+		method string
+	}{
+		{Message{Y: "q", Q: "get_peers"}, "query", "get_peers"},
+		{Message{Y: "q", Q: "sample_infohashes"}, "query", "unknown"},
+		{Message{Y: "r", R: ResponseValues{Token: []byte("aoeusnth")}}, "response", "get_peers"},
+		{Message{Y: "r", R: ResponseValues{Nodes: CompactNodeInfos{{}}}}, "response", "find_node"},
+		{Message{Y: "r"}, "response", "ping_or_announce_peer"},
+		{Message{Y: "e"}, "error", ""},
+		{Message{}, "invalid", ""},
+	}
+
+	for i, test := range tests {
+		type_, method := krpcLabels(&test.msg)
+		if type_ != test.type_ || method != test.method {
+			t.Errorf("Expected the labels of the message #%d to be (%s, %s), got (%s, %s)",
+				i, test.type_, test.method, type_, method)
+		}
+	}
+}
@@ -58,6 +58,8 @@ func (p *Protocol) Terminate() {
 }
 
 func (p *Protocol) onMessage(msg *Message, addr net.Addr) {
+	countPacket("in", msg)
+
 	switch msg.Y {
 	case "q":
 		switch msg.Q {
@@ -147,6 +149,7 @@ func (p *Protocol) onMessage(msg *Message, addr net.Addr) {
 }
 
 func (p *Protocol) SendMessage(msg *Message, addr net.Addr) {
+	countPacket("out", msg)
 	p.transport.WriteMessages(msg, addr)
 }
 
@@ -90,6 +90,7 @@ func (s *TrawlingService) trawl() {
 				zap.String("ID", hex.EncodeToString(s.trueNodeID)),
 				zap.Int("peers", len(s.routingTable)),
 			)
+			routingTableSize.WithLabelValues(s.protocol.transport.laddr.String()).Set(float64(len(s.routingTable)))
 			s.findNeighbors()
 			s.routingTable = make(map[string]net.Addr)
 		}
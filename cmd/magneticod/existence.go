@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+
+	"github.com/willf/bloom"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+const (
+	// BLOOM_FALSE_POSITIVE_RATE is the false positive rate of the bloom filter of the existing
+	// torrents as long as the number of torrents stays below its capacity.
+	BLOOM_FALSE_POSITIVE_RATE = 0.01
+	// MIN_BLOOM_CAPACITY is the minimum number of torrents the bloom filter is sized for. The
+	// capacity is (at least) twice the number of torrents in the database at startup, so that the
+	// database can grow before the false positive rate starts to degrade.
+	MIN_BLOOM_CAPACITY = 1 << 20
+	// EXISTENCE_CACHE_SIZE is the number of the most recently confirmed existing torrents that are
+	// remembered, so that the popular torrents are not looked up in the database over and over.
+	EXISTENCE_CACHE_SIZE = 100000
+)
+
+// existenceCache answers whether a torrent exists in the database, mostly without touching the
+// database. It is not thread-safe.
+//
+// A bloom filter of all the torrents never gives false negatives, so the torrents it does not
+// contain (i.e. the vast majority of the trawled ones) certainly do not exist. Otherwise, the
+// recently confirmed torrents are looked up in an LRU cache, and only the rest (i.e. the false
+// positives of the bloom filter and the torrents that are not seen for a while) are looked up in
+// the database.
+type existenceCache struct {
+	bloom  *bloom.BloomFilter
+	recent *lruSet
+}
+
+// newExistenceCache loads the infohashes of all the torrents in the database into a new cache.
+func newExistenceCache(database persistence.Database) (*existenceCache, error) {
+	nTorrents, err := database.GetNumberOfTorrents()
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := 2 * nTorrents
+	if capacity < MIN_BLOOM_CAPACITY {
+		capacity = MIN_BLOOM_CAPACITY
+	}
+	ec := &existenceCache{
+		bloom:  bloom.NewWithEstimates(capacity, BLOOM_FALSE_POSITIVE_RATE),
+		recent: newLRUSet(EXISTENCE_CACHE_SIZE),
+	}
+
+	err = database.IterateInfoHashes(func(infoHash []byte) error {
+		ec.bloom.Add(infoHash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ec, nil
+}
+
+// add marks the torrent as existing, even before it is written to the database.
+func (ec *existenceCache) add(infoHash []byte) {
+	ec.bloom.Add(infoHash)
+	ec.recent.add(infoHash)
+}
+
+// doesExist reports whether the torrent exists, querying the database only if it is necessary.
+func (ec *existenceCache) doesExist(database persistence.Database, infoHash []byte) (bool, error) {
+	if !ec.bloom.Test(infoHash) {
+		return false, nil
+	}
+	if ec.recent.contains(infoHash) {
+		return true, nil
+	}
+
+	exists, err := database.DoesTorrentExist(infoHash)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		ec.recent.add(infoHash)
+	}
+	return exists, nil
+}
+
+// lruSet is a set of infohashes that evicts the least recently used one when it is full.
+type lruSet struct {
+	capacity int
+	order    *list.List
+	elements map[[20]byte]*list.Element
+}
+
+func newLRUSet(capacity int) *lruSet {
+	return &lruSet{
+		capacity: capacity,
+		order:    list.New(),
+		elements: make(map[[20]byte]*list.Element),
+	}
+}
+
+func (ls *lruSet) add(infoHash []byte) {
+	var key [20]byte
+	copy(key[:], infoHash)
+
+	if element, exists := ls.elements[key]; exists {
+		ls.order.MoveToFront(element)
+		return
+	}
+
+	ls.elements[key] = ls.order.PushFront(key)
+	if ls.order.Len() > ls.capacity {
+		oldest := ls.order.Back()
+		ls.order.Remove(oldest)
+		delete(ls.elements, oldest.Value.([20]byte))
+	}
+}
+
+func (ls *lruSet) contains(infoHash []byte) bool {
+	var key [20]byte
+	copy(key[:], infoHash)
+
+	element, exists := ls.elements[key]
+	if exists {
+		ls.order.MoveToFront(element)
+	}
+	return exists
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+)
+
+func testInfoHash(i int) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(i))
+	infoHash := sha1.Sum(b[:])
+	return infoHash[:]
+}
+
+func TestLRUSet(t *testing.T) {
+	ls := newLRUSet(2)
+
+	ls.add(testInfoHash(1))
+	ls.add(testInfoHash(2))
+	// Now 2 is the least recently used one.
+	if !ls.contains(testInfoHash(1)) {
+		t.Fatal("Expected the set to contain 1")
+	}
+	ls.add(testInfoHash(3))
+
+	if ls.contains(testInfoHash(2)) {
+		t.Error("Expected 2 to be evicted")
+	}
+	if !ls.contains(testInfoHash(1)) || !ls.contains(testInfoHash(3)) {
+		t.Error("Expected the set to contain 1 and 3")
+	}
+}
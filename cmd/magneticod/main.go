@@ -7,7 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
-	"runtime/pprof"
+	"syscall"
 	"time"
 
 	"github.com/Wessie/appdirs"
@@ -17,15 +17,31 @@ import (
 
 	"github.com/izolight/magnetico/cmd/magneticod/bittorrent"
 	"github.com/izolight/magnetico/cmd/magneticod/dht"
+	"github.com/izolight/magnetico/pkg/config"
 	"github.com/izolight/magnetico/pkg/persistence"
 )
 
 type cmdFlags struct {
+	Config      string   `short:"c" long:"config" description:"Path of the (YAML) configuration file." env:"CONFIG"`
 	DatabaseURL string   `short:"d" long:"database" description:"URL of the database." env:"DATABASE"`
+	SearchIndex string   `long:"search-index" description:"URL (e.g. file:///path/to/index) of the search index to add the new torrents to." env:"SEARCH_INDEX"`
 	BindAddr    []string `short:"b" long:"bind" description:"Address(es) that the Crawler should listen on." env:"BIND_ADDR" env-delim:"," default:"0.0.0.0:6881"`
 	Interval    uint     `short:"i" long:"interval" description:"Trawling Interval in milliseconds" env:"INTERVAL" default:"100"`
 	Verbose     []bool   `short:"v" long:"verbose" description:"Increase verbosity"`
 	Profile     string   `short:"p" long:"profile" description:"Enable profiling." choice:"cpu" choice:"memory" choice:"trace"`
+	DebugAddr   string   `long:"debug-addr" description:"Address (e.g. 127.0.0.1:6060) to serve net/http/pprof and runtime statistics on." env:"DEBUG_ADDR"`
+	MetricsAddr string   `long:"metrics-addr" description:"Address (e.g. 0.0.0.0:9100) to serve the Prometheus metrics on at /metrics." env:"METRICS_ADDR"`
+
+	Readme        bool `long:"readme" description:"Fetch README, .nfo, and .txt files of torrents." env:"README"`
+	ReadmeMaxSize uint `long:"readme-max-size" description:"Maximum size of the README files to fetch in bytes." env:"README_MAX_SIZE" default:"65536"`
+	ProbeMedia    bool `long:"probe-media" description:"Probe the largest video or image file of torrents for duration, resolution and codecs." env:"PROBE_MEDIA"`
+
+	BatchSize     uint   `long:"batch-size" description:"Maximum number of new torrents to write to the database in a single transaction." env:"BATCH_SIZE" default:"100"`
+	BatchInterval uint   `long:"batch-interval" description:"Maximum time in milliseconds a new torrent waits to be written to the database." env:"BATCH_INTERVAL" default:"1000"`
+	SpillDir      string `long:"spill-dir" description:"Directory to keep the new torrents in while the database is unavailable." env:"SPILL_DIR"`
+
+	MaxFetchRate  uint `long:"max-fetch-rate" description:"Maximum number of torrents to start fetching the metadata of per second (0 for unlimited)." env:"MAX_FETCH_RATE" default:"0"`
+	ShutdownGrace uint `long:"shutdown-grace" description:"Time in seconds to wait for the metadata being fetched when shutting down." env:"SHUTDOWN_GRACE" default:"5"`
 }
 
 type opFlags struct {
@@ -34,6 +50,28 @@ type opFlags struct {
 	Interval    time.Duration
 	Verbosity   int
 	Profile     string
+	DebugAddr   string
+	MetricsAddr string
+	// ReadmeMaxSize is the maximum size of the README files to fetch, or 0 if they are not fetched.
+	ReadmeMaxSize uint64
+	ProbeMedia    bool
+	BatchSize     int
+	BatchInterval time.Duration
+	SpillDir      string
+	ShutdownGrace time.Duration
+	MaxFetchRate  uint
+
+	// SearchIndexURL is nil if there is no search index.
+	SearchIndexURL *url.URL
+
+	// ConfigPath is the path of the configuration file, or empty if there is none.
+	ConfigPath string
+	// Runtime are the settings that can be changed by reloading the configuration file.
+	Runtime runtimeConfig
+	// explicitVerbosity and explicitMaxFetchRate are true if the respective options are given
+	// explicitly, and hence take precedence over the configuration file even when it is reloaded.
+	explicitVerbosity    bool
+	explicitMaxFetchRate bool
 }
 
 func main() {
@@ -54,72 +92,215 @@ func main() {
 	zap.L().Info("Copyright (C) 2017  Mert Bora ALPER <bora@boramalper.org>.")
 	zap.L().Info("Dedicated to Cemile Binay, in whose hands I thrived.")
 
-	switch opFlags.Verbosity {
-	case 0:
-		loggerLevel.SetLevel(zap.WarnLevel)
-	case 1:
-		loggerLevel.SetLevel(zap.InfoLevel)
-	default: // Default: i.e. in case of 2 or more.
-		// TODO: print the caller (function)'s name and line number!
-		loggerLevel.SetLevel(zap.DebugLevel)
-	}
+	loggerLevel.SetLevel(opFlags.Runtime.LogLevel)
 
 	zap.ReplaceGlobals(logger)
 
-	switch opFlags.Profile {
-	case "cpu":
-		file, err := os.OpenFile("magneticod_cpu.prof", os.O_CREATE|os.O_WRONLY, 0755)
+	if opFlags.Profile != "" {
+		profiler, err := startProfiler(opFlags.Profile)
 		if err != nil {
-			zap.L().Fatal("Could not open the cpu profile file!", zap.Error(err))
+			zap.L().Fatal("Could not start profiling!", zap.Error(err))
 		}
-		pprof.StartCPUProfile(file)
-		defer file.Close()
-		defer pprof.StopCPUProfile()
-
-	case "memory":
-		zap.L().Fatal("Memory profiling NOT IMPLEMENTED")
-
-	case "trace":
-		zap.L().Fatal("trace NOT IMPLEMENTED")
+		defer profiler.Stop()
+	}
+	if opFlags.DebugAddr != "" {
+		go serveDebug(opFlags.DebugAddr)
+	}
+	if opFlags.MetricsAddr != "" {
+		go serveMetrics(opFlags.MetricsAddr)
 	}
 
-	// Handle Ctrl-C gracefully.
-	interruptChan := make(chan os.Signal)
-	signal.Notify(interruptChan, os.Interrupt)
+	// Handle Ctrl-C (and SIGTERM, as sent by Docker and systemd) gracefully.
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+	// Reload the configuration file on SIGHUP.
+	hangupChan := make(chan os.Signal, 1)
+	signal.Notify(hangupChan, syscall.SIGHUP)
 
 	database, err := persistence.MakeDatabase(opFlags.DatabaseURL, logger)
 	if err != nil {
 		logger.Sugar().Fatalf("Could not open the database at `%s`: %s", opFlags.DatabaseURL, err.Error())
 	}
+	if opFlags.SearchIndexURL != nil {
+		index, err := persistence.MakeSearchIndex(opFlags.SearchIndexURL)
+		if err != nil {
+			logger.Sugar().Fatalf("Could not open the search index at `%s`: %s", opFlags.SearchIndexURL, err.Error())
+		}
+		database = persistence.WithSearchIndex(database, index)
+	}
+
+	existence, err := newExistenceCache(database)
+	if err != nil {
+		zap.L().Fatal("Could not load the existing torrents!", zap.Error(err))
+	}
+	dbWriter := newWriter(database, opFlags.BatchSize, opFlags.BatchInterval, opFlags.SpillDir)
 
 	trawlingManager := dht.NewTrawlingManager(opFlags.BindAddr)
-	metadataSink := bittorrent.NewMetadataSink(2 * time.Minute)
+	metadataSink := bittorrent.NewMetadataSink(2*time.Minute, opFlags.ReadmeMaxSize, opFlags.ProbeMedia)
+	statisticsTicker := time.NewTicker(time.Minute)
+	defer statisticsTicker.Stop()
+	retryTicker := time.NewTicker(30 * time.Second)
+	defer retryTicker.Stop()
+	announces := newAnnounceCounter()
+	announcesTicker := time.NewTicker(ANNOUNCES_FLUSH_INTERVAL)
+	defer announcesTicker.Stop()
+	flushAnnounces := func() {
+		flushed := announces.flush()
+		dbWriter.do("Could not add the announces to the database!", func(database persistence.Database) error {
+			return database.AddAnnounces(flushed)
+		})
+	}
+
+	// Once shutting down, idle is closed when the metadata being fetched are either drained or
+	// failed, unless graceTimeout expires first.
+	fetchLimiter := new(rateLimiter)
+	fetchLimiter.setRate(opFlags.Runtime.MaxFetchRate)
+	filter := opFlags.Runtime.Filter
+
+	var idle <-chan struct{}
+	var graceTimeout <-chan time.Time
 
 	// The Event Loop
 	for stopped := false; !stopped; {
 		select {
 		case result := <-trawlingManager.Output():
 			zap.L().Info("Trawled!", zap.String("infoHash", result.InfoHash.String()))
-			exists, err := database.DoesTorrentExist(result.InfoHash[:])
-			if err != nil {
+			announcesReceived.Inc()
+			if announces.add(result.InfoHash, time.Now()) {
+				flushAnnounces()
+			}
+			exists, err := existence.doesExist(database, result.InfoHash[:])
+			if persistence.IsTransient(err) {
+				// Fetching the metadata of a torrent that exists already is harmless (as it will be
+				// ignored when it is written) whereas missing it is not, so assume it does not exist.
+				zap.L().Warn("Could not check whether torrent exists, assuming not.", zap.Error(err))
+				exists = false
+			} else if err != nil {
 				zap.L().Fatal("Could not check whether torrent exists!", zap.Error(err))
-			} else if !exists {
-				metadataSink.Sink(result)
 			}
+			if exists {
+				break
+			}
+			if !fetchLimiter.allow(time.Now()) {
+				zap.L().Debug("Skipped due to the fetch rate limit.", zap.String("infoHash", result.InfoHash.String()))
+				break
+			}
+			metadataSink.Sink(result)
 
 		case metadata := <-metadataSink.Drain():
-			if err := database.AddNewTorrent(metadata.InfoHash, metadata.Name, metadata.Files); err != nil {
-				logger.Sugar().Fatalf("Could not add new torrent %x to the database: %s",
-					metadata.InfoHash, err.Error())
+			// Filtered out torrents are also marked as existing, so that they are not fetched again
+			// (at least for a while).
+			existence.add(metadata.InfoHash)
+			if len(metadata.InfoHashV2) != 0 {
+				// The peers of the v2 swarm of hybrid torrents announce the truncated v2 infohash.
+				existence.add(metadata.InfoHashV2[:20])
+			}
+			// The torrent might have been pending by either of its infohashes.
+			pendingInfoHashes := [][]byte{metadata.InfoHash}
+			if len(metadata.InfoHashV2) != 0 {
+				pendingInfoHashes = append(pendingInfoHashes, metadata.InfoHashV2[:20])
 			}
+			dbWriter.do("Could not delete the pending infohash!", func(database persistence.Database) error {
+				for _, infoHash := range pendingInfoHashes {
+					if err := database.DeletePendingInfoHash(infoHash); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if allowed, reason := filter.allows(metadata); !allowed {
+				zap.L().Info("Filtered out!", zap.String("name", metadata.Name),
+					zap.String("infoHash", hex.EncodeToString(metadata.InfoHash)), zap.String("reason", reason))
+				break
+			}
+			dbWriter.addTorrent(persistence.NewTorrent{
+				InfoHash:     metadata.InfoHash,
+				Name:         metadata.Name,
+				Files:        metadata.Files,
+				InfoMetadata: metadata.InfoMetadata,
+				Info:         metadata.Info,
+				Readme:       metadata.Readme,
+				MediaInfo:    metadata.MediaInfo,
+			})
 			zap.L().Info("Fetched!", zap.String("name", metadata.Name), zap.String("infoHash", hex.EncodeToString(metadata.InfoHash)))
 
+		case failure := <-metadataSink.Failures():
+			failedOn := time.Now()
+			dbWriter.do("Could not record the failed infohash!", func(database persistence.Database) error {
+				return recordFailure(database, failure, failedOn)
+			})
+
+		case <-announcesTicker.C:
+			flushAnnounces()
+
+		case <-retryTicker.C:
+			if idle != nil {
+				continue
+			}
+			retriedOn := time.Now()
+			dbWriter.do("Could not retry the pending infohashes!", func(database persistence.Database) error {
+				return retryPending(database, metadataSink, retriedOn)
+			})
+
+		case <-statisticsTicker.C:
+			stats := metadataSink.Statistics()
+			fields := []zap.Field{zap.Uint64("succeeded", stats.Succeeded)}
+			for reason, n := range stats.Failed {
+				fields = append(fields, zap.Uint64(reason.String(), n))
+			}
+			zap.L().Info("Metadata fetching statistics", fields...)
+
+			peerStats := metadataSink.FlushPeerStatistics()
+			dbWriter.do("Could not add the peer statistics to the database!", func(database persistence.Database) error {
+				return database.AddPeerStatistics(peerStats)
+			})
+
+		case <-hangupChan:
+			if opFlags.ConfigPath == "" {
+				zap.L().Warn("SIGHUP received but there is no configuration file to reload.")
+				continue
+			}
+			runtime, err := reloadConfig(opFlags)
+			if err != nil {
+				zap.L().Error("Could not reload the configuration file, keeping the current one!", zap.Error(err))
+				continue
+			}
+			loggerLevel.SetLevel(runtime.LogLevel)
+			fetchLimiter.setRate(runtime.MaxFetchRate)
+			filter = runtime.Filter
+			zap.L().Info("Reloaded the configuration file.", zap.String("path", opFlags.ConfigPath))
+
 		case <-interruptChan:
+			if idle != nil {
+				zap.L().Warn("Interrupted again, shutting down immediately!")
+				stopped = true
+				continue
+			}
+			zap.L().Info("Shutting down, waiting for the metadata being fetched...",
+				zap.Duration("grace", opFlags.ShutdownGrace))
 			trawlingManager.Terminate()
+			idle = metadataSink.Stop()
+			graceTimeout = time.After(opFlags.ShutdownGrace)
+
+		case <-idle:
+			stopped = true
+
+		case <-graceTimeout:
+			zap.L().Info("Grace period is over, abandoning the metadata being fetched.")
 			stopped = true
 		}
 	}
 
+	metadataSink.Terminate()
+
+	flushAnnounces()
+	peerStats := metadataSink.FlushPeerStatistics()
+	dbWriter.do("Could not add the peer statistics to the database!", func(database persistence.Database) error {
+		return database.AddPeerStatistics(peerStats)
+	})
+	// Wait for all the writes to be done before closing the database.
+	dbWriter.close()
+
 	if err = database.Close(); err != nil {
 		zap.L().Error("Could not close database!", zap.Error(err))
 	}
@@ -129,12 +310,31 @@ func parseFlags() *opFlags {
 	opF := new(opFlags)
 	cmdF := new(cmdFlags)
 
-	_, err := flags.Parse(cmdF)
+	parser := flags.NewParser(cmdF, flags.Default)
+	_, err := parser.Parse()
 	if err != nil {
 		// Do not print any error messages as jessevdk/go-flags already did.
 		os.Exit(1)
 	}
 
+	var fc *fileConfig
+	if cmdF.Config != "" {
+		fc, err = loadFileConfig(cmdF.Config)
+		if err != nil {
+			zap.L().Fatal("Failed to load the configuration file", zap.Error(err))
+		}
+		if fc.Database != "" && !config.IsExplicit(parser, "database") {
+			cmdF.DatabaseURL = fc.Database
+		}
+		if len(fc.Bind) != 0 && !config.IsExplicit(parser, "bind") {
+			cmdF.BindAddr = fc.Bind
+		}
+		if fc.SearchIndex != "" && !config.IsExplicit(parser, "search-index") {
+			cmdF.SearchIndex = fc.SearchIndex
+		}
+	}
+	opF.ConfigPath = cmdF.Config
+
 	if cmdF.DatabaseURL == "" {
 		cmdF.DatabaseURL = "sqlite3://" + path.Join(
 			appdirs.UserDataDir("magneticod", "", "", false),
@@ -145,6 +345,12 @@ func parseFlags() *opFlags {
 	if err != nil {
 		zap.L().Fatal("Failed to parse DB URL", zap.Error(err))
 	}
+	if cmdF.SearchIndex != "" {
+		opF.SearchIndexURL, err = url.Parse(cmdF.SearchIndex)
+		if err != nil {
+			zap.L().Fatal("Failed to parse search index URL", zap.Error(err))
+		}
+	}
 
 	for _, addr := range cmdF.BindAddr {
 		udpAddr, err := net.ResolveUDPAddr("udp", addr)
@@ -159,6 +365,37 @@ func parseFlags() *opFlags {
 	opF.Verbosity = len(cmdF.Verbose)
 
 	opF.Profile = cmdF.Profile
+	opF.DebugAddr = cmdF.DebugAddr
+	opF.MetricsAddr = cmdF.MetricsAddr
+
+	if cmdF.Readme {
+		opF.ReadmeMaxSize = uint64(cmdF.ReadmeMaxSize)
+	}
+	opF.ProbeMedia = cmdF.ProbeMedia
+
+	if cmdF.BatchSize == 0 {
+		zap.L().Fatal("Batch size must be positive!")
+	}
+	opF.BatchSize = int(cmdF.BatchSize)
+	if cmdF.BatchInterval == 0 {
+		zap.L().Fatal("Batch interval must be positive!")
+	}
+	opF.BatchInterval = time.Duration(cmdF.BatchInterval) * time.Millisecond
+
+	if cmdF.SpillDir == "" {
+		cmdF.SpillDir = path.Join(appdirs.UserCacheDir("magneticod", "", "", false), "spill")
+	}
+	opF.SpillDir = cmdF.SpillDir
+
+	opF.ShutdownGrace = time.Duration(cmdF.ShutdownGrace) * time.Second
+
+	opF.MaxFetchRate = cmdF.MaxFetchRate
+	opF.explicitVerbosity = config.IsExplicit(parser, "verbose")
+	opF.explicitMaxFetchRate = config.IsExplicit(parser, "max-fetch-rate")
+	opF.Runtime, err = makeRuntimeConfig(opF, fc)
+	if err != nil {
+		zap.L().Fatal("Invalid configuration file", zap.Error(err))
+	}
 
 	return opF
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+var (
+	announcesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "magneticod",
+		Name:      "announces_received_total",
+		Help:      "Number of torrents trawled from the DHT (including the ones that exist already).",
+	})
+	torrentsAdded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "magneticod",
+		Name:      "torrents_added_total",
+		Help:      "Number of new torrents written to the database.",
+	})
+	dbWriteDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "magneticod",
+			Subsystem: "database",
+			Name:      "write_duration_seconds",
+			Help:      "Time it takes to write to the database, by operation (each attempt is observed separately).",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(announcesReceived, torrentsAdded, dbWriteDuration)
+}
+
+// observeWrite calls @fn and observes how long it takes as the given operation.
+func observeWrite(operation string, fn func() error) error {
+	started := time.Now()
+	err := fn()
+	dbWriteDuration.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+	return err
+}
+
+// serveMetrics serves the Prometheus metrics at /metrics on the given address. It is a goroutine!
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	zap.L().Info("Serving the metrics.", zap.String("addr", addr))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		zap.L().Error("Could not serve the metrics!", zap.Error(err))
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestWriterMetrics(t *testing.T) {
+	database := &flakyDatabase{}
+	w := &writer{database: database, retryInterval: time.Millisecond}
+
+	added := testutil.ToFloat64(torrentsAdded)
+	w.flush([]persistence.NewTorrent{{Name: "a"}, {Name: "bad"}, {Name: "c"}})
+	// The bad torrent is dropped, and the others are written one by one afterwards.
+	if n := testutil.ToFloat64(torrentsAdded) - added; n != 2 {
+		t.Errorf("Expected 2 torrents to be counted as added, got %v", n)
+	}
+	if testutil.CollectAndCount(dbWriteDuration) != 1 {
+		t.Error("Expected the write durations of adding new torrents to be observed")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PROFILE_INTERVAL is how often the CPU and heap profiles are written while running, so that a
+// recent profile is available even if magneticod is killed instead of being shut down gracefully.
+const PROFILE_INTERVAL = 10 * time.Minute
+
+// profiler writes a profile of the given kind ("cpu", "memory", or "trace") periodically (except
+// for the execution traces, which are written continuously), and once more when it is stopped.
+type profiler struct {
+	kind string
+	// file is the execution trace or the ongoing CPU profile.
+	file *os.File
+	stop chan struct{}
+	done chan struct{}
+}
+
+var profileFileNames = map[string]string{
+	"cpu":    "magneticod_cpu.prof",
+	"memory": "magneticod_mem.prof",
+	"trace":  "magneticod.trace",
+}
+
+func startProfiler(kind string) (*profiler, error) {
+	p := &profiler{
+		kind: kind,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	switch kind {
+	case "cpu":
+		if err := p.startCPUProfile(); err != nil {
+			return nil, err
+		}
+
+	case "memory":
+		// The heap profile is a snapshot, so there is nothing to start.
+
+	case "trace":
+		file, err := os.Create(profileFileNames[kind])
+		if err != nil {
+			return nil, fmt.Errorf("could not create the trace file: %s", err.Error())
+		}
+		if err = trace.Start(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not start tracing: %s", err.Error())
+		}
+		p.file = file
+		close(p.done)
+		return p, nil
+
+	default:
+		return nil, fmt.Errorf("unknown profile `%s`", kind)
+	}
+
+	go p.run()
+	return p, nil
+}
+
+// run is a goroutine!
+func (p *profiler) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(PROFILE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.write(true); err != nil {
+				zap.L().Error("Could not write the profile!", zap.String("profile", p.kind), zap.Error(err))
+			}
+
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop writes the final profile.
+func (p *profiler) Stop() {
+	if p.kind == "trace" {
+		trace.Stop()
+		if err := p.file.Close(); err != nil {
+			zap.L().Error("Could not close the trace file!", zap.Error(err))
+		}
+		return
+	}
+
+	close(p.stop)
+	<-p.done
+	if err := p.write(false); err != nil {
+		zap.L().Error("Could not write the profile!", zap.String("profile", p.kind), zap.Error(err))
+	}
+}
+
+// write writes the CPU profile since the last time it is written, or a snapshot of the heap. If
+// @resume is true, a new CPU profile is started afterwards.
+func (p *profiler) write(resume bool) error {
+	name := profileFileNames[p.kind]
+
+	if p.kind == "cpu" {
+		pprof.StopCPUProfile()
+		if err := p.file.Close(); err != nil {
+			return err
+		}
+		// The profile is written to a temporary file first, so that the previous one is replaced
+		// only once the new one is complete.
+		if err := os.Rename(name+".tmp", name); err != nil {
+			return err
+		}
+		if resume {
+			return p.startCPUProfile()
+		}
+		return nil
+	}
+
+	file, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	// Get up-to-date statistics, as the heap profile is as of the last garbage collection.
+	runtime.GC()
+	if err = pprof.WriteHeapProfile(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (p *profiler) startCPUProfile() error {
+	file, err := os.Create(profileFileNames["cpu"] + ".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create the cpu profile file: %s", err.Error())
+	}
+	if err = pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		return fmt.Errorf("could not start the cpu profile: %s", err.Error())
+	}
+	p.file = file
+	return nil
+}
+
+// serveDebug serves the net/http/pprof endpoints under /debug/pprof/ and the runtime statistics
+// (as expvar's JSON) at /debug/vars, on the given address which is meant to be a loopback one.
+// It is a goroutine!
+func serveDebug(addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); (ip == nil && host != "localhost") || (ip != nil && !ip.IsLoopback()) {
+			zap.L().Warn("The debug listener is not on a loopback address, it should not be exposed!",
+				zap.String("addr", addr))
+		}
+	}
+
+	zap.L().Info("Serving the debug endpoints.", zap.String("addr", addr))
+	if err := http.ListenAndServe(addr, debugHandler()); err != nil {
+		zap.L().Error("Could not serve the debug endpoints!", zap.Error(err))
+	}
+}
+
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func init() {
+	// expvar publishes the memory statistics (as "memstats") and the command line already.
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestProfiler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magneticod")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Chdir(wd)
+
+	for _, kind := range []string{"cpu", "memory", "trace"} {
+		p, err := startProfiler(kind)
+		if err != nil {
+			t.Fatalf("Could not start the %s profiler: %s", kind, err.Error())
+		}
+		p.Stop()
+
+		info, err := os.Stat(profileFileNames[kind])
+		if err != nil {
+			t.Errorf("Expected the %s profile to be written: %s", kind, err.Error())
+		} else if info.Size() == 0 {
+			t.Errorf("Expected the %s profile not to be empty", kind)
+		}
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	server := httptest.NewServer(debugHandler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer response.Body.Close()
+
+	var vars map[string]interface{}
+	if err = json.NewDecoder(response.Body).Decode(&vars); err != nil {
+		t.Fatalf("Could not decode the runtime statistics: %s", err.Error())
+	}
+	if _, exists := vars["goroutines"]; !exists {
+		t.Error("Expected the number of goroutines in the runtime statistics")
+	}
+	if _, exists := vars["memstats"]; !exists {
+		t.Error("Expected the memory statistics in the runtime statistics")
+	}
+
+	response, err = http.Get(server.URL + "/debug/pprof/heap")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected the heap profile to be served, got %s", response.Status)
+	}
+}
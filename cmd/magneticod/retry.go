@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/cmd/magneticod/bittorrent"
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+const (
+	// RETRY_BASE_INTERVAL is the interval between the first and the second attempts to fetch the
+	// metadata of a torrent, which is doubled after each failed attempt up to RETRY_MAX_INTERVAL.
+	RETRY_BASE_INTERVAL = time.Minute
+	RETRY_MAX_INTERVAL  = 24 * time.Hour
+	// MAX_ATTEMPTS is the number of attempts after which an infohash is given up on.
+	MAX_ATTEMPTS = 12
+	// MAX_PENDING_PEERS is the number of the (most recent) peers remembered for an infohash.
+	MAX_PENDING_PEERS = 8
+	// RETRY_BATCH_SIZE is the maximum number of infohashes retried at once.
+	RETRY_BATCH_SIZE = 64
+)
+
+// retryBackoff returns the interval to wait before the next attempt, after nAttempts have failed.
+func retryBackoff(nAttempts uint) time.Duration {
+	backoff := RETRY_BASE_INTERVAL
+	for i := uint(1); i < nAttempts && backoff < RETRY_MAX_INTERVAL; i++ {
+		backoff *= 2
+	}
+	if backoff > RETRY_MAX_INTERVAL {
+		backoff = RETRY_MAX_INTERVAL
+	}
+	return backoff
+}
+
+// recordFailure adds the infohash whose metadata could not be fetched to the pending infohashes (or
+// updates it, if it is already pending), so that it is retried later.
+func recordFailure(database persistence.Database, failure bittorrent.Failure, now time.Time) error {
+	pending, err := database.GetPendingInfoHash(failure.InfoHash[:])
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		pending = &persistence.PendingInfoHash{InfoHash: failure.InfoHash[:]}
+	}
+
+	pending.NAttempts++
+	if pending.NAttempts >= MAX_ATTEMPTS {
+		zap.L().Debug("Giving up on infohash.", zap.Binary("infoHash", failure.InfoHash[:]),
+			zap.Uint("nAttempts", pending.NAttempts))
+		return database.DeletePendingInfoHash(failure.InfoHash[:])
+	}
+	pending.LastAttempt = now.Unix()
+	pending.NextAttempt = now.Add(retryBackoff(pending.NAttempts)).Unix()
+	for _, peer := range failure.Peers {
+		pending.Peers = addPeer(pending.Peers, peer.Addr.String())
+	}
+
+	return database.AddPendingInfoHash(*pending)
+}
+
+// addPeer adds the peer to the end of the peers (as the most recent one), keeping at most
+// MAX_PENDING_PEERS of them.
+func addPeer(peers []string, peer string) []string {
+	for i, p := range peers {
+		if p == peer {
+			peers = append(peers[:i], peers[i+1:]...)
+			break
+		}
+	}
+	peers = append(peers, peer)
+	if len(peers) > MAX_PENDING_PEERS {
+		peers = peers[len(peers)-MAX_PENDING_PEERS:]
+	}
+	return peers
+}
+
+// retryPending retries the pending infohashes whose next attempts are due, most recent peers first.
+func retryPending(database persistence.Database, metadataSink *bittorrent.MetadataSink, now time.Time) error {
+	pendings, err := database.GetDuePendingInfoHashes(now.Unix(), RETRY_BATCH_SIZE)
+	if err != nil {
+		return err
+	}
+
+	for _, pending := range pendings {
+		var infoHash [20]byte
+		copy(infoHash[:], pending.InfoHash)
+
+		var peers []bittorrent.Peer
+		for i := len(pending.Peers) - 1; i >= 0; i-- {
+			addr, err := net.ResolveTCPAddr("tcp", pending.Peers[i])
+			if err != nil {
+				continue
+			}
+			peers = append(peers, bittorrent.Peer{Addr: addr})
+		}
+
+		// Postpone the next attempt as if this one has failed already, so that the infohash is
+		// not retried again while it is being fetched. If it fails, recordFailure reschedules it.
+		pending.NextAttempt = now.Add(retryBackoff(pending.NAttempts + 1)).Unix()
+		if err = database.AddPendingInfoHash(pending); err != nil {
+			return err
+		}
+
+		metadataSink.Retry(infoHash, peers)
+	}
+
+	return nil
+}
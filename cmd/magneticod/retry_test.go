@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/cmd/magneticod/bittorrent"
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := map[uint]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		12: RETRY_MAX_INTERVAL,
+		99: RETRY_MAX_INTERVAL,
+	}
+	for nAttempts, expected := range tests {
+		if backoff := retryBackoff(nAttempts); backoff != expected {
+			t.Errorf("Expected %s after %d attempts, got %s", expected, nAttempts, backoff)
+		}
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magneticod")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	database, err := persistence.MakeDatabase(&url.URL{Scheme: "sqlite3", Path: path.Join(dir, "database.sqlite3")}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Could not open the database: %s", err.Error())
+	}
+	defer database.Close()
+
+	failure := bittorrent.Failure{
+		InfoHash: [20]byte{0xde, 0xad},
+		Peers:    []bittorrent.Peer{{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}}},
+	}
+	now := time.Unix(1000000, 0)
+
+	for i := 0; i < 2; i++ {
+		if err = recordFailure(database, failure, now); err != nil {
+			t.Fatalf("Could not record the failure: %s", err.Error())
+		}
+	}
+
+	pending, err := database.GetPendingInfoHash(failure.InfoHash[:])
+	if err != nil || pending == nil {
+		t.Fatalf("Expected the infohash to be pending (%v)", err)
+	}
+	if pending.NAttempts != 2 || pending.NextAttempt != now.Add(2*time.Minute).Unix() ||
+		len(pending.Peers) != 1 || pending.Peers[0] != "127.0.0.1:6881" {
+		t.Errorf("Unexpected pending infohash %+v", *pending)
+	}
+
+	for i := 2; i < MAX_ATTEMPTS; i++ {
+		if err = recordFailure(database, failure, now); err != nil {
+			t.Fatalf("Could not record the failure: %s", err.Error())
+		}
+	}
+	if pending, _ = database.GetPendingInfoHash(failure.InfoHash[:]); pending != nil {
+		t.Errorf("Expected the infohash to be given up on after %d attempts", MAX_ATTEMPTS)
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	var peers []string
+	for _, peer := range []string{"a", "b", "a", "c", "d", "e", "f", "g", "h", "i"} {
+		peers = addPeer(peers, peer)
+	}
+	if len(peers) != MAX_PENDING_PEERS || peers[0] != "a" || peers[len(peers)-1] != "i" {
+		t.Errorf("Unexpected peers %v", peers)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// spill is a buffer on disk for the new torrents that could not be written to the database (e.g.
+// because it is locked or unreachable for a while), so that they are not lost and can be written
+// later on, even after a restart. Each batch is stored in a JSON file of its own in the directory.
+type spill struct {
+	dir string
+}
+
+const spillFileExt = ".json"
+
+// write stores the batch in a new file.
+func (s spill) write(torrents []persistence.NewTorrent) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("could not create the spill directory: %s", err.Error())
+	}
+
+	data, err := json.Marshal(torrents)
+	if err != nil {
+		return fmt.Errorf("could not marshal the torrents: %s", err.Error())
+	}
+
+	// The files are named after the time they are created (zero-padded, so that their names sort
+	// in the same order), and they are renamed only after they are written completely so that a
+	// crash cannot leave a partial file behind.
+	name := path.Join(s.dir, fmt.Sprintf("%020d", time.Now().UnixNano()))
+	if err = ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("could not write the spill file: %s", err.Error())
+	}
+	if err = os.Rename(name+".tmp", name+spillFileExt); err != nil {
+		return fmt.Errorf("could not rename the spill file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// replay calls @fn with the batches in the order they are written, deleting each after @fn
+// succeeds, until @fn fails.
+func (s spill) replay(fn func(torrents []persistence.NewTorrent) error) error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not list the spill directory: %s", err.Error())
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spillFileExt) {
+			names = append(names, path.Join(s.dir, entry.Name()))
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("could not read the spill file: %s", err.Error())
+		}
+
+		var torrents []persistence.NewTorrent
+		if err = json.Unmarshal(data, &torrents); err != nil {
+			// Retrying would not help, so log and discard it instead of getting stuck.
+			zap.L().Error("Could not unmarshal the spill file, discarding!",
+				zap.String("file", name), zap.Error(err))
+		} else if err = fn(torrents); err != nil {
+			return err
+		}
+
+		if err = os.Remove(name); err != nil {
+			return fmt.Errorf("could not remove the spill file: %s", err.Error())
+		}
+	}
+
+	return nil
+}
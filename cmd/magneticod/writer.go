@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+const (
+	// WRITER_QUEUE_SIZE is the number of torrents (and separately, of the other writes) that can be
+	// waiting to be written before the event loop blocks on the writer.
+	WRITER_QUEUE_SIZE = 1024
+	// WRITE_RETRY_BASE_INTERVAL is the time to wait before retrying a write that failed due to a
+	// transient error, which doubles after every attempt.
+	WRITE_RETRY_BASE_INTERVAL = 100 * time.Millisecond
+	// WRITE_MAX_ATTEMPTS is the number of times a write is attempted before the database is
+	// considered unavailable.
+	WRITE_MAX_ATTEMPTS = 5
+	// SPILL_REPLAY_INTERVAL is how often the spilled torrents are tried to be written again.
+	SPILL_REPLAY_INTERVAL = time.Minute
+)
+
+var errDatabaseUnavailable = errors.New("the database is unavailable")
+
+// writer performs all the writes to the database in a goroutine of its own, so that the event loop
+// never blocks on disk. New torrents are written in batches, each in a single transaction, of at
+// most batchSize torrents or of the torrents received in batchInterval, whichever comes first.
+//
+// The other writes are run as soon as they are received, hence they might be run before the new
+// torrents that are received earlier are written.
+//
+// Writes that fail due to transient errors are retried with exponential backoff. If they still
+// fail, the database is considered unavailable until the next replay of the spill: meanwhile, new
+// batches are spilled to the disk directly and the other writes are dropped, so that the writer
+// keeps up with the event loop.
+type writer struct {
+	database      persistence.Database
+	batchSize     int
+	batchInterval time.Duration
+	spill         spill
+	retryInterval time.Duration
+
+	// unavailable is true if the last write failed even after retrying.
+	unavailable bool
+
+	torrents chan persistence.NewTorrent
+	jobs     chan writeJob
+	done     chan struct{}
+}
+
+type writeJob struct {
+	// errorMessage is logged if the job fails.
+	errorMessage string
+	fn           func(database persistence.Database) error
+}
+
+func newWriter(database persistence.Database, batchSize int, batchInterval time.Duration, spillDir string) *writer {
+	w := &writer{
+		database:      database,
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+		spill:         spill{dir: spillDir},
+		retryInterval: WRITE_RETRY_BASE_INTERVAL,
+		torrents:      make(chan persistence.NewTorrent, WRITER_QUEUE_SIZE),
+		jobs:          make(chan writeJob, WRITER_QUEUE_SIZE),
+		done:          make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// addTorrent queues the torrent to be written in the next batch.
+func (w *writer) addTorrent(torrent persistence.NewTorrent) {
+	w.torrents <- torrent
+}
+
+// do queues @fn to be run on the database, and @errorMessage is logged (with the error) if it fails.
+func (w *writer) do(errorMessage string, fn func(database persistence.Database) error) {
+	w.jobs <- writeJob{errorMessage: errorMessage, fn: fn}
+}
+
+// close writes the remaining torrents, runs the remaining jobs, and returns after all is done. The
+// writer must not be used afterwards.
+func (w *writer) close() {
+	close(w.torrents)
+	close(w.jobs)
+	<-w.done
+}
+
+func (w *writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.batchInterval)
+	defer ticker.Stop()
+	replayTicker := time.NewTicker(SPILL_REPLAY_INTERVAL)
+	defer replayTicker.Stop()
+
+	// The torrents spilled before a restart are written as soon as possible.
+	w.replay()
+
+	batch := make([]persistence.NewTorrent, 0, w.batchSize)
+	torrents, jobs := w.torrents, w.jobs
+	for torrents != nil || jobs != nil {
+		select {
+		case torrent, ok := <-torrents:
+			if !ok {
+				torrents = nil
+				continue
+			}
+			batch = append(batch, torrent)
+			if len(batch) >= w.batchSize {
+				batch = w.flush(batch)
+			}
+
+		case job, ok := <-jobs:
+			if !ok {
+				jobs = nil
+				continue
+			}
+			if w.unavailable {
+				zap.L().Debug("Dropped a write as the database is unavailable.",
+					zap.String("error", job.errorMessage))
+				continue
+			}
+			err := w.retry(func() error {
+				return observeWrite("job", func() error {
+					return job.fn(w.database)
+				})
+			})
+			if err != nil {
+				zap.L().Error(job.errorMessage, zap.Error(err))
+			}
+
+		case <-ticker.C:
+			batch = w.flush(batch)
+
+		case <-replayTicker.C:
+			w.replay()
+		}
+	}
+
+	w.flush(batch)
+}
+
+// flush writes the batch (or spills it if the database is unavailable), and returns it emptied to
+// be reused.
+func (w *writer) flush(batch []persistence.NewTorrent) []persistence.NewTorrent {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	err := errDatabaseUnavailable
+	if !w.unavailable {
+		err = w.addNewTorrents(batch)
+	}
+	if err == nil {
+		zap.L().Debug("Added the new torrents to the database.", zap.Int("torrents", len(batch)))
+		return batch[:0]
+	}
+
+	if spillErr := w.spill.write(batch); spillErr != nil {
+		zap.L().Error("Could not spill the new torrents to the disk, they are lost!",
+			zap.Int("torrents", len(batch)), zap.NamedError("writeError", err), zap.Error(spillErr))
+	} else {
+		zap.L().Warn("Spilled the new torrents to the disk to be written later.",
+			zap.Int("torrents", len(batch)), zap.Error(err))
+	}
+
+	return batch[:0]
+}
+
+// addNewTorrents writes the torrents, and returns an error only if the database is unavailable. If
+// a permanent error occurs, the torrents are written one by one so that only the offending ones are
+// dropped.
+func (w *writer) addNewTorrents(torrents []persistence.NewTorrent) error {
+	err := w.retry(func() error {
+		return observeWrite("add_new_torrents", func() error {
+			return w.database.AddNewTorrents(torrents)
+		})
+	})
+	if err == nil {
+		torrentsAdded.Add(float64(len(torrents)))
+		return nil
+	} else if persistence.IsTransient(err) {
+		return err
+	}
+
+	if len(torrents) == 1 {
+		zap.L().Error("Could not add the new torrent to the database, dropping!",
+			zap.String("infoHash", hex.EncodeToString(torrents[0].InfoHash)), zap.Error(err))
+		return nil
+	}
+	for i := range torrents {
+		if err = w.addNewTorrents(torrents[i : i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry calls @fn until it succeeds or fails with a permanent error, for at most WRITE_MAX_ATTEMPTS
+// times with exponential backoff, and marks the database unavailable if it has failed with a
+// transient error all the way.
+func (w *writer) retry(fn func() error) error {
+	var err error
+	interval := w.retryInterval
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if !persistence.IsTransient(err) {
+			return err
+		}
+		if attempt == WRITE_MAX_ATTEMPTS {
+			break
+		}
+
+		zap.L().Warn("Transient database error, retrying...", zap.Duration("after", interval), zap.Error(err))
+		time.Sleep(interval)
+		interval *= 2
+	}
+
+	w.unavailable = true
+	return err
+}
+
+// replay writes the spilled torrents, and marks the database available again if all succeed.
+func (w *writer) replay() {
+	w.unavailable = false
+	if err := w.spill.replay(w.addNewTorrents); err != nil {
+		zap.L().Warn("Could not write the spilled torrents to the database.", zap.Error(err))
+	}
+}
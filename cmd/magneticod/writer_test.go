@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func makeTestDatabase(t *testing.T) (persistence.Database, func()) {
+	dir, err := ioutil.TempDir("", "magneticod")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	database, err := persistence.MakeDatabase(&url.URL{Scheme: "sqlite3", Path: path.Join(dir, "database.sqlite3")}, zap.NewNop())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not open the database: %s", err.Error())
+	}
+
+	return database, func() {
+		database.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	database, cleanUp := makeTestDatabase(t)
+	defer cleanUp()
+
+	spillDir, err := ioutil.TempDir("", "magneticod")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(spillDir)
+
+	// The interval is long enough for the batches to be written only when they are full or when
+	// the writer is closed.
+	w := newWriter(database, 3, time.Hour, spillDir)
+	for i := 0; i < 5; i++ {
+		w.addTorrent(persistence.NewTorrent{
+			InfoHash: testInfoHash(i),
+			Name:     "torrent",
+			Files:    []persistence.File{{Path: "torrent", Size: 1}},
+		})
+	}
+	jobRun := false
+	w.do("Could not run the job!", func(database persistence.Database) error {
+		jobRun = true
+		return nil
+	})
+	w.close()
+
+	if !jobRun {
+		t.Error("Expected the job to be run before the writer is closed")
+	}
+	n, err := database.GetNumberOfTorrents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != 5 {
+		t.Errorf("Expected 5 torrents to be written, got %d", n)
+	}
+}
+
+// flakyDatabase fails to add new torrents with a transient error for the given number of times,
+// and with a permanent error whenever a torrent named "bad" is in the batch.
+type flakyDatabase struct {
+	persistence.Database
+	nFailures int
+	added     []string
+}
+
+func (db *flakyDatabase) AddNewTorrents(torrents []persistence.NewTorrent) error {
+	if db.nFailures > 0 {
+		db.nFailures--
+		return sqlite3.Error{Code: sqlite3.ErrBusy}
+	}
+	for _, torrent := range torrents {
+		if torrent.Name == "bad" {
+			return errors.New("bad torrent")
+		}
+	}
+	for _, torrent := range torrents {
+		db.added = append(db.added, torrent.Name)
+	}
+	return nil
+}
+
+func TestWriter_TransientErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magneticod")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	database := &flakyDatabase{nFailures: WRITE_MAX_ATTEMPTS - 1}
+	w := &writer{database: database, spill: spill{dir: dir}, retryInterval: time.Millisecond}
+
+	// Succeeds at the last attempt.
+	w.flush([]persistence.NewTorrent{{Name: "a"}})
+	if len(database.added) != 1 || w.unavailable {
+		t.Fatalf("Expected the torrent to be added after retrying, got %v", database.added)
+	}
+
+	// Fails all the attempts, hence spilled.
+	database.nFailures = WRITE_MAX_ATTEMPTS
+	w.flush([]persistence.NewTorrent{{Name: "b"}})
+	if !w.unavailable {
+		t.Fatal("Expected the database to be unavailable")
+	}
+	// Spilled directly while the database is unavailable.
+	w.flush([]persistence.NewTorrent{{Name: "c"}})
+	if len(database.added) != 1 || database.nFailures != 0 {
+		t.Fatalf("Expected no more attempts while the database is unavailable, got %v", database.added)
+	}
+
+	w.replay()
+	if w.unavailable {
+		t.Fatal("Expected the database to be available after the replay")
+	}
+	if len(database.added) != 3 || database.added[1] != "b" || database.added[2] != "c" {
+		t.Fatalf("Expected the spilled torrents to be added in order, got %v", database.added)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the spill files to be removed, got %d", len(entries))
+	}
+}
+
+func TestWriter_PermanentErrors(t *testing.T) {
+	database := &flakyDatabase{}
+	w := &writer{database: database, retryInterval: time.Millisecond}
+
+	w.flush([]persistence.NewTorrent{{Name: "a"}, {Name: "bad"}, {Name: "c"}})
+	if len(database.added) != 2 || database.added[0] != "a" || database.added[1] != "c" {
+		t.Fatalf("Expected only the bad torrent to be dropped, got %v", database.added)
+	}
+	if w.unavailable {
+		t.Error("Expected the database to be available")
+	}
+}
+
+func TestExistenceCache(t *testing.T) {
+	database, cleanUp := makeTestDatabase(t)
+	defer cleanUp()
+
+	err := database.AddNewTorrent(testInfoHash(1), "torrent", []persistence.File{{Path: "torrent", Size: 1}},
+		persistence.InfoMetadata{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ec, err := newExistenceCache(database)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		infoHash []byte
+		expected bool
+	}{
+		{testInfoHash(1), true},  // loaded from the database
+		{testInfoHash(2), false}, // neither in the database nor added
+		{testInfoHash(3), true},  // added, but not written to the database yet
+	}
+	ec.add(testInfoHash(3))
+
+	for i, test := range tests {
+		exists, err := ec.doesExist(database, test.infoHash)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if exists != test.expected {
+			t.Errorf("Expected existence of the torrent #%d to be %t", i, test.expected)
+		}
+	}
+}
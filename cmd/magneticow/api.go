@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// API_MAX_LIMIT is the maximum number of the torrents returned by the API at once.
+const API_MAX_LIMIT = 100
+
+type apiTorrent struct {
+	ID           uint     `json:"id"`
+	InfoHash     string   `json:"infoHash"`
+	Name         string   `json:"name"`
+	Size         uint64   `json:"size"`
+	DiscoveredOn int64    `json:"discoveredOn"`
+	NFiles       uint     `json:"nFiles"`
+	MatchedFiles []string `json:"matchedFiles,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiTorrentsHandler returns the torrents as JSON, given the same query parameters as the torrents
+// page (search, in, orderBy, ascending, limit, and the filters, see parseTorrentFilter), where the
+// next pages are those after the lastOrderedValue and the lastID (of the last torrent of the
+// previous page, with its discoveredOn, size, or nFiles as the lastOrderedValue) that are
+// discovered before the epoch (the time of the first page).
+func apiTorrentsHandler(w http.ResponseWriter, r *http.Request) {
+	queryValues := r.URL.Query()
+	search := queryValues.Get("search")
+
+	badRequest := func(message string) {
+		writeJSON(w, http.StatusBadRequest, apiError{message})
+	}
+
+	epoch := time.Now().Unix()
+	limit := uint64(N_TORRENTS)
+	var lastOrderedValue, lastID uint64
+	for name, value := range map[string]*uint64{"limit": &limit, "lastOrderedValue": &lastOrderedValue, "lastID": &lastID} {
+		if queryValues.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(queryValues.Get(name), 10, 64)
+		if err != nil {
+			badRequest("invalid " + name)
+			return
+		}
+		*value = n
+	}
+	if limit == 0 || limit > API_MAX_LIMIT {
+		badRequest("limit must be between 1 and " + strconv.Itoa(API_MAX_LIMIT))
+		return
+	}
+	if (lastOrderedValue == 0) != (lastID == 0) {
+		badRequest("lastOrderedValue and lastID must be supplied together")
+		return
+	}
+	if queryValues.Get("epoch") != "" {
+		var err error
+		if epoch, err = strconv.ParseInt(queryValues.Get("epoch"), 10, 64); err != nil {
+			badRequest("invalid epoch")
+			return
+		}
+	}
+
+	filter, err := parseTorrentFilter(queryValues)
+	if err != nil {
+		badRequest(err.Error())
+		return
+	}
+
+	orderBy := parseOrderBy(queryValues.Get("orderBy"), search)
+	if orderBy == persistence.ByNSeeders || orderBy == persistence.ByNLeechers {
+		badRequest("torrents cannot be ordered by the number of seeders or leechers yet")
+		return
+	}
+
+	torrents, err := database.QueryTorrents(
+		search,
+		parseSearchMode(queryValues),
+		filter,
+		epoch,
+		orderBy,
+		queryValues.Get("ascending") != "",
+		uint(limit),
+		lastOrderedValue,
+		lastID,
+		queryValues.Get("backward") != "",
+	)
+	var queryErr *persistence.QueryError
+	if errors.As(err, &queryErr) {
+		badRequest(queryErr.Error())
+		return
+	}
+	if err != nil {
+		zap.L().Error("Couldn't get torrents from database",
+			zap.Error(err),
+		)
+		writeJSON(w, http.StatusInternalServerError, apiError{"could not get the torrents"})
+		return
+	}
+
+	response := make([]apiTorrent, 0, len(torrents))
+	for _, torrent := range torrents {
+		var matchedFiles []string
+		for _, file := range torrent.MatchedFiles {
+			matchedFiles = append(matchedFiles, file.Path)
+		}
+		response = append(response, apiTorrent{
+			ID:           torrent.ID,
+			InfoHash:     hex.EncodeToString(torrent.InfoHash),
+			Name:         torrent.Name,
+			Size:         torrent.Size,
+			DiscoveredOn: torrent.DiscoveredOn,
+			NFiles:       torrent.NFiles,
+			MatchedFiles: matchedFiles,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Warn("Couldn't write the response", zap.Error(err))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestAPITorrentsHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magneticow")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := persistence.MakeDatabase(&url.URL{Scheme: "sqlite3", Path: path.Join(dir, "database.sqlite3")}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Could not open the database: %s", err.Error())
+	}
+	defer db.Close()
+	database = instrumentedDatabase{db}
+	defer func() { database = nil }()
+
+	for i, torrent := range []struct {
+		name  string
+		files []persistence.File
+	}{
+		{"Ubuntu 18.04", []persistence.File{{Path: "ubuntu-18.04-desktop-amd64.iso", Size: 2000000000}}},
+		{"Ubuntu Tutorial", []persistence.File{{Path: "ubuntu.mkv", Size: 300000000}, {Path: "ubuntu.srt", Size: 1000}}},
+	} {
+		infoHash := make([]byte, 20)
+		infoHash[0] = byte(i + 1)
+		if err = db.AddNewTorrent(infoHash, torrent.name, torrent.files, persistence.InfoMetadata{}); err != nil {
+			t.Fatalf("Could not add the torrent: %s", err.Error())
+		}
+	}
+
+	tests := []struct {
+		query    string
+		status   int
+		expected []string
+	}{
+		{"search=ubuntu&orderBy=size&ascending=true", http.StatusOK, []string{"Ubuntu Tutorial", "Ubuntu 18.04"}},
+		{"search=ubuntu&minSize=1GB", http.StatusOK, []string{"Ubuntu 18.04"}},
+		{"search=ubuntu&category=video", http.StatusOK, []string{"Ubuntu Tutorial"}},
+		{"search=ubuntu+files:>1", http.StatusOK, []string{"Ubuntu Tutorial"}},
+		{"minFiles=2", http.StatusOK, []string{"Ubuntu Tutorial"}},
+		{"search=ubuntu&maxSize=1MB", http.StatusOK, []string{}},
+		{"search=%22ubuntu", http.StatusBadRequest, nil},
+		{"search=ubuntu&category=movies", http.StatusBadRequest, nil},
+		{"limit=1000", http.StatusBadRequest, nil},
+		{"orderBy=seeders", http.StatusBadRequest, nil},
+		{"search=ubuntu&orderBy=leechers", http.StatusBadRequest, nil},
+		{"lastID=5", http.StatusBadRequest, nil},
+		{"lastOrderedValue=5&lastID=a", http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		apiTorrentsHandler(w, httptest.NewRequest("GET", "/api/v0.1/torrents?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("Expected %d for %s, got %d: %s", test.status, test.query, w.Code, w.Body.String())
+			continue
+		}
+		if test.status != http.StatusOK {
+			var response apiError
+			if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Error == "" {
+				t.Errorf("Expected an error message for %s, got %s", test.query, w.Body.String())
+			}
+			continue
+		}
+
+		var torrents []apiTorrent
+		if err = json.Unmarshal(w.Body.Bytes(), &torrents); err != nil {
+			t.Fatalf("Could not decode the response: %s", err.Error())
+		}
+		names := []string{}
+		for _, torrent := range torrents {
+			names = append(names, torrent.Name)
+		}
+		if len(names) != len(test.expected) {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.query, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("Expected %v for %s, got %v", test.expected, test.query, names)
+				break
+			}
+		}
+	}
+}
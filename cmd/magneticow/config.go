@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/izolight/magnetico/pkg/config"
+)
+
+// fileConfig is the (optional) configuration file of magneticow, e.g.
+//
+//	database: postgres://magnetico@localhost/magnetico
+//	search_index: file:///var/lib/magnetico/index
+//	bind: 127.0.0.1:8080
+//	log:
+//	  level: info
+//
+// Only the logging level is reloaded on SIGHUP.
+type fileConfig struct {
+	Database    string `yaml:"database"`
+	SearchIndex string `yaml:"search_index"`
+	Bind        string `yaml:"bind"`
+	Log         struct {
+		Level string `yaml:"level"`
+	} `yaml:"log"`
+}
+
+func loadFileConfig(path string) (*fileConfig, error) {
+	fc := new(fileConfig)
+	if err := config.Load(path, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// logLevel returns the logging level of the configuration file (which might be nil), unless the
+// verbosity is given explicitly.
+func logLevel(opF *opFlags, fc *fileConfig) (zapcore.Level, error) {
+	if fc == nil || fc.Log.Level == "" || opF.explicitVerbosity {
+		return verbosityLevel(opF.Verbosity), nil
+	}
+	return config.ParseLogLevel(fc.Log.Level)
+}
+
+func verbosityLevel(verbosity int) zapcore.Level {
+	switch verbosity {
+	case 0:
+		return zapcore.WarnLevel
+	case 1:
+		return zapcore.InfoLevel
+	default: // Default: i.e. in case of 2 or more.
+		return zapcore.DebugLevel
+	}
+}
+
+// reloadOnHangup reloads the logging level from the configuration file whenever SIGHUP is received.
+// It is a goroutine!
+func reloadOnHangup(opF *opFlags, loggerLevel zap.AtomicLevel) {
+	hangupChan := make(chan os.Signal, 1)
+	signal.Notify(hangupChan, syscall.SIGHUP)
+
+	for range hangupChan {
+		if opF.ConfigPath == "" {
+			zap.L().Warn("SIGHUP received but there is no configuration file to reload.")
+			continue
+		}
+
+		fc, err := loadFileConfig(opF.ConfigPath)
+		if err == nil {
+			var level zapcore.Level
+			if level, err = logLevel(opF, fc); err == nil {
+				loggerLevel.SetLevel(level)
+			}
+		}
+		if err != nil {
+			zap.L().Error("Could not reload the configuration file, keeping the current one!", zap.Error(err))
+			continue
+		}
+		zap.L().Info("Reloaded the configuration file.", zap.String("path", opF.ConfigPath))
+	}
+}
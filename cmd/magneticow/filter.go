@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+// filterParameters are the query parameters of the filters of the torrents, both of the search
+// form and of the API.
+var filterParameters = []string{"minSize", "maxSize", "discoveredFrom", "discoveredTo", "minFiles", "maxFiles", "category"}
+
+// parseTorrentFilter parses the filters of the torrents in the query parameters, where
+//   - minSize and maxSize are sizes such as 700MB or 1.5GiB
+//   - discoveredFrom and discoveredTo are dates (YYYY-MM-DD, in UTC), both inclusive
+//   - minFiles and maxFiles are numbers of files
+//   - category is the name of a persistence.Category
+//
+// any of which can be left out.
+func parseTorrentFilter(values url.Values) (persistence.TorrentFilter, error) {
+	var filter persistence.TorrentFilter
+	var err error
+
+	parseSize := func(name string, size *uint64) {
+		if value := values.Get(name); value != "" && err == nil {
+			if *size, err = humanize.ParseBytes(value); err != nil {
+				err = fmt.Errorf("invalid %s %q (e.g. 700MB or 1.5GiB)", name, value)
+			}
+		}
+	}
+	parseDate := func(name string, unixTime *int64, endOfDay bool) {
+		if value := values.Get(name); value != "" && err == nil {
+			date, parseErr := time.Parse("2006-01-02", value)
+			if parseErr != nil || date.Unix() <= 0 {
+				err = fmt.Errorf("invalid %s %q (e.g. 2026-09-01)", name, value)
+				return
+			}
+			if endOfDay {
+				date = date.AddDate(0, 0, 1).Add(-time.Second)
+			}
+			*unixTime = date.Unix()
+		}
+	}
+	parseCount := func(name string, count *uint) {
+		if value := values.Get(name); value != "" && err == nil {
+			n, parseErr := strconv.ParseUint(value, 10, 32)
+			if parseErr != nil {
+				err = fmt.Errorf("invalid %s %q", name, value)
+				return
+			}
+			*count = uint(n)
+		}
+	}
+
+	parseSize("minSize", &filter.MinSize)
+	parseSize("maxSize", &filter.MaxSize)
+	parseDate("discoveredFrom", &filter.MinDiscoveredOn, false)
+	parseDate("discoveredTo", &filter.MaxDiscoveredOn, true)
+	parseCount("minFiles", &filter.MinNFiles)
+	parseCount("maxFiles", &filter.MaxNFiles)
+	if err != nil {
+		return persistence.TorrentFilter{}, err
+	}
+
+	if filter.Category, err = persistence.ParseCategory(values.Get("category")); err != nil {
+		return persistence.TorrentFilter{}, err
+	}
+
+	return filter, nil
+}
+
+// filterValues returns the (non-empty) query parameters of the filters, so that they are kept
+// while paginating.
+func filterValues(values url.Values) url.Values {
+	filters := make(url.Values)
+	for _, name := range filterParameters {
+		if value := values.Get(name); value != "" {
+			filters.Set(name, value)
+		}
+	}
+	return filters
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestParseTorrentFilter(t *testing.T) {
+	values, err := url.ParseQuery("minSize=700MB&maxSize=1.5GiB&discoveredFrom=2026-09-01&discoveredTo=2026-09-30" +
+		"&minFiles=2&maxFiles=10&category=video&search=ignored")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	filter, err := parseTorrentFilter(values)
+	if err != nil {
+		t.Fatalf("parseTorrentFilter returned an error: %s", err.Error())
+	}
+	expected := persistence.TorrentFilter{
+		MinSize:         700000000,
+		MaxSize:         1610612736,
+		MinDiscoveredOn: time.Date(2026, time.September, 1, 0, 0, 0, 0, time.UTC).Unix(),
+		MaxDiscoveredOn: time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC).Unix() - 1,
+		MinNFiles:       2,
+		MaxNFiles:       10,
+		Category:        persistence.VideoCategory,
+	}
+	if filter != expected {
+		t.Errorf("Expected the filter to be %+v, got %+v", expected, filter)
+	}
+	if filters := filterValues(values); len(filters) != 7 || filters.Get("search") != "" {
+		t.Errorf("Expected the values of the filters only, got %v", filters)
+	}
+
+	if filter, err = parseTorrentFilter(url.Values{}); err != nil || filter != (persistence.TorrentFilter{}) {
+		t.Errorf("Expected no filters, got %+v (%v)", filter, err)
+	}
+
+	for _, query := range []string{"minSize=big", "discoveredTo=2026-13-01", "maxFiles=-1", "category=movies"} {
+		values, _ := url.ParseQuery(query)
+		if _, err = parseTorrentFilter(values); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
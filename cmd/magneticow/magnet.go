@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	// BEP 52 v2 infohashes are multihashes in magnet links, where 0x12 denotes SHA-256 and 0x20 is
+	// the length of the digest.
+	btmhPrefix = "urn:btmh:1220"
+)
+
+// magnetURI returns the magnet link of the torrent, which has a `urn:btih` exact topic for v1
+// torrents, a `urn:btmh` one for v2 torrents, and both of them for hybrid torrents.
+func magnetURI(torrent persistence.TorrentMetadata) template.URL {
+	var xts []string
+	if torrent.HasV1() {
+		xts = append(xts, btihPrefix+hex.EncodeToString(torrent.InfoHash))
+	}
+	if len(torrent.InfoHashV2) != 0 {
+		xts = append(xts, btmhPrefix+hex.EncodeToString(torrent.InfoHashV2))
+	}
+
+	uri := "magnet:?xt=" + strings.Join(xts, "&xt=")
+	uri += "&dn=" + url.QueryEscape(torrent.Name)
+	return template.URL(uri)
+}
+
+// parseInfoHash recognises magnet links and `urn:btih` & `urn:btmh` exact topics (as users might
+// paste them in the search box), and returns the (20 bytes) infohash or the (32 bytes) v2 infohash
+// in them, or nil if there is none.
+func parseInfoHash(s string) []byte {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "magnet:?") {
+		query, err := url.ParseQuery(s[len("magnet:?"):])
+		if err != nil {
+			return nil
+		}
+		for _, xt := range query["xt"] {
+			if infoHash := parseInfoHash(xt); infoHash != nil {
+				return infoHash
+			}
+		}
+		return nil
+	}
+
+	var infoHash []byte
+	var err error
+	switch {
+	case strings.HasPrefix(s, btmhPrefix):
+		infoHash, err = hex.DecodeString(s[len(btmhPrefix):])
+		if len(infoHash) != 32 {
+			return nil
+		}
+
+	case strings.HasPrefix(s, btihPrefix):
+		// BTIH hash can be in HEX or BASE32 encoding.
+		encoded := s[len(btihPrefix):]
+		if len(encoded) == 32 {
+			infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		} else {
+			infoHash, err = hex.DecodeString(encoded)
+		}
+		if len(infoHash) != 20 {
+			return nil
+		}
+
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return nil
+	}
+	return infoHash
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"net"
@@ -9,18 +11,22 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Wessie/appdirs"
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/dustin/go-humanize"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/izolight/magnetico/pkg/config"
 	"github.com/izolight/magnetico/pkg/persistence"
 )
 
@@ -30,7 +36,9 @@ var templates map[string]*template.Template
 var database persistence.Database
 
 type cmdFlags struct {
+	Config      string `short:"c" long:"config" description:"Path of the (YAML) configuration file." env:"CONFIG"`
 	DatabaseURL string `long:"database" description:"URL of the database."`
+	SearchIndex string `long:"search-index" description:"URL (e.g. file:///path/to/index) of the search index to search for the torrents in." env:"SEARCH_INDEX"`
 	BindAddr    string `short:"b" long:"bind" description:"Address that the WebUI should listen on." env:"BIND_ADDR" env-delim:"," default:"0.0.0.0:8080"`
 	Verbose     []bool `short:"v" long:"verbose" description:"Increases verbosity."`
 }
@@ -39,6 +47,16 @@ type opFlags struct {
 	DatabaseURL *url.URL
 	BindAddr    string
 	Verbosity   int
+	LogLevel    zapcore.Level
+
+	// SearchIndexURL is nil if there is no search index.
+	SearchIndexURL *url.URL
+
+	// ConfigPath is the path of the configuration file, or empty if there is none.
+	ConfigPath string
+	// explicitVerbosity is true if the verbosity is given explicitly, and hence takes precedence
+	// over the configuration file even when it is reloaded.
+	explicitVerbosity bool
 }
 
 // ========= TD: TemplateData =========
@@ -49,6 +67,10 @@ type HomepageTD struct {
 
 type TorrentsTD struct {
 	Search            string
+	SearchFiles       bool
+	Filters           url.Values
+	Categories        []persistence.Category
+	Error             string // the error of the search query, if it is malformed
 	SubscriptionURL   string
 	Torrents          []persistence.TorrentMetadata
 	Epoch             int64
@@ -65,8 +87,10 @@ type TorrentsTD struct {
 }
 
 type TorrentTD struct {
-	Torrent persistence.TorrentMetadata
-	Files   []persistence.File
+	Torrent   persistence.TorrentMetadata
+	Files     []persistence.File
+	Readme    *persistence.Readme
+	MediaInfo *persistence.MediaInfo
 }
 
 type FeedTD struct {
@@ -75,6 +99,20 @@ type FeedTD struct {
 type StatisticsTD struct {
 	Stats persistence.Statistics
 	Dates []string
+
+	// Peer statistics, each ordered by the number of peers in descending order.
+	Clients       []PeerCountTD
+	Versions      []PeerCountTD
+	Extensions    []PeerCountTD
+	RequestQueues []PeerCountTD
+	YourIPs       []PeerCountTD
+}
+
+type PeerCountTD struct {
+	Name  string
+	Count uint64
+	// Percentage is of all the peers in the same category.
+	Percentage float64
 }
 
 func main() {
@@ -97,25 +135,23 @@ func main() {
 	zap.L().Info("Copyright (C) 2017  Mert Bora ALPER <bora@boramalper.org>.")
 	zap.L().Info("Dedicated to Cemile Binay, in whose hands I thrived.")
 
-	switch opFlags.Verbosity {
-	case 0:
-		loggerLevel.SetLevel(zap.WarnLevel)
-	case 1:
-		loggerLevel.SetLevel(zap.InfoLevel)
-	default: // Default: i.e. in case of 2 or more.
-		// TODO: print the caller (function)'s name and line number!
-		loggerLevel.SetLevel(zap.DebugLevel)
-	}
+	loggerLevel.SetLevel(opFlags.LogLevel)
+	go reloadOnHangup(opFlags, loggerLevel)
 
 	zap.ReplaceGlobals(logger)
 
 	router := mux.NewRouter()
-	router.HandleFunc("/", rootHandler)
-	router.HandleFunc("/torrents", torrentsHandler)
-	router.HandleFunc("/torrents/{infohash:[a-z0-9]{40}}", torrentsInfohashHandler)
-	router.HandleFunc("/statistics", statisticsHandler)
-	router.HandleFunc("/feed", feedHandler)
-	router.PathPrefix("/static").HandlerFunc(staticHandler)
+	router.HandleFunc("/", instrument("/", rootHandler))
+	router.HandleFunc("/torrents", instrument("/torrents", torrentsHandler))
+	router.HandleFunc("/torrents/{infohash:[a-z0-9]{40}}", instrument("/torrents/{infohash}", torrentsInfohashHandler))
+	router.HandleFunc("/torrents/{infohash:[a-z0-9]{40}}.torrent", instrument("/torrents/{infohash}.torrent", torrentFileHandler))
+	router.HandleFunc("/api/v0.1/torrents", instrument("/api/v0.1/torrents", apiTorrentsHandler))
+	router.HandleFunc("/statistics", instrument("/statistics", statisticsHandler))
+	router.HandleFunc("/feed", instrument("/feed", feedHandler))
+	router.PathPrefix("/static").HandlerFunc(instrument("/static", staticHandler))
+	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/healthz", healthzHandler)
+	router.HandleFunc("/readyz", readyzHandler)
 
 	templateFunctions := template.FuncMap{
 		"add": func(augend int, addends int) int {
@@ -145,6 +181,12 @@ func main() {
 		"humanizeSize": func(s uint64) string {
 			return humanize.IBytes(s)
 		},
+
+		"secondsToDuration": func(s float64) string {
+			return (time.Duration(s) * time.Second).String()
+		},
+
+		"magnetURI": magnetURI,
 	}
 
 	templates = make(map[string]*template.Template)
@@ -154,10 +196,18 @@ func main() {
 	templates["torrent"] = template.Must(template.New("torrent").Funcs(templateFunctions).Parse(string(mustAsset("templates/torrent.html"))))
 	templates["torrents"] = template.Must(template.New("torrents").Funcs(templateFunctions).Parse(string(mustAsset("templates/torrents.html"))))
 
-	database, err = persistence.MakeDatabase(opFlags.DatabaseURL, logger)
+	db, err := persistence.MakeDatabase(opFlags.DatabaseURL, logger)
 	if err != nil {
 		panic(err.Error())
 	}
+	if opFlags.SearchIndexURL != nil {
+		index, err := persistence.MakeSearchIndex(opFlags.SearchIndexURL)
+		if err != nil {
+			panic(err.Error())
+		}
+		db = persistence.WithSearchIndex(db, index)
+	}
+	database = instrumentedDatabase{db}
 
 	zap.L().Info("magneticow is ready to serve!")
 
@@ -194,8 +244,27 @@ func torrentsHandler(w http.ResponseWriter, r *http.Request) {
 	queryValues := r.URL.Query()
 
 	search := queryValues.Get("search")
+	// If the user is searching for a magnet link (or an infohash thereof), take them to the
+	// torrent right away if we have it.
+	if infoHash := parseInfoHash(search); infoHash != nil {
+		torrent, err := database.GetTorrent(infoHash)
+		if err != nil {
+			zap.L().Error("Couldn't get torrent from database",
+				zap.Error(err),
+				zap.String("infohash", hex.EncodeToString(infoHash)),
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if torrent != nil {
+			http.Redirect(w, r, "/torrents/"+hex.EncodeToString(torrent.InfoHash), http.StatusSeeOther)
+			return
+		}
+	}
+	mode := parseSearchMode(queryValues)
 	epoch := time.Now()
-	orderBy := persistence.ByRelevance
+	qOrderBy := queryValues.Get("orderBy")
+	orderBy := parseOrderBy(qOrderBy, search)
 	ascending := false
 	backward := false
 	limit := uint(N_TORRENTS)
@@ -205,24 +274,6 @@ func torrentsHandler(w http.ResponseWriter, r *http.Request) {
 
 	var err error
 
-	qOrderBy := queryValues.Get("orderBy")
-	switch qOrderBy {
-	case "size":
-		orderBy = persistence.BySize
-	case "discovered":
-		orderBy = persistence.ByDiscoveredOn
-	case "files":
-		orderBy = persistence.ByNFiles
-	case "seeders":
-		orderBy = persistence.ByNSeeders
-	case "leechers":
-		orderBy = persistence.ByNLeechers
-	default:
-		if search == "" {
-			orderBy = persistence.ByDiscoveredOn
-		}
-	}
-
 	if queryValues.Get("ascending") != "" {
 		ascending = true
 	}
@@ -277,12 +328,42 @@ func torrentsHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("when specifying epoch, need to supply lastOrderedValue and lastID as well"))
+			return
 		}
 	}
 
+	// The malformed queries and filters are shown to the user along with the search form.
+	badRequest := func(message string) {
+		w.WriteHeader(http.StatusBadRequest)
+		templates["torrents"].Execute(w, TorrentsTD{
+			Search:      search,
+			SearchFiles: mode == persistence.SearchFiles,
+			Filters:     filterValues(queryValues),
+			Categories:  persistence.Categories,
+			Error:       message,
+			Epoch:       epoch.Unix(),
+			OrderBy:     qOrderBy,
+			Ascending:   ascending,
+			Limit:       limit,
+			IsFirstPage: true,
+		})
+	}
+
+	filter, err := parseTorrentFilter(queryValues)
+	if err != nil {
+		badRequest(err.Error())
+		return
+	}
+	if orderBy == persistence.ByNSeeders || orderBy == persistence.ByNLeechers {
+		badRequest("torrents cannot be ordered by the number of seeders or leechers yet")
+		return
+	}
+
 	var torrents []persistence.TorrentMetadata
 	torrents, err = database.QueryTorrents(
 		search,
+		mode,
+		filter,
 		epoch.Unix(),
 		orderBy,
 		ascending,
@@ -291,6 +372,11 @@ func torrentsHandler(w http.ResponseWriter, r *http.Request) {
 		lastID,
 		backward,
 	)
+	var queryErr *persistence.QueryError
+	if errors.As(err, &queryErr) {
+		badRequest(queryErr.Error())
+		return
+	}
 	if err != nil {
 		zap.L().Error("Couldn't get torrents from database",
 			zap.Error(err),
@@ -320,6 +406,9 @@ func torrentsHandler(w http.ResponseWriter, r *http.Request) {
 
 	templates["torrents"].Execute(w, TorrentsTD{
 		Search:            search,
+		SearchFiles:       mode == persistence.SearchFiles,
+		Filters:           filterValues(queryValues),
+		Categories:        persistence.Categories,
 		SubscriptionURL:   "borabora",
 		Torrents:          torrents,
 		Epoch:             epoch.Unix(),
@@ -337,6 +426,38 @@ func torrentsHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// parseSearchMode returns the SearchMode of the query parameters, where the paths of the files are
+// searched too if in=files (and the files that match are listed).
+func parseSearchMode(values url.Values) persistence.SearchMode {
+	if values.Get("in") == "files" {
+		return persistence.SearchFiles
+	}
+	return persistence.SearchNames
+}
+
+// parseOrderBy returns the ordering of the torrents given by the orderBy query parameter, which is
+// by relevance by default unless there are no words to search for (e.g. if there are filters
+// only), in which case it is by the date of discovery.
+func parseOrderBy(qOrderBy string, search string) persistence.OrderingCriteria {
+	switch qOrderBy {
+	case "size":
+		return persistence.BySize
+	case "discovered":
+		return persistence.ByDiscoveredOn
+	case "files":
+		return persistence.ByNFiles
+	case "seeders":
+		return persistence.ByNSeeders
+	case "leechers":
+		return persistence.ByNLeechers
+	default:
+		if q, err := persistence.ParseSearchQuery(search); err != nil || len(q.Terms) == 0 {
+			return persistence.ByDiscoveredOn
+		}
+		return persistence.ByRelevance
+	}
+}
+
 func torrentsInfohashHandler(w http.ResponseWriter, r *http.Request) {
 	// show torrents/{infohash}
 	infoHash, err := hex.DecodeString(mux.Vars(r)["infohash"])
@@ -373,12 +494,77 @@ func torrentsInfohashHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	readme, err := database.GetReadme(torrent.InfoHash)
+	if err != nil {
+		zap.L().Error("Couldn't get readme from database",
+			zap.Error(err),
+			zap.String("infohash", string(infoHash)),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	mediaInfo, err := database.GetMediaInfo(torrent.InfoHash)
+	if err != nil {
+		zap.L().Error("Couldn't get media info from database",
+			zap.Error(err),
+			zap.String("infohash", string(infoHash)),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	templates["torrent"].Execute(w, TorrentTD{
-		Torrent: *torrent,
-		Files:   files,
+		Torrent:   *torrent,
+		Files:     files,
+		Readme:    readme,
+		MediaInfo: mediaInfo,
 	})
 }
 
+func torrentFileHandler(w http.ResponseWriter, r *http.Request) {
+	// serve torrents/{infohash}.torrent
+	infoHash, err := hex.DecodeString(mux.Vars(r)["infohash"])
+	if err != nil {
+		zap.L().Error("Couldn't decode infohash",
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	info, err := database.GetInfoDictionary(infoHash)
+	if err != nil {
+		zap.L().Error("Couldn't get info dictionary from database",
+			zap.Error(err),
+			zap.String("infohash", hex.EncodeToString(infoHash)),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if info == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// We do not know any trackers of the torrent (that's the whole point!), so the reconstructed
+	// .torrent file consists of the info dictionary only; clients will find peers through DHT.
+	mi := metainfo.MetaInfo{
+		InfoBytes: info,
+		CreatedBy: "magnetico",
+	}
+
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%x.torrent"`, infoHash))
+	if err = mi.Write(w); err != nil {
+		zap.L().Error("Couldn't write .torrent file",
+			zap.Error(err),
+			zap.String("infohash", hex.EncodeToString(infoHash)),
+		)
+	}
+}
+
 func statisticsHandler(w http.ResponseWriter, r *http.Request) {
 	interval, err := time.ParseDuration("24h")
 	if err != nil {
@@ -405,10 +591,53 @@ func statisticsHandler(w http.ResponseWriter, r *http.Request) {
 		from = from.Add(interval)
 		dates = append(dates, from.Format("2006-01-02"))
 	}
+	peerStats, err := database.GetPeerStatistics()
+	if err != nil {
+		zap.L().Error("Couldn't get peer statistics from database",
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	templates["statistics"].Execute(w, StatisticsTD{
-		Stats: *stats,
-		Dates: dates,
+		Stats:         *stats,
+		Dates:         dates,
+		Clients:       topPeerCounts(peerStats.Clients, N_TOP_PEER_COUNTS),
+		Versions:      topPeerCounts(peerStats.Versions, N_TOP_PEER_COUNTS),
+		Extensions:    topPeerCounts(peerStats.Extensions, N_TOP_PEER_COUNTS),
+		RequestQueues: topPeerCounts(peerStats.RequestQueues, N_TOP_PEER_COUNTS),
+		YourIPs:       topPeerCounts(peerStats.YourIPs, N_TOP_PEER_COUNTS),
+	})
+}
+
+// N_TOP_PEER_COUNTS is the number of the most common clients, versions... shown on the statistics
+// page.
+const N_TOP_PEER_COUNTS = 20
+
+// topPeerCounts returns the n biggest counts, in descending order.
+func topPeerCounts(counts map[string]uint64, n int) []PeerCountTD {
+	var total uint64
+	var peerCounts []PeerCountTD
+	for name, count := range counts {
+		total += count
+		peerCounts = append(peerCounts, PeerCountTD{Name: name, Count: count})
+	}
+
+	sort.Slice(peerCounts, func(i, j int) bool {
+		if peerCounts[i].Count != peerCounts[j].Count {
+			return peerCounts[i].Count > peerCounts[j].Count
+		}
+		return peerCounts[i].Name < peerCounts[j].Name
 	})
+	if len(peerCounts) > n {
+		peerCounts = peerCounts[:n]
+	}
+	for i := range peerCounts {
+		peerCounts[i].Percentage = 100 * float64(peerCounts[i].Count) / float64(total)
+	}
+
+	return peerCounts
 }
 
 func feedHandler(w http.ResponseWriter, r *http.Request) {
@@ -445,11 +674,30 @@ func parseFlags() (*opFlags, error) {
 	opF := new(opFlags)
 	cmdF := new(cmdFlags)
 
-	_, err := flags.Parse(cmdF)
+	parser := flags.NewParser(cmdF, flags.Default)
+	_, err := parser.Parse()
 	if err != nil {
 		return nil, err
 	}
 
+	var fc *fileConfig
+	if cmdF.Config != "" {
+		fc, err = loadFileConfig(cmdF.Config)
+		if err != nil {
+			zap.L().Fatal("Failed to load the configuration file", zap.Error(err))
+		}
+		if fc.Database != "" && !config.IsExplicit(parser, "database") {
+			cmdF.DatabaseURL = fc.Database
+		}
+		if fc.Bind != "" && !config.IsExplicit(parser, "bind") {
+			cmdF.BindAddr = fc.Bind
+		}
+		if fc.SearchIndex != "" && !config.IsExplicit(parser, "search-index") {
+			cmdF.SearchIndex = fc.SearchIndex
+		}
+	}
+	opF.ConfigPath = cmdF.Config
+
 	if cmdF.DatabaseURL == "" {
 		cmdF.DatabaseURL = "sqlite3://" + path.Join(
 			appdirs.UserDataDir("magneticod", "", "", false),
@@ -460,6 +708,12 @@ func parseFlags() (*opFlags, error) {
 	if err != nil {
 		zap.L().Fatal("Failed to parse DB URL", zap.Error(err))
 	}
+	if cmdF.SearchIndex != "" {
+		opF.SearchIndexURL, err = url.Parse(cmdF.SearchIndex)
+		if err != nil {
+			zap.L().Fatal("Failed to parse search index URL", zap.Error(err))
+		}
+	}
 
 	_, err = net.ResolveTCPAddr("tcp", cmdF.BindAddr)
 	if err != nil {
@@ -468,6 +722,11 @@ func parseFlags() (*opFlags, error) {
 	opF.BindAddr = cmdF.BindAddr
 
 	opF.Verbosity = len(cmdF.Verbose)
+	opF.explicitVerbosity = config.IsExplicit(parser, "verbose")
+	opF.LogLevel, err = logLevel(opF, fc)
+	if err != nil {
+		zap.L().Fatal("Invalid configuration file", zap.Error(err))
+	}
 
 	return opF, nil
 }
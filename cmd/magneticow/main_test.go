@@ -0,0 +1,28 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTorrentsHandler_UnpairedPagination(t *testing.T) {
+	// The page is not to be rendered at all, so a stand-in template will do.
+	templates = map[string]*template.Template{
+		"torrents": template.Must(template.New("torrents").Parse("torrents page")),
+	}
+	defer func() { templates = nil }()
+
+	for _, query := range []string{"epoch=1000&lastID=5", "epoch=1000&lastOrderedValue=5"} {
+		w := httptest.NewRecorder()
+		torrentsHandler(w, httptest.NewRequest("GET", "/torrents?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %d for %s, got %d", http.StatusBadRequest, query, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "torrents page") {
+			t.Errorf("Expected the page not to be rendered for %s, got %s", query, w.Body.String())
+		}
+	}
+}
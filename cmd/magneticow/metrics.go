@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "magneticow",
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests served, by route and status code.",
+		},
+		[]string{"route", "code"},
+	)
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "magneticow",
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time it takes to serve HTTP requests, by route.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+	queryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "magneticow",
+			Subsystem: "database",
+			Name:      "query_duration_seconds",
+			Help:      "Time it takes to query the database, by query.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"query"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, queryDuration)
+}
+
+// statusRecorder records the status code written to the underlying http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// instrument counts and times the requests served by the handler, labelling them by @route (i.e.
+// the route template rather than the actual path, so that the cardinality of the metrics stays
+// bounded).
+func instrument(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(sr, r)
+		requestDuration.WithLabelValues(route).Observe(time.Since(started).Seconds())
+		requestsTotal.WithLabelValues(route, strconv.Itoa(sr.status)).Inc()
+	}
+}
+
+// instrumentedDatabase times the queries that magneticow makes to the underlying database.
+type instrumentedDatabase struct {
+	persistence.Database
+}
+
+func observeQuery(query string, started time.Time) {
+	queryDuration.WithLabelValues(query).Observe(time.Since(started).Seconds())
+}
+
+func (db instrumentedDatabase) GetNumberOfTorrents() (uint, error) {
+	defer observeQuery("get_number_of_torrents", time.Now())
+	return db.Database.GetNumberOfTorrents()
+}
+
+func (db instrumentedDatabase) GetTotalSizeOfTorrents() (uint64, error) {
+	defer observeQuery("get_total_size_of_torrents", time.Now())
+	return db.Database.GetTotalSizeOfTorrents()
+}
+
+func (db instrumentedDatabase) QueryTorrents(
+	query string,
+	mode persistence.SearchMode,
+	filter persistence.TorrentFilter,
+	epoch int64,
+	orderBy persistence.OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue uint64,
+	lastID uint64,
+	backward bool,
+) ([]persistence.TorrentMetadata, error) {
+	defer observeQuery("query_torrents", time.Now())
+	return db.Database.QueryTorrents(query, mode, filter, epoch, orderBy, ascending, limit, lastOrderedValue, lastID, backward)
+}
+
+func (db instrumentedDatabase) GetTorrent(infoHash []byte) (*persistence.TorrentMetadata, error) {
+	defer observeQuery("get_torrent", time.Now())
+	return db.Database.GetTorrent(infoHash)
+}
+
+func (db instrumentedDatabase) GetFiles(infoHash []byte) ([]persistence.File, error) {
+	defer observeQuery("get_files", time.Now())
+	return db.Database.GetFiles(infoHash)
+}
+
+func (db instrumentedDatabase) GetInfoDictionary(infoHash []byte) ([]byte, error) {
+	defer observeQuery("get_info_dictionary", time.Now())
+	return db.Database.GetInfoDictionary(infoHash)
+}
+
+func (db instrumentedDatabase) GetReadme(infoHash []byte) (*persistence.Readme, error) {
+	defer observeQuery("get_readme", time.Now())
+	return db.Database.GetReadme(infoHash)
+}
+
+func (db instrumentedDatabase) GetMediaInfo(infoHash []byte) (*persistence.MediaInfo, error) {
+	defer observeQuery("get_media_info", time.Now())
+	return db.Database.GetMediaInfo(infoHash)
+}
+
+func (db instrumentedDatabase) GetStatistics(n uint, from string) (*persistence.Statistics, error) {
+	defer observeQuery("get_statistics", time.Now())
+	return db.Database.GetStatistics(n, from)
+}
+
+func (db instrumentedDatabase) GetPeerStatistics() (*persistence.PeerStatistics, error) {
+	defer observeQuery("get_peer_statistics", time.Now())
+	return db.Database.GetPeerStatistics()
+}
+
+func (db instrumentedDatabase) Ping() error {
+	defer observeQuery("ping", time.Now())
+	return db.Database.Ping()
+}
+
+// healthzHandler reports whether magneticow is alive, i.e. whether it can reach the database.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := database.Ping(); err != nil {
+		zap.L().Warn("Health check failed, the database is unreachable!", zap.Error(err))
+		http.Error(w, "database unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether magneticow is ready to serve, i.e. whether it can not only reach
+// but also query the database (with the cheap lookup of a torrent that does not exist).
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := database.Ping(); err != nil {
+		zap.L().Warn("Readiness check failed, the database is unreachable!", zap.Error(err))
+		http.Error(w, "database unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := database.GetTorrent(make([]byte, metainfo.HashSize)); err != nil {
+		zap.L().Warn("Readiness check failed, the database cannot be queried!", zap.Error(err))
+		http.Error(w, "database cannot be queried", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
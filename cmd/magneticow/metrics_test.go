@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	"github.com/izolight/magnetico/pkg/persistence"
+)
+
+func TestInstrument(t *testing.T) {
+	handler := instrument("/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/test?fail=1", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/test?fail=1", nil))
+
+	if n := testutil.ToFloat64(requestsTotal.WithLabelValues("/test", "200")); n != 1 {
+		t.Errorf("Expected 1 successful request, got %v", n)
+	}
+	if n := testutil.ToFloat64(requestsTotal.WithLabelValues("/test", "500")); n != 2 {
+		t.Errorf("Expected 2 failed requests, got %v", n)
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magneticow")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := persistence.MakeDatabase(&url.URL{Scheme: "sqlite3", Path: path.Join(dir, "database.sqlite3")}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Could not open the database: %s", err.Error())
+	}
+	database = instrumentedDatabase{db}
+	defer func() { database = nil }()
+
+	for _, handler := range []http.HandlerFunc{healthzHandler, readyzHandler} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected the database to be healthy, got %d", w.Code)
+		}
+	}
+
+	db.Close()
+	for _, handler := range []http.HandlerFunc{healthzHandler, readyzHandler} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected the closed database to be unhealthy, got %d", w.Code)
+		}
+	}
+}
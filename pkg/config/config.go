@@ -0,0 +1,76 @@
+// Package config loads the optional configuration files of magneticod and magneticow. The settings
+// in a configuration file apply unless they are given explicitly, i.e. on the command line or
+// through the environment.
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// Load decodes the YAML configuration file at @path into @v. Unknown settings are rejected, so that
+// typos do not go unnoticed.
+func Load(path string, v interface{}) error {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yml", ".yaml":
+	default:
+		return fmt.Errorf("unsupported configuration file format `%s` (only YAML is supported)", ext)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open the configuration file: %s", err.Error())
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	// An empty file is a valid (albeit useless) configuration file.
+	if err = decoder.Decode(v); err != nil && err != io.EOF {
+		return fmt.Errorf("could not parse the configuration file `%s`: %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// IsExplicit reports whether the option of the given long name is given on the command line or
+// through the environment, as opposed to being left as its default.
+func IsExplicit(parser *flags.Parser, longName string) bool {
+	option := parser.FindOptionByLongName(longName)
+	if option == nil || !option.IsSet() {
+		return false
+	}
+	// go-flags considers the values from the environment as defaults too.
+	if !option.IsSetDefault() {
+		return true
+	}
+	envKey := option.EnvKeyWithNamespace()
+	if envKey == "" {
+		return false
+	}
+	_, exists := os.LookupEnv(envKey)
+	return exists
+}
+
+// ParseLogLevel parses the logging level, which is one of "debug", "info", "warn", or "error".
+func ParseLogLevel(level string) (zapcore.Level, error) {
+	switch level {
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "info":
+		return zapcore.InfoLevel, nil
+	case "warn":
+		return zapcore.WarnLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	default:
+		return zapcore.InfoLevel, fmt.Errorf("unknown logging level `%s`", level)
+	}
+}
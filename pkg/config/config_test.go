@@ -0,0 +1,71 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnetico")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var v struct {
+		Database string   `yaml:"database"`
+		Bind     []string `yaml:"bind"`
+	}
+
+	valid := path.Join(dir, "valid.yml")
+	if err = ioutil.WriteFile(valid, []byte("database: sqlite3:///tmp/db\nbind: [\"0.0.0.0:6881\"]\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = Load(valid, &v); err != nil {
+		t.Fatalf("Could not load the configuration file: %s", err.Error())
+	}
+	if v.Database != "sqlite3:///tmp/db" || len(v.Bind) != 1 {
+		t.Errorf("Unexpected configuration %+v", v)
+	}
+
+	unknown := path.Join(dir, "unknown.yaml")
+	if err = ioutil.WriteFile(unknown, []byte("databse: sqlite3:///tmp/db\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = Load(unknown, &v); err == nil {
+		t.Error("Expected an error for the unknown setting")
+	}
+
+	if err = Load(path.Join(dir, "config.toml"), &v); err == nil {
+		t.Error("Expected an error for the unsupported format")
+	}
+}
+
+func TestIsExplicit(t *testing.T) {
+	var opts struct {
+		A uint `long:"a" env:"MAGNETICO_TEST_A" default:"1"`
+		B uint `long:"b" env:"MAGNETICO_TEST_B" default:"1"`
+		C uint `long:"c" env:"MAGNETICO_TEST_C" default:"1"`
+	}
+	os.Setenv("MAGNETICO_TEST_B", "2")
+	defer os.Unsetenv("MAGNETICO_TEST_B")
+
+	parser := flags.NewParser(&opts, flags.Default)
+	if _, err := parser.ParseArgs([]string{"--a", "2"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !IsExplicit(parser, "a") {
+		t.Error("Expected the option given on the command line to be explicit")
+	}
+	if !IsExplicit(parser, "b") {
+		t.Error("Expected the option given through the environment to be explicit")
+	}
+	if IsExplicit(parser, "c") {
+		t.Error("Expected the default option not to be explicit")
+	}
+}
@@ -0,0 +1,33 @@
+package persistence
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+)
+
+// compress is used to shrink the (mostly textual) blobs such as raw info dictionaries before they
+// are written to the database.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
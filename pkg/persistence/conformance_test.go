@@ -0,0 +1,869 @@
+package persistence
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The conformance tests verify that all the Database implementations behave identically. They are
+// run against SQLite (with and without a search index) always, and against the other engines only
+// if the URL of a database dedicated to testing is given in the environment, e.g.
+//
+//	MAGNETICO_TEST_POSTGRES_URL=postgresql://magnetico@localhost/magnetico_test?sslmode=disable
+//	MAGNETICO_TEST_MYSQL_URL=mysql://magnetico@localhost/magnetico_test
+//
+// BEWARE that the test databases are wiped before each test!
+
+type testBackend struct {
+	name string
+	// open returns an empty database, and a function to close it.
+	open func(t *testing.T) (Database, func())
+}
+
+func testBackends() []testBackend {
+	backends := []testBackend{{"sqlite3", openSqlite3TestDatabase}, {"sqlite3+embedded", openIndexedTestDatabase}}
+	if rawURL := os.Getenv("MAGNETICO_TEST_POSTGRES_URL"); rawURL != "" {
+		backends = append(backends, testBackend{"postgres", func(t *testing.T) (Database, func()) {
+			return openPostgresTestDatabase(t, rawURL)
+		}})
+	}
+	if rawURL := os.Getenv("MAGNETICO_TEST_MYSQL_URL"); rawURL != "" {
+		backends = append(backends, testBackend{"mysql", func(t *testing.T) (Database, func()) {
+			return openMySQLTestDatabase(t, rawURL)
+		}})
+	}
+	return backends
+}
+
+func openSqlite3TestDatabase(t *testing.T) (Database, func()) {
+	dir, err := ioutil.TempDir("", "magnetico")
+	checkErr(err, t)
+
+	db, err := MakeDatabase(&url.URL{Scheme: "sqlite3", Path: path.Join(dir, "database.sqlite3")}, zap.NewNop())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// openIndexedTestDatabase returns an SQLite database with an embedded search index.
+func openIndexedTestDatabase(t *testing.T) (Database, func()) {
+	db, closeDB := openSqlite3TestDatabase(t)
+
+	dir, err := ioutil.TempDir("", "magnetico")
+	checkErr(err, t)
+	index, err := MakeSearchIndex(&url.URL{Scheme: "file", Path: path.Join(dir, "index")})
+	if err != nil {
+		closeDB()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return WithSearchIndex(db, index), func() {
+		index.Close()
+		closeDB()
+		os.RemoveAll(dir)
+	}
+}
+
+func openPostgresTestDatabase(t *testing.T, rawURL string) (Database, func()) {
+	dbURL, err := url.Parse(rawURL)
+	checkErr(err, t)
+
+	conn, err := sql.Open("postgres", rawURL)
+	checkErr(err, t)
+	_, err = conn.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public;")
+	conn.Close()
+	if err != nil {
+		t.Fatalf("could not wipe the test database: %s", err.Error())
+	}
+
+	db, err := MakeDatabase(dbURL, zap.NewNop())
+	checkErr(err, t)
+
+	return db, func() {
+		db.Close()
+	}
+}
+
+func openMySQLTestDatabase(t *testing.T, rawURL string) (Database, func()) {
+	dbURL, err := url.Parse(rawURL)
+	checkErr(err, t)
+	dsn, err := mysqlDSN(dbURL)
+	checkErr(err, t)
+
+	conn, err := sql.Open("mysql", dsn)
+	checkErr(err, t)
+	defer conn.Close()
+	for _, table := range []string{"info_dictionaries", "media_info", "files", "torrents", "statistics",
+		"peer_statistics", "pending_infohashes", "settings"} {
+		if _, err = conn.Exec("DROP TABLE IF EXISTS " + table + ";"); err != nil {
+			t.Fatalf("could not wipe the test database: %s", err.Error())
+		}
+	}
+
+	db, err := MakeDatabase(dbURL, zap.NewNop())
+	checkErr(err, t)
+
+	return db, func() {
+		db.Close()
+	}
+}
+
+var conformanceTests = []struct {
+	name string
+	test func(t *testing.T, db Database)
+}{
+	{"AddNewTorrent", testAddNewTorrent},
+	{"AddNewTorrents", testAddNewTorrents},
+	{"EmptyDatabase", testEmptyDatabase},
+	{"GetTorrentByInfoHashV2", testGetTorrentByInfoHashV2},
+	{"IterateInfoHashes", testIterateInfoHashes},
+	{"InfoDictionary", testInfoDictionary},
+	{"Readme", testReadme},
+	{"MediaInfo", testMediaInfo},
+	{"PeerStatistics", testPeerStatistics},
+	{"PendingInfoHashes", testPendingInfoHashes},
+	{"AddAnnounces", testAddAnnounces},
+	{"QueryTorrents", testQueryTorrents},
+	{"QueryTorrents_Pagination", testQueryTorrentsPagination},
+	{"QueryTorrents_Search", testQueryTorrentsSearch},
+	{"QueryTorrents_SearchFiles", testQueryTorrentsSearchFiles},
+	{"QueryTorrents_Syntax", testQueryTorrentsSyntax},
+	{"QueryTorrents_Filter", testQueryTorrentsFilter},
+	{"GetStatistics", testGetStatistics},
+}
+
+func TestDatabaseConformance(t *testing.T) {
+	for _, backend := range testBackends() {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			for _, ct := range conformanceTests {
+				ct := ct
+				t.Run(ct.name, func(t *testing.T) {
+					db, cleanUp := backend.open(t)
+					defer cleanUp()
+					ct.test(t, db)
+				})
+			}
+		})
+	}
+}
+
+// conformanceInfoHash returns a distinct (20 bytes) infohash for each i.
+func conformanceInfoHash(i int) []byte {
+	infoHash := make([]byte, 20)
+	copy(infoHash, fmt.Sprintf("%08d", i))
+	return infoHash
+}
+
+// addTestTorrent adds a torrent of the given name whose files are of the given sizes, and returns
+// its infohash.
+func addTestTorrent(t *testing.T, db Database, i int, name string, sizes ...uint64) []byte {
+	var files []File
+	for j, size := range sizes {
+		files = append(files, File{Path: name + "/" + strconv.Itoa(j), Size: size})
+	}
+	checkErr(db.AddNewTorrent(conformanceInfoHash(i), name, files, InfoMetadata{}), t)
+	return conformanceInfoHash(i)
+}
+
+func testAddNewTorrent(t *testing.T, db Database) {
+	infoHash := conformanceInfoHash(1)
+	before := time.Now().Unix()
+	checkErr(db.AddNewTorrent(infoHash, "torrent", []File{
+		{Path: "torrent/a.mkv", Size: 100, Attributes: "x"},
+		{Path: "torrent/.pad/28", Size: 28, Attributes: "p"},
+		{Path: "torrent/b.txt", Size: 20},
+		{Path: "torrent/c", Size: 0, Attributes: "l", SymlinkPath: "torrent/b.txt"},
+	}, InfoMetadata{PieceLength: 64, NPieces: 3, Private: true, Source: "tracker"}), t)
+	after := time.Now().Unix()
+
+	exists, err := db.DoesTorrentExist(infoHash)
+	checkErr(err, t)
+	if !exists {
+		t.Fatal("expected the torrent to exist")
+	}
+	exists, err = db.DoesTorrentExist(conformanceInfoHash(2))
+	checkErr(err, t)
+	if exists {
+		t.Fatal("expected the other torrent not to exist")
+	}
+
+	torrent, err := db.GetTorrent(infoHash)
+	checkErr(err, t)
+	if torrent == nil {
+		t.Fatal("expected the torrent to be found")
+	}
+	if !bytes.Equal(torrent.InfoHash, infoHash) || torrent.Name != "torrent" || torrent.ID == 0 {
+		t.Errorf("torrent mismatch. Got: %+v", torrent)
+	}
+	// The padding file is neither counted towards the size nor the number of files.
+	if torrent.Size != 120 || torrent.NFiles != 3 {
+		t.Errorf("expected 3 files of 120 bytes in total, got %d files of %d bytes", torrent.NFiles, torrent.Size)
+	}
+	if torrent.PieceLength != 64 || torrent.NPieces != 3 || !torrent.Private || torrent.Source != "tracker" {
+		t.Errorf("info metadata mismatch. Got: %+v", torrent.InfoMetadata)
+	}
+	if torrent.DiscoveredOn < before || torrent.DiscoveredOn > after {
+		t.Errorf("expected the torrent to be discovered on between %d and %d, got %d", before, after,
+			torrent.DiscoveredOn)
+	}
+	if torrent.LastSeenOn != 0 || torrent.NAnnounces != 0 {
+		t.Errorf("expected the torrent not to be announced yet. Got: %+v", torrent)
+	}
+
+	files, err := db.GetFiles(infoHash)
+	checkErr(err, t)
+	if len(files) != 4 {
+		t.Fatalf("expected 4 files, got %d", len(files))
+	}
+	if files[0] != (File{Path: "torrent/a.mkv", Size: 100, Attributes: "x"}) || !files[1].IsPadding() ||
+		files[3].SymlinkPath != "torrent/b.txt" {
+		t.Errorf("files mismatch. Got: %+v", files)
+	}
+
+	torrent, err = db.GetTorrent(conformanceInfoHash(2))
+	checkErr(err, t)
+	if torrent != nil {
+		t.Errorf("expected no torrent, got %+v", torrent)
+	}
+	files, err = db.GetFiles(conformanceInfoHash(2))
+	checkErr(err, t)
+	if len(files) != 0 {
+		t.Errorf("expected no files, got %+v", files)
+	}
+}
+
+func testAddNewTorrents(t *testing.T, db Database) {
+	existing := addTestTorrent(t, db, 1, "existing", 10)
+
+	checkErr(db.AddNewTorrents([]NewTorrent{
+		// Already exists, hence must be skipped without attaching its files to another torrent.
+		{InfoHash: existing, Name: "duplicate", Files: []File{{Path: "duplicate", Size: 1}}},
+		// Empty, hence must be skipped.
+		{InfoHash: conformanceInfoHash(2), Name: "empty", Files: []File{{Path: "empty", Size: 0}}},
+		{
+			InfoHash:  conformanceInfoHash(3),
+			Name:      "new",
+			Files:     []File{{Path: "README", Size: 5}, {Path: "new.mkv", Size: 100}},
+			Info:      []byte("d4:name3:newe"),
+			Readme:    &Readme{Path: "README", Content: "hello"},
+			MediaInfo: &MediaInfo{Path: "new.mkv", Format: "matroska"},
+		},
+	}), t)
+
+	n, err := db.GetNumberOfTorrents()
+	checkErr(err, t)
+	if n != 2 {
+		t.Fatalf("expected 2 torrents, got %d", n)
+	}
+
+	torrent, err := db.GetTorrent(existing)
+	checkErr(err, t)
+	if torrent.Name != "existing" || torrent.NFiles != 1 {
+		t.Errorf("the existing torrent is changed. Got: %+v", torrent)
+	}
+
+	info, err := db.GetInfoDictionary(conformanceInfoHash(3))
+	checkErr(err, t)
+	if string(info) != "d4:name3:newe" {
+		t.Errorf("info dictionary mismatch. Got: %q", info)
+	}
+	readme, err := db.GetReadme(conformanceInfoHash(3))
+	checkErr(err, t)
+	if readme == nil || *readme != (Readme{Path: "README", Content: "hello"}) {
+		t.Errorf("readme mismatch. Got: %+v", readme)
+	}
+	mediaInfo, err := db.GetMediaInfo(conformanceInfoHash(3))
+	checkErr(err, t)
+	if mediaInfo == nil || mediaInfo.Path != "new.mkv" || mediaInfo.Format != "matroska" {
+		t.Errorf("media info mismatch. Got: %+v", mediaInfo)
+	}
+}
+
+func testEmptyDatabase(t *testing.T, db Database) {
+	n, err := db.GetNumberOfTorrents()
+	checkErr(err, t)
+	size, err := db.GetTotalSizeOfTorrents()
+	checkErr(err, t)
+	if n != 0 || size != 0 {
+		t.Errorf("expected no torrents, got %d torrents of %d bytes", n, size)
+	}
+
+	torrents, err := db.QueryTorrents("", SearchNames, TorrentFilter{}, time.Now().Unix(), ByDiscoveredOn, false, 10, 0, 0, false)
+	checkErr(err, t)
+	if len(torrents) != 0 {
+		t.Errorf("expected no torrents, got %+v", torrents)
+	}
+
+	peerStats, err := db.GetPeerStatistics()
+	checkErr(err, t)
+	if len(peerStats.Clients) != 0 {
+		t.Errorf("expected no peer statistics, got %+v", peerStats)
+	}
+}
+
+func testGetTorrentByInfoHashV2(t *testing.T, db Database) {
+	infoHashV2 := bytes.Repeat([]byte{0xab}, 32)
+	// A hybrid torrent.
+	checkErr(db.AddNewTorrent(conformanceInfoHash(1), "hybrid", []File{{Path: "hybrid", Size: 1}},
+		InfoMetadata{InfoHashV2: infoHashV2}), t)
+
+	torrent, err := db.GetTorrent(infoHashV2)
+	checkErr(err, t)
+	if torrent == nil || !bytes.Equal(torrent.InfoHash, conformanceInfoHash(1)) ||
+		!bytes.Equal(torrent.InfoHashV2, infoHashV2) {
+		t.Fatalf("expected the torrent to be found by its v2 infohash. Got: %+v", torrent)
+	}
+	if !torrent.HasV1() {
+		t.Error("expected the hybrid torrent to have a v1 infohash")
+	}
+
+	for _, infoHash := range [][]byte{conformanceInfoHash(1), infoHashV2[:20]} {
+		exists, err := db.DoesTorrentExist(infoHash)
+		checkErr(err, t)
+		if !exists {
+			t.Errorf("expected the hybrid torrent to exist by %x", infoHash)
+		}
+	}
+	infoHash := append(bytes.Repeat([]byte{0xab}, 19), 0xac)
+	exists, err := db.DoesTorrentExist(infoHash)
+	checkErr(err, t)
+	if exists {
+		t.Errorf("expected no torrent to exist by %x", infoHash)
+	}
+}
+
+func testIterateInfoHashes(t *testing.T, db Database) {
+	var expected []string
+	for i := 0; i < 3; i++ {
+		expected = append(expected, string(addTestTorrent(t, db, i, "torrent", 1)))
+	}
+
+	var infoHashes []string
+	checkErr(db.IterateInfoHashes(func(infoHash []byte) error {
+		infoHashes = append(infoHashes, string(infoHash))
+		return nil
+	}), t)
+	sort.Strings(infoHashes)
+	if fmt.Sprint(infoHashes) != fmt.Sprint(expected) {
+		t.Errorf("infohashes mismatch. Got: %q", infoHashes)
+	}
+
+	stop := fmt.Errorf("stop")
+	n := 0
+	err := db.IterateInfoHashes(func(infoHash []byte) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("expected the iteration to stop at the first error, got %v after %d", err, n)
+	}
+}
+
+func testInfoDictionary(t *testing.T, db Database) {
+	infoHash := addTestTorrent(t, db, 1, "torrent", 1)
+
+	info, err := db.GetInfoDictionary(infoHash)
+	checkErr(err, t)
+	if info != nil {
+		t.Fatalf("expected no info dictionary, got %q", info)
+	}
+
+	checkErr(db.AddInfoDictionary(infoHash, []byte("d4:name1:ae")), t)
+	checkErr(db.AddInfoDictionary(infoHash, []byte("d4:name1:be")), t)
+	// No-op, as the torrent does not exist.
+	checkErr(db.AddInfoDictionary(conformanceInfoHash(2), []byte("d4:name1:ce")), t)
+
+	info, err = db.GetInfoDictionary(infoHash)
+	checkErr(err, t)
+	if string(info) != "d4:name1:be" {
+		t.Errorf("expected the info dictionary to be replaced, got %q", info)
+	}
+	info, err = db.GetInfoDictionary(conformanceInfoHash(2))
+	checkErr(err, t)
+	if info != nil {
+		t.Errorf("expected no info dictionary, got %q", info)
+	}
+}
+
+func testReadme(t *testing.T, db Database) {
+	infoHash := conformanceInfoHash(1)
+	checkErr(db.AddNewTorrent(infoHash, "torrent", []File{{Path: "README.txt", Size: 5}, {Path: "a", Size: 1}},
+		InfoMetadata{}), t)
+
+	readme, err := db.GetReadme(infoHash)
+	checkErr(err, t)
+	if readme != nil {
+		t.Fatalf("expected no readme, got %+v", readme)
+	}
+
+	checkErr(db.AddReadme(infoHash, "README.txt", "hello"), t)
+	readme, err = db.GetReadme(infoHash)
+	checkErr(err, t)
+	if readme == nil || *readme != (Readme{Path: "README.txt", Content: "hello"}) {
+		t.Errorf("readme mismatch. Got: %+v", readme)
+	}
+}
+
+func testMediaInfo(t *testing.T, db Database) {
+	infoHash := addTestTorrent(t, db, 1, "torrent", 1)
+
+	mediaInfo, err := db.GetMediaInfo(infoHash)
+	checkErr(err, t)
+	if mediaInfo != nil {
+		t.Fatalf("expected no media info, got %+v", mediaInfo)
+	}
+
+	checkErr(db.AddMediaInfo(infoHash, MediaInfo{Path: "a.png", Format: "png", Width: 1, Height: 1}), t)
+	expected := MediaInfo{Path: "torrent/0", Format: "mp4", Duration: 1.5, Width: 1920, Height: 1080,
+		VideoCodec: "avc1", AudioCodec: "mp4a"}
+	checkErr(db.AddMediaInfo(infoHash, expected), t)
+
+	mediaInfo, err = db.GetMediaInfo(infoHash)
+	checkErr(err, t)
+	if mediaInfo == nil || *mediaInfo != expected {
+		t.Errorf("expected the media info to be replaced. Got: %+v", mediaInfo)
+	}
+}
+
+func testPeerStatistics(t *testing.T, db Database) {
+	stats := NewPeerStatistics()
+	stats.Clients["qB"] = 2
+	stats.Extensions["ut_metadata"] = 3
+	checkErr(db.AddPeerStatistics(stats), t)
+
+	stats = NewPeerStatistics()
+	stats.Clients["qB"] = 1
+	stats.YourIPs["ipv6"] = 1
+	checkErr(db.AddPeerStatistics(stats), t)
+
+	got, err := db.GetPeerStatistics()
+	checkErr(err, t)
+	if got.Clients["qB"] != 3 || got.Extensions["ut_metadata"] != 3 || got.YourIPs["ipv6"] != 1 {
+		t.Errorf("peer statistics mismatch. Got: %+v", got)
+	}
+
+	// The new names beyond MAX_PEER_NAMES are counted as OTHER_PEER_NAME, across the additions too.
+	stats = NewPeerStatistics()
+	for i := 0; i < MAX_PEER_NAMES-1; i++ {
+		stats.Versions[fmt.Sprintf("v%d", i)] = 1
+	}
+	checkErr(db.AddPeerStatistics(stats), t)
+	stats = NewPeerStatistics()
+	stats.Versions["v0"] = 1
+	stats.Versions["popular"] = 3
+	stats.Versions["new"] = 1
+	stats.Versions["newer"] = 1
+	checkErr(db.AddPeerStatistics(stats), t)
+
+	got, err = db.GetPeerStatistics()
+	checkErr(err, t)
+	if len(got.Versions) != MAX_PEER_NAMES+1 || got.Versions["v0"] != 2 || got.Versions["popular"] != 3 ||
+		got.Versions[OTHER_PEER_NAME] != 2 || got.Clients["qB"] != 3 {
+		t.Errorf("expected the versions to be folded, got %d versions with %d others", len(got.Versions),
+			got.Versions[OTHER_PEER_NAME])
+	}
+}
+
+func testPendingInfoHashes(t *testing.T, db Database) {
+	checkErr(db.AddPendingInfoHash(PendingInfoHash{
+		InfoHash: conformanceInfoHash(1), LastAttempt: 1000, NextAttempt: 1100, NAttempts: 1,
+	}), t)
+	checkErr(db.AddPendingInfoHash(PendingInfoHash{
+		InfoHash: conformanceInfoHash(2), LastAttempt: 1000, NextAttempt: 1050, NAttempts: 1,
+		Peers: []string{"1.2.3.4:6881", "[::1]:6881"},
+	}), t)
+	// Replaces the first one.
+	checkErr(db.AddPendingInfoHash(PendingInfoHash{
+		InfoHash: conformanceInfoHash(1), LastAttempt: 1100, NextAttempt: 1300, NAttempts: 2,
+	}), t)
+
+	pending, err := db.GetPendingInfoHash(conformanceInfoHash(2))
+	checkErr(err, t)
+	if pending == nil || pending.NAttempts != 1 || len(pending.Peers) != 2 || pending.Peers[1] != "[::1]:6881" {
+		t.Fatalf("pending infohash mismatch. Got: %+v", pending)
+	}
+
+	pendings, err := db.GetDuePendingInfoHashes(1049, 10)
+	checkErr(err, t)
+	if len(pendings) != 0 {
+		t.Errorf("expected no due infohashes, got %+v", pendings)
+	}
+	pendings, err = db.GetDuePendingInfoHashes(1300, 10)
+	checkErr(err, t)
+	if len(pendings) != 2 || !bytes.Equal(pendings[0].InfoHash, conformanceInfoHash(2)) ||
+		pendings[1].NAttempts != 2 {
+		t.Errorf("expected both infohashes to be due, the most overdue first. Got: %+v", pendings)
+	}
+	pendings, err = db.GetDuePendingInfoHashes(1300, 1)
+	checkErr(err, t)
+	if len(pendings) != 1 {
+		t.Errorf("expected the due infohashes to be limited, got %d", len(pendings))
+	}
+
+	checkErr(db.DeletePendingInfoHash(conformanceInfoHash(2)), t)
+	checkErr(db.DeletePendingInfoHash(conformanceInfoHash(3)), t)
+	pending, err = db.GetPendingInfoHash(conformanceInfoHash(2))
+	checkErr(err, t)
+	if pending != nil {
+		t.Errorf("expected the infohash to be deleted, got %+v", pending)
+	}
+}
+
+func testAddAnnounces(t *testing.T, db Database) {
+	infoHash := addTestTorrent(t, db, 1, "torrent", 1)
+
+	checkErr(db.AddAnnounces([]Announces{
+		{InfoHash: infoHash, Count: 3, LastSeenOn: 2000},
+		{InfoHash: conformanceInfoHash(2), Count: 1, LastSeenOn: 2000}, // does not exist
+	}), t)
+	checkErr(db.AddAnnounces([]Announces{{InfoHash: infoHash, Count: 2, LastSeenOn: 1500}}), t)
+
+	torrent, err := db.GetTorrent(infoHash)
+	checkErr(err, t)
+	if torrent.NAnnounces != 5 || torrent.LastSeenOn != 2000 {
+		t.Errorf("announces mismatch. Got: %d announces, last seen on %d", torrent.NAnnounces, torrent.LastSeenOn)
+	}
+
+	// The announces of a hybrid torrent by its truncated v2 infohash are counted too.
+	infoHashV2 := bytes.Repeat([]byte{0xab}, 32)
+	checkErr(db.AddNewTorrent(conformanceInfoHash(3), "hybrid", []File{{Path: "hybrid", Size: 1}},
+		InfoMetadata{InfoHashV2: infoHashV2}), t)
+	checkErr(db.AddAnnounces([]Announces{
+		{InfoHash: conformanceInfoHash(3), Count: 1, LastSeenOn: 2000},
+		{InfoHash: infoHashV2[:20], Count: 2, LastSeenOn: 2500},
+	}), t)
+	torrent, err = db.GetTorrent(conformanceInfoHash(3))
+	checkErr(err, t)
+	if torrent.NAnnounces != 3 || torrent.LastSeenOn != 2500 {
+		t.Errorf("announces of the hybrid torrent mismatch. Got: %d announces, last seen on %d",
+			torrent.NAnnounces, torrent.LastSeenOn)
+	}
+}
+
+// queryNames returns the names of the torrents returned by QueryTorrents.
+func queryNames(t *testing.T, db Database, query string, orderBy OrderingCriteria, ascending bool, limit uint,
+	after *TorrentMetadata, backward bool) []string {
+	var lastOrderedValue, lastID uint64
+	if after != nil {
+		lastID = uint64(after.ID)
+		switch orderBy {
+		case BySize:
+			lastOrderedValue = after.Size
+		case ByDiscoveredOn:
+			lastOrderedValue = uint64(after.DiscoveredOn)
+		case ByNFiles:
+			lastOrderedValue = uint64(after.NFiles)
+		}
+	}
+
+	torrents, err := db.QueryTorrents(query, SearchNames, TorrentFilter{}, time.Now().Unix()+1, orderBy, ascending, limit, lastOrderedValue,
+		lastID, backward)
+	checkErr(err, t)
+
+	var names []string
+	for _, torrent := range torrents {
+		names = append(names, torrent.Name)
+	}
+	return names
+}
+
+func testQueryTorrents(t *testing.T, db Database) {
+	addTestTorrent(t, db, 1, "a", 10)
+	addTestTorrent(t, db, 2, "b", 5, 5, 5)
+	addTestTorrent(t, db, 3, "c", 20, 1)
+
+	if _, err := db.QueryTorrents("", SearchNames, TorrentFilter{}, time.Now().Unix(), ByRelevance, false, 10, 0, 0, false); err == nil {
+		t.Error("expected an error when ordering by relevance without a query")
+	}
+	if _, err := db.QueryTorrents("", SearchNames, TorrentFilter{}, time.Now().Unix(), BySize, false, 10, 1, 0, false); err == nil {
+		t.Error("expected an error when lastOrderedValue is given without lastID")
+	}
+
+	// The torrents discovered after the epoch are excluded.
+	torrents, err := db.QueryTorrents("", SearchNames, TorrentFilter{}, time.Now().Unix()-3600, ByDiscoveredOn, false, 10, 0, 0, false)
+	checkErr(err, t)
+	if len(torrents) != 0 {
+		t.Errorf("expected no torrents discovered an hour ago, got %d", len(torrents))
+	}
+
+	tests := []struct {
+		orderBy   OrderingCriteria
+		ascending bool
+		expected  string
+	}{
+		{BySize, true, "[a b c]"},
+		{BySize, false, "[c b a]"},
+		{ByNFiles, true, "[a c b]"},
+		{ByNFiles, false, "[b c a]"},
+		// Discovered in the same second most probably, hence ordered by their IDs.
+		{ByDiscoveredOn, true, "[a b c]"},
+	}
+	for i, test := range tests {
+		if names := fmt.Sprint(queryNames(t, db, "", test.orderBy, test.ascending, 10, nil, false)); names != test.expected {
+			t.Errorf("expected the torrents of the query #%d to be %s, got %s", i, test.expected, names)
+		}
+	}
+
+	torrents, err = db.QueryTorrents("", SearchNames, TorrentFilter{}, time.Now().Unix()+1, BySize, true, 10, 0, 0, false)
+	checkErr(err, t)
+	if len(torrents) != 3 || torrents[2].Size != 21 || torrents[2].NFiles != 2 || torrents[2].ID == 0 ||
+		!bytes.Equal(torrents[2].InfoHash, conformanceInfoHash(3)) || torrents[2].DiscoveredOn == 0 {
+		t.Errorf("torrents mismatch. Got: %+v", torrents)
+	}
+	// The numbers of seeders and leechers are not recorded yet.
+	for _, orderBy := range []OrderingCriteria{ByNSeeders, ByNLeechers} {
+		if _, err = db.QueryTorrents("", SearchNames, TorrentFilter{}, time.Now().Unix()+1, orderBy, false, 10, 0, 0, false); err == nil {
+			t.Errorf("expected an error when ordering by %d", orderBy)
+		}
+	}
+}
+
+func testQueryTorrentsPagination(t *testing.T, db Database) {
+	// b1 and b2 are of the same size, so they are ordered by their IDs.
+	addTestTorrent(t, db, 1, "a", 10)
+	addTestTorrent(t, db, 2, "b1", 20)
+	addTestTorrent(t, db, 3, "b2", 20)
+	addTestTorrent(t, db, 4, "c", 30)
+	addTestTorrent(t, db, 5, "d", 40)
+
+	torrents := make(map[string]*TorrentMetadata)
+	all, err := db.QueryTorrents("", SearchNames, TorrentFilter{}, time.Now().Unix()+1, BySize, true, 10, 0, 0, false)
+	checkErr(err, t)
+	for i := range all {
+		torrents[all[i].Name] = &all[i]
+	}
+
+	tests := []struct {
+		ascending bool
+		after     string
+		backward  bool
+		expected  string
+	}{
+		{true, "", false, "[a b1]"},
+		{true, "b1", false, "[b2 c]"},
+		{true, "c", false, "[d]"},
+		{true, "d", false, "[]"},
+		{false, "", false, "[d c]"},
+		{false, "c", false, "[b1 b2]"},
+		{false, "b2", false, "[a]"},
+		// Backwards, the torrents before the given one are returned in the reverse order (but the
+		// ones of the same size are still ordered by their IDs).
+		{true, "c", true, "[b1 b2]"},
+		{true, "b2", true, "[b1 a]"},
+		{false, "b1", true, "[c d]"},
+	}
+	for i, test := range tests {
+		var after *TorrentMetadata
+		if test.after != "" {
+			after = torrents[test.after]
+		}
+		names := fmt.Sprint(queryNames(t, db, "", BySize, test.ascending, 2, after, test.backward))
+		if names != test.expected {
+			t.Errorf("expected the page #%d to be %s, got %s", i, test.expected, names)
+		}
+	}
+}
+
+func testQueryTorrentsSearch(t *testing.T, db Database) {
+	addTestTorrent(t, db, 1, "ubuntu-18.04-desktop-amd64.iso", 10)
+	addTestTorrent(t, db, 2, "debian-9.4.0-amd64-netinst.iso", 20)
+	addTestTorrent(t, db, 3, "Ubuntu Server 18.04", 30)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"ubuntu", "[Ubuntu Server 18.04 ubuntu-18.04-desktop-amd64.iso]"},
+		{"netinst", "[debian-9.4.0-amd64-netinst.iso]"},
+		{"ubuntu desktop", "[ubuntu-18.04-desktop-amd64.iso]"},
+		{"fedora", "[]"},
+	}
+	for _, test := range tests {
+		for _, orderBy := range []OrderingCriteria{ByRelevance, BySize} {
+			names := queryNames(t, db, test.query, orderBy, false, 10, nil, false)
+			sort.Strings(names)
+			if fmt.Sprint(names) != test.expected {
+				t.Errorf("expected the torrents matching %q to be %s, got %s", test.query, test.expected, names)
+			}
+		}
+	}
+}
+
+func testQueryTorrentsSearchFiles(t *testing.T, db Database) {
+	checkErr(db.AddNewTorrent(conformanceInfoHash(1), "Some Show", []File{
+		{Path: "Season 1/Episode 01.mkv", Size: 100},
+		{Path: ".pad/100", Size: 100, Attributes: "p"},
+		{Path: "Season 1/Sample.mkv", Size: 10},
+	}, InfoMetadata{}), t)
+	checkErr(db.AddNewTorrent(conformanceInfoHash(2), "Sample Pack", []File{{Path: "readme.txt", Size: 200}},
+		InfoMetadata{}), t)
+
+	torrents, err := db.QueryTorrents("sample", SearchFiles, TorrentFilter{}, time.Now().Unix()+1, BySize, true, 10, 0, 0, false)
+	checkErr(err, t)
+	if len(torrents) != 2 || torrents[0].Name != "Some Show" || torrents[1].Name != "Sample Pack" {
+		t.Fatalf("expected both torrents to match, got %+v", torrents)
+	}
+	expected := []MatchedFile{{Path: "Season 1/Sample.mkv", Fragments: []Fragment{
+		{Text: "Season 1/"}, {Text: "Sample", Highlighted: true}, {Text: ".mkv"},
+	}}}
+	if !reflect.DeepEqual(torrents[0].MatchedFiles, expected) {
+		t.Errorf("expected the matching file to be highlighted, got %+v", torrents[0].MatchedFiles)
+	}
+	if len(torrents[1].MatchedFiles) != 0 {
+		t.Errorf("expected no matching files for the name match, got %+v", torrents[1].MatchedFiles)
+	}
+
+	// The padding files are not searched.
+	torrents, err = db.QueryTorrents("pad", SearchFiles, TorrentFilter{}, time.Now().Unix()+1, ByRelevance, false, 10, 0, 0, false)
+	checkErr(err, t)
+	if len(torrents) != 0 {
+		t.Errorf("expected the padding files not to match, got %+v", torrents)
+	}
+}
+
+func testQueryTorrentsSyntax(t *testing.T, db Database) {
+	checkErr(db.AddNewTorrent(conformanceInfoHash(1), "ubuntu-18.04-desktop-amd64", []File{
+		{Path: "ubuntu-18.04-desktop-amd64.iso", Size: 10},
+	}, InfoMetadata{}), t)
+	checkErr(db.AddNewTorrent(conformanceInfoHash(2), "Ubuntu Server 18.04", []File{
+		{Path: "ubuntu-18.04-server-amd64.iso", Size: 20},
+		{Path: "README.TXT", Size: 1},
+	}, InfoMetadata{}), t)
+	addTestTorrent(t, db, 3, "Server Ubuntu", 30, 30, 30)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"ubuntu -desktop", "[Server Ubuntu Ubuntu Server 18.04]"},
+		{`"ubuntu server"`, "[Ubuntu Server 18.04]"},
+		{`ubuntu -"ubuntu server"`, "[Server Ubuntu ubuntu-18.04-desktop-amd64]"},
+		{`ubuntu" & server`, "[Server Ubuntu Ubuntu Server 18.04]"},
+		{"ubuntu size:>21", "[Server Ubuntu]"},
+		{"ubuntu size:11..21", "[Ubuntu Server 18.04]"},
+		{"ubuntu files:<3", "[Ubuntu Server 18.04 ubuntu-18.04-desktop-amd64]"},
+		{"ubuntu files:2", "[Ubuntu Server 18.04]"},
+		{"ubuntu ext:iso", "[Ubuntu Server 18.04 ubuntu-18.04-desktop-amd64]"},
+		{"ubuntu ext:txt,pdf", "[Ubuntu Server 18.04]"},
+		{"ubuntu ext:iso ext:txt", "[Ubuntu Server 18.04]"},
+		{"ubuntu discovered:<2000", "[]"},
+		{"ubuntu discovered:>=2000", "[Server Ubuntu Ubuntu Server 18.04 ubuntu-18.04-desktop-amd64]"},
+		{"size:>=20 files:<=2", "[Ubuntu Server 18.04]"},
+	}
+	for _, test := range tests {
+		orderBy := ByRelevance
+		if q, _ := ParseSearchQuery(test.query); len(q.Terms) == 0 {
+			orderBy = BySize
+		}
+		names := queryNames(t, db, test.query, orderBy, false, 10, nil, false)
+		sort.Strings(names)
+		if fmt.Sprint(names) != test.expected {
+			t.Errorf("expected the torrents matching %q to be %s, got %s", test.query, test.expected, names)
+		}
+	}
+
+	for _, query := range []string{`ubuntu "server`, "size:>1XB", "-cam"} {
+		_, err := db.QueryTorrents(query, SearchNames, TorrentFilter{}, time.Now().Unix()+1, ByRelevance, false, 10, 0, 0, false)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("expected a QueryError for %q, got %v", query, err)
+		}
+	}
+}
+
+func testQueryTorrentsFilter(t *testing.T, db Database) {
+	checkErr(db.AddNewTorrent(conformanceInfoHash(1), "Movie", []File{
+		{Path: "Movie.MKV", Size: 100}, {Path: "Movie.srt", Size: 1},
+	}, InfoMetadata{}), t)
+	checkErr(db.AddNewTorrent(conformanceInfoHash(2), "Movie Soundtrack", []File{
+		{Path: "01.flac", Size: 10}, {Path: "02.flac", Size: 10}, {Path: "03.flac", Size: 10},
+	}, InfoMetadata{}), t)
+	addTestTorrent(t, db, 3, "Movie Poster", 5)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		query    string
+		filter   TorrentFilter
+		expected string
+	}{
+		{"movie", TorrentFilter{}, "[Movie Movie Poster Movie Soundtrack]"},
+		{"movie", TorrentFilter{MinSize: 30}, "[Movie Movie Soundtrack]"},
+		{"movie", TorrentFilter{MinSize: 6, MaxSize: 100}, "[Movie Soundtrack]"},
+		{"movie", TorrentFilter{MinNFiles: 2, MaxNFiles: 2}, "[Movie]"},
+		{"movie", TorrentFilter{MaxNFiles: 1}, "[Movie Poster]"},
+		{"movie", TorrentFilter{MinDiscoveredOn: now - 3600, MaxDiscoveredOn: now + 3600}, "[Movie Movie Poster Movie Soundtrack]"},
+		{"movie", TorrentFilter{MaxDiscoveredOn: now - 3600}, "[]"},
+		{"movie", TorrentFilter{Category: VideoCategory}, "[Movie]"},
+		{"movie", TorrentFilter{Category: AudioCategory, MinNFiles: 3}, "[Movie Soundtrack]"},
+		{"movie", TorrentFilter{Category: ImageCategory}, "[]"},
+		// The filters of the query must match too.
+		{"movie size:<50", TorrentFilter{MinSize: 10}, "[Movie Soundtrack]"},
+		{"movie ext:srt", TorrentFilter{Category: VideoCategory}, "[Movie]"},
+		{"", TorrentFilter{MinSize: 30, MaxNFiles: 2}, "[Movie]"},
+	}
+	for _, test := range tests {
+		orderBy := ByRelevance
+		if test.query == "" {
+			orderBy = BySize
+		}
+		torrents, err := db.QueryTorrents(test.query, SearchNames, test.filter, now+1, orderBy, false, 10, 0, 0, false)
+		checkErr(err, t)
+		var names []string
+		for _, torrent := range torrents {
+			names = append(names, torrent.Name)
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != test.expected {
+			t.Errorf("expected the torrents matching %q and %+v to be %s, got %s", test.query, test.filter,
+				test.expected, names)
+		}
+	}
+}
+
+func testGetStatistics(t *testing.T, db Database) {
+	addTestTorrent(t, db, 1, "torrent", 10, 20)
+
+	// The statistics start at the end of the given period, so the torrent is either in the first
+	// or the second data point (near the end of the year).
+	lastYear := strconv.Itoa(time.Now().UTC().Year() - 1)
+	stats, err := db.GetStatistics(2, lastYear)
+	checkErr(err, t)
+	if stats.N != 2 || len(stats.NTorrents) != 2 || len(stats.NFiles) != 2 || len(stats.TotalSize) != 2 {
+		t.Fatalf("expected 2 data points. Got: %+v", stats)
+	}
+	if stats.NTorrents[0]+stats.NTorrents[1] != 1 || stats.NFiles[0]+stats.NFiles[1] != 2 ||
+		stats.TotalSize[0]+stats.TotalSize[1] != 30 {
+		t.Errorf("expected the torrent to be in the statistics. Got: %+v", stats)
+	}
+
+	stats, err = db.GetStatistics(1, "2016")
+	checkErr(err, t)
+	if stats.NTorrents[0] != 0 || stats.NFiles[0] != 0 || stats.TotalSize[0] != 0 {
+		t.Errorf("expected no torrents in 2017. Got: %+v", stats)
+	}
+
+	if _, err = db.GetStatistics(1, "yesterday"); err == nil {
+		t.Error("expected an error for an invalid date")
+	}
+}
@@ -0,0 +1,210 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeElasticsearch is a stand-in for the bulk and the search APIs of Elasticsearch, whose queries
+// match the documents that contain all of their words (in their names or paths).
+type fakeElasticsearch struct {
+	sync.Mutex
+	indices   map[string]map[string]elasticsearchDocument
+	nRequests int
+}
+
+func (es *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.Lock()
+	defer es.Unlock()
+	es.nRequests++
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "magnetico" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "HEAD" && len(parts) == 1:
+		if _, exists := es.indices[parts[0]]; !exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case r.Method == "PUT" && len(parts) == 1:
+		es.indices[parts[0]] = make(map[string]elasticsearchDocument)
+		fmt.Fprint(w, `{"acknowledged": true}`)
+
+	case r.Method == "POST" && parts[0] == "_bulk":
+		var items []interface{}
+		failed := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action struct {
+				Index struct {
+					Index string `json:"_index"`
+					ID    string `json:"_id"`
+				} `json:"index"`
+			}
+			var document elasticsearchDocument
+			if json.Unmarshal(scanner.Bytes(), &action) != nil || !scanner.Scan() ||
+				json.Unmarshal(scanner.Bytes(), &document) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			index, exists := es.indices[action.Index.Index]
+			if !exists || document.Name == "invalid" {
+				failed = true
+				items = append(items, map[string]interface{}{"index": map[string]interface{}{
+					"_id": action.Index.ID, "status": 400, "error": map[string]string{"type": "mapper_parsing_exception"},
+				}})
+				continue
+			}
+			index[action.Index.ID] = document
+			items = append(items, map[string]interface{}{"index": map[string]interface{}{"_id": action.Index.ID, "status": 201}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": failed, "items": items})
+
+	case r.Method == "POST" && len(parts) == 2 && parts[1] == "_search":
+		var request struct {
+			Size  int `json:"size"`
+			Query struct {
+				SimpleQueryString struct {
+					Query string `json:"query"`
+				} `json:"simple_query_string"`
+			} `json:"query"`
+		}
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		type hit struct {
+			Score  float64               `json:"_score"`
+			Source elasticsearchDocument `json:"_source"`
+		}
+		var hits []hit
+		for _, document := range es.indices[parts[0]] {
+			text := strings.ToLower(document.Name + " " + strings.Join(document.Paths, " "))
+			score := 0.0
+			for _, word := range strings.Fields(strings.ToLower(request.Query.SimpleQueryString.Query)) {
+				if !strings.Contains(text, word) {
+					score = 0
+					break
+				}
+				score += float64(strings.Count(text, word))
+			}
+			if score > 0 {
+				document.Paths = nil
+				hits = append(hits, hit{score, document})
+			}
+		}
+		sort.Slice(hits, func(i, j int) bool {
+			if hits[i].Score != hits[j].Score {
+				return hits[i].Score > hits[j].Score
+			}
+			return hits[i].Source.ID < hits[j].Source.ID
+		})
+		if len(hits) > request.Size {
+			hits = hits[:request.Size]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"hits": hits}})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestElasticsearchIndex(t *testing.T) {
+	es := &fakeElasticsearch{indices: make(map[string]map[string]elasticsearchDocument)}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	indexURL, err := url.Parse(server.URL)
+	checkErr(err, t)
+	indexURL.User = url.UserPassword("magnetico", "secret")
+
+	idx, err := MakeSearchIndex(indexURL)
+	checkErr(err, t)
+	defer idx.Close()
+	if _, exists := es.indices[ELASTICSEARCH_DEFAULT_INDEX]; !exists {
+		t.Fatal("expected the index to be created")
+	}
+
+	ubuntu := indexedTorrent(1, "Ubuntu 18.04", "ubuntu-18.04-desktop-amd64.iso")
+	ubuntu.Size = 10
+	ubuntu.DiscoveredOn = 1500000000
+	ubuntu.NFiles = 1
+	ubuntu.InfoHashV2 = make([]byte, 32)
+	checkErr(idx.Index([]IndexedTorrent{ubuntu, indexedTorrent(2, "Debian", "debian-9.4.0-amd64-netinst.iso")}), t)
+
+	hits, err := idx.Search("ubuntu desktop", 10)
+	checkErr(err, t)
+	if len(hits) != 1 || hits[0].ID != 1 || hits[0].Name != "Ubuntu 18.04" || hits[0].Size != 10 ||
+		hits[0].DiscoveredOn != 1500000000 || hits[0].NFiles != 1 || hits[0].Score <= 0 ||
+		fmt.Sprintf("%x", hits[0].InfoHash) != fmt.Sprintf("%x", ubuntu.InfoHash) || len(hits[0].InfoHashV2) != 32 {
+		t.Errorf("hits mismatch. Got: %+v", hits)
+	}
+
+	if names := searchNames(t, idx, "amd64"); names != "[Debian Ubuntu 18.04]" {
+		t.Errorf("expected both torrents to match, got %s", names)
+	}
+
+	// The errors of the individual torrents are reported.
+	if err = idx.Index([]IndexedTorrent{indexedTorrent(3, "invalid")}); err == nil ||
+		!strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Errorf("expected the bulk error to be reported, got %v", err)
+	}
+
+	// The existing index is reused.
+	nRequests := es.nRequests
+	indexURL.Path = "/" + ELASTICSEARCH_DEFAULT_INDEX
+	if _, err = MakeSearchIndex(indexURL); err != nil || es.nRequests != nRequests+1 {
+		t.Errorf("expected the existing index to be used, got %v after %d requests", err, es.nRequests-nRequests)
+	}
+
+	indexURL.User = url.UserPassword("magnetico", "wrong")
+	if _, err = MakeSearchIndex(indexURL); err == nil {
+		t.Error("expected an error for the wrong password")
+	}
+}
+
+func TestElasticsearchIndex_ErrorStatus(t *testing.T) {
+	var status int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"error": {"type": "some_exception"}}`)
+	}))
+	defer server.Close()
+
+	indexURL, err := url.Parse(server.URL)
+	checkErr(err, t)
+	idx := &elasticsearchIndex{client: server.Client(), baseURL: *indexURL, name: ELASTICSEARCH_DEFAULT_INDEX}
+
+	tests := map[int]bool{
+		http.StatusTooManyRequests:     true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        false,
+		http.StatusInternalServerError: false,
+	}
+	for status = range tests {
+		_, err = idx.Search("ubuntu", 10)
+		if err == nil || !strings.Contains(err.Error(), "some_exception") {
+			t.Errorf("expected the error of %d to be described, got %v", status, err)
+		}
+		if IsTransient(err) != tests[status] {
+			t.Errorf("expected IsTransient for %d to be %t, got %v", status, tests[status], err)
+		}
+	}
+}
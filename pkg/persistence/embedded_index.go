@@ -0,0 +1,542 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// The embedded index is a pure-Go full-text index that is stored in a single file, as a log of the
+// indexed torrents (one JSON object per line) which is loaded in memory. Hence the same index can
+// be written by magneticod and read by magneticow at the same time: the entries appended to the log
+// are loaded lazily, before each operation.
+//
+// The words of the names and of the file paths of the torrents are indexed (case-insensitively),
+// and the queries consist of the following clauses, all of which must match:
+//
+//	ubuntu            the word, in the name or in one of the file paths
+//	"ubuntu desktop"  the phrase (i.e. the words consecutively)
+//	ubun*             a word that starts with the prefix
+//	ubunut~ ubnt~2    a word that is at most 1 (or the given number, up to 2) edit(s) away
+//	name:ubuntu       the word (or the phrase, etc.) in the name only; path: for the file paths
+//	-ubuntu           excludes the torrents that match the clause
+//
+// A word that contains punctuation (e.g. ubuntu-20.04) is searched for as a phrase.
+
+const (
+	embeddedNameField = iota
+	embeddedPathField
+	embeddedNFields
+)
+
+// embeddedFields are the fields of the embedded index by their names in the queries.
+var embeddedFields = map[string]int{
+	"name": embeddedNameField,
+	"path": embeddedPathField,
+}
+
+// embeddedFieldBoosts are the factors of the scores of the matches in each field, such that a match
+// in the name counts more than one in a file path.
+var embeddedFieldBoosts = [embeddedNFields]float64{2, 1}
+
+// EMBEDDED_PATH_GAP is the gap between the positions of the words of consecutive file paths, so that
+// the phrases do not match across the files.
+const EMBEDDED_PATH_GAP = 100
+
+// EMBEDDED_MAX_FUZZINESS is the maximum edit distance of the fuzzy queries.
+const EMBEDDED_MAX_FUZZINESS = 2
+
+type embeddedIndex struct {
+	// mu guards all of the fields below.
+	mu   sync.Mutex
+	file *os.File
+	// offset is the number of bytes of the log that are loaded.
+	offset int64
+
+	docs       []embeddedDoc
+	byInfoHash map[string]int
+	nLive      int
+	fields     [embeddedNFields]embeddedField
+}
+
+type embeddedDoc struct {
+	TorrentMetadata
+	// replaced is true if the torrent is indexed again, as another document.
+	replaced bool
+}
+
+type embeddedField struct {
+	postings map[string][]embeddedPosting
+	// terms are the keys of postings in order, or nil if they are to be sorted again.
+	terms []string
+}
+
+type embeddedPosting struct {
+	doc       int
+	positions []int
+}
+
+// embeddedClause is a clause of a query, where the phrase consists of one or more terms.
+type embeddedClause struct {
+	// field is -1 for all the fields.
+	field     int
+	phrase    []string
+	prefix    bool
+	fuzziness int
+	excluded  bool
+}
+
+func makeEmbeddedIndex(path string) (*embeddedIndex, error) {
+	if path == "" {
+		return nil, fmt.Errorf("the path of the search index is empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+
+	idx := &embeddedIndex{file: file}
+	idx.reset()
+	if err = idx.refresh(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not load the search index: %s", err.Error())
+	}
+
+	return idx, nil
+}
+
+func (idx *embeddedIndex) reset() {
+	idx.offset = 0
+	idx.docs = nil
+	idx.byInfoHash = make(map[string]int)
+	idx.nLive = 0
+	for i := range idx.fields {
+		idx.fields[i] = embeddedField{postings: make(map[string][]embeddedPosting)}
+	}
+}
+
+// refresh loads the (complete) entries that are appended to the log since it was last loaded.
+func (idx *embeddedIndex) refresh() error {
+	info, err := idx.file.Stat()
+	if err != nil {
+		return err
+	}
+	// The log is truncated (e.g. to be rebuilt), so it is loaded from scratch.
+	if info.Size() < idx.offset {
+		idx.reset()
+	}
+	if info.Size() == idx.offset {
+		return nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(idx.file, idx.offset, info.Size()-idx.offset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// The last line is incomplete (i.e. it is being written), so it is left to be loaded
+			// the next time.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		idx.offset += int64(len(line))
+
+		var torrent IndexedTorrent
+		if err = json.Unmarshal(line, &torrent); err != nil {
+			zap.L().Warn("Skipping a corrupt entry of the search index!", zap.Error(err))
+			continue
+		}
+		idx.add(torrent)
+	}
+}
+
+func (idx *embeddedIndex) add(torrent IndexedTorrent) {
+	doc := len(idx.docs)
+	if replaced, exists := idx.byInfoHash[string(torrent.InfoHash)]; exists {
+		idx.docs[replaced].replaced = true
+	} else {
+		idx.nLive++
+	}
+	idx.docs = append(idx.docs, embeddedDoc{TorrentMetadata: torrent.TorrentMetadata})
+	idx.byInfoHash[string(torrent.InfoHash)] = doc
+
+	idx.fields[embeddedNameField].add(doc, analyze(torrent.Name), 0)
+	position := 0
+	for _, path := range torrent.Paths {
+		words := analyze(path)
+		idx.fields[embeddedPathField].add(doc, words, position)
+		position += len(words) + EMBEDDED_PATH_GAP
+	}
+}
+
+func (field *embeddedField) add(doc int, words []string, start int) {
+	positions := make(map[string][]int)
+	var terms []string
+	for i, word := range words {
+		if _, exists := positions[word]; !exists {
+			terms = append(terms, word)
+		}
+		positions[word] = append(positions[word], start+i)
+	}
+
+	for _, term := range terms {
+		postings := field.postings[term]
+		// The same document can be added more than once (for each file path).
+		if n := len(postings); n > 0 && postings[n-1].doc == doc {
+			postings[n-1].positions = append(postings[n-1].positions, positions[term]...)
+			continue
+		}
+		if postings == nil {
+			field.terms = nil
+		}
+		field.postings[term] = append(postings, embeddedPosting{doc: doc, positions: positions[term]})
+	}
+}
+
+func (field *embeddedField) sortedTerms() []string {
+	if field.terms == nil {
+		field.terms = make([]string, 0, len(field.postings))
+		for term := range field.postings {
+			field.terms = append(field.terms, term)
+		}
+		sort.Strings(field.terms)
+	}
+	return field.terms
+}
+
+func (idx *embeddedIndex) Index(torrents []IndexedTorrent) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err := idx.refresh(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	// Terminate the incomplete last line (e.g. of a crashed writer), if any, so that it is skipped
+	// instead of corrupting the first of our entries.
+	if info, err := idx.file.Stat(); err != nil {
+		return err
+	} else if info.Size() > idx.offset {
+		buf.WriteByte('\n')
+	}
+	for _, torrent := range torrents {
+		line, err := json.Marshal(torrent)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// The entries are appended with a single write, so that the readers never see them partially
+	// (except for the last line, which they do not load until it is complete).
+	if _, err := idx.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return idx.refresh()
+}
+
+func (idx *embeddedIndex) Search(query string, limit uint) ([]SearchHit, error) {
+	clauses, err := parseEmbeddedQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err = idx.refresh(); err != nil {
+		return nil, err
+	}
+
+	var scores map[int]float64
+	for _, clause := range clauses {
+		if clause.excluded {
+			continue
+		}
+		matches := idx.match(clause)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for doc, score := range scores {
+			if match, exists := matches[doc]; exists {
+				scores[doc] = score + match
+			} else {
+				delete(scores, doc)
+			}
+		}
+	}
+	for _, clause := range clauses {
+		if clause.excluded {
+			for doc := range idx.match(clause) {
+				delete(scores, doc)
+			}
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for doc, score := range scores {
+		hits = append(hits, SearchHit{TorrentMetadata: idx.docs[doc].TorrentMetadata, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	if uint(len(hits)) > limit {
+		hits = hits[:limit]
+	}
+
+	return hits, nil
+}
+
+// match returns the scores of the (current) documents that match the clause.
+func (idx *embeddedIndex) match(clause embeddedClause) map[int]float64 {
+	scores := make(map[int]float64)
+	for f := range idx.fields {
+		if clause.field != -1 && clause.field != f {
+			continue
+		}
+		field := &idx.fields[f]
+
+		if len(clause.phrase) > 1 {
+			idx.matchPhrase(f, clause.phrase, scores)
+			continue
+		}
+
+		for _, term := range idx.expand(field, clause) {
+			postings := field.postings[term]
+			idf := idx.idf(len(postings))
+			for _, posting := range postings {
+				if !idx.docs[posting.doc].replaced {
+					scores[posting.doc] += embeddedFieldBoosts[f] * idf * (1 + math.Log(float64(len(posting.positions))))
+				}
+			}
+		}
+	}
+	return scores
+}
+
+// expand returns the terms of the field that the (single word) clause matches.
+func (idx *embeddedIndex) expand(field *embeddedField, clause embeddedClause) []string {
+	word := clause.phrase[0]
+	if clause.prefix {
+		terms := field.sortedTerms()
+		var matches []string
+		for i := sort.SearchStrings(terms, word); i < len(terms) && strings.HasPrefix(terms[i], word); i++ {
+			matches = append(matches, terms[i])
+		}
+		return matches
+	}
+	if clause.fuzziness > 0 {
+		var matches []string
+		for _, term := range field.sortedTerms() {
+			if withinEditDistance(word, term, clause.fuzziness) {
+				matches = append(matches, term)
+			}
+		}
+		return matches
+	}
+	return []string{word}
+}
+
+func (idx *embeddedIndex) matchPhrase(f int, phrase []string, scores map[int]float64) {
+	field := &idx.fields[f]
+
+	// The positions of the rest of the words, by document.
+	rest := make([]map[int]map[int]struct{}, len(phrase))
+	idf := idx.idf(len(field.postings[phrase[0]]))
+	for i := 1; i < len(phrase); i++ {
+		postings := field.postings[phrase[i]]
+		if len(postings) == 0 {
+			return
+		}
+		idf += idx.idf(len(postings))
+		rest[i] = make(map[int]map[int]struct{}, len(postings))
+		for _, posting := range postings {
+			positions := make(map[int]struct{}, len(posting.positions))
+			for _, position := range posting.positions {
+				positions[position] = struct{}{}
+			}
+			rest[i][posting.doc] = positions
+		}
+	}
+
+	for _, posting := range field.postings[phrase[0]] {
+		if idx.docs[posting.doc].replaced {
+			continue
+		}
+
+		n := 0
+	positions:
+		for _, position := range posting.positions {
+			for i := 1; i < len(phrase); i++ {
+				if _, exists := rest[i][posting.doc][position+i]; !exists {
+					continue positions
+				}
+			}
+			n++
+		}
+		if n > 0 {
+			scores[posting.doc] += embeddedFieldBoosts[f] * idf * (1 + math.Log(float64(n)))
+		}
+	}
+}
+
+// idf is the inverse document frequency of a term that is in @df documents.
+func (idx *embeddedIndex) idf(df int) float64 {
+	return math.Log(1 + float64(idx.nLive)/float64(df+1))
+}
+
+func (idx *embeddedIndex) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.file.Close()
+}
+
+// analyze splits the text into its (lowercase) words.
+func analyze(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func parseEmbeddedQuery(query string) ([]embeddedClause, error) {
+	var clauses []embeddedClause
+	nIncluded := 0
+
+	rest := strings.TrimSpace(query)
+	for rest != "" {
+		clause := embeddedClause{field: -1}
+
+		if rest[0] == '-' {
+			clause.excluded = true
+			rest = rest[1:]
+		} else if rest[0] == '+' {
+			rest = rest[1:]
+		}
+
+		if colon := strings.IndexByte(rest, ':'); colon != -1 {
+			if field, exists := embeddedFields[rest[:colon]]; exists {
+				name := rest[:colon]
+				clause.field = field
+				rest = rest[colon+1:]
+				if rest == "" || unicode.IsSpace(rune(rest[0])) {
+					return nil, fmt.Errorf("nothing to search for in the field %s", name)
+				}
+			}
+		}
+
+		var text string
+		if rest != "" && rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated phrase %s", rest)
+			}
+			text, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end == -1 {
+				end = len(rest)
+			}
+			text, rest = rest[:end], rest[end:]
+
+			if tilde := strings.LastIndexByte(text, '~'); tilde != -1 {
+				clause.fuzziness = 1
+				if digits := text[tilde+1:]; digits != "" {
+					fuzziness, err := strconv.Atoi(digits)
+					if err != nil || fuzziness < 0 || fuzziness > EMBEDDED_MAX_FUZZINESS {
+						return nil, fmt.Errorf("invalid fuzziness in %s (must be between 0 and %d)", text, EMBEDDED_MAX_FUZZINESS)
+					}
+					clause.fuzziness = fuzziness
+				}
+				text = text[:tilde]
+			}
+			if strings.HasSuffix(text, "*") {
+				clause.prefix = true
+				text = strings.TrimSuffix(text, "*")
+			}
+		}
+
+		clause.phrase = analyze(text)
+		if len(clause.phrase) == 0 {
+			return nil, fmt.Errorf("no words to search for in %q", text)
+		}
+		if len(clause.phrase) > 1 && (clause.prefix || clause.fuzziness > 0) {
+			return nil, fmt.Errorf("%s must be a single word to be searched for by prefix or fuzzily", text)
+		}
+
+		if !clause.excluded {
+			nIncluded++
+		}
+		clauses = append(clauses, clause)
+		rest = strings.TrimSpace(rest)
+	}
+
+	if nIncluded == 0 {
+		return nil, fmt.Errorf("the query must contain at least one word to search for")
+	}
+	return clauses, nil
+}
+
+// withinEditDistance reports whether the Levenshtein distance between a and b is at most max.
+func withinEditDistance(a, b string, max int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra)-len(rb) > max || len(rb)-len(ra) > max {
+		return false
+	}
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if current[j] < rowMin {
+				rowMin = current[j]
+			}
+		}
+		if rowMin > max {
+			return false
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)] <= max
+}
+
+func minInt(first int, rest ...int) int {
+	for _, n := range rest {
+		if n < first {
+			first = n
+		}
+	}
+	return first
+}
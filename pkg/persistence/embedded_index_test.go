@@ -0,0 +1,158 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func openTestIndex(t *testing.T) (*embeddedIndex, string) {
+	dir, err := ioutil.TempDir("", "magnetico")
+	checkErr(err, t)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	indexPath := path.Join(dir, "index")
+	idx, err := makeEmbeddedIndex(indexPath)
+	checkErr(err, t)
+	t.Cleanup(func() { idx.Close() })
+	return idx, indexPath
+}
+
+func indexedTorrent(id uint, name string, paths ...string) IndexedTorrent {
+	return IndexedTorrent{
+		TorrentMetadata: TorrentMetadata{ID: id, InfoHash: conformanceInfoHash(int(id)), Name: name},
+		Paths:           paths,
+	}
+}
+
+func searchNames(t *testing.T, idx SearchIndex, query string) string {
+	hits, err := idx.Search(query, 100)
+	checkErr(err, t)
+
+	var names []string
+	for _, hit := range hits {
+		names = append(names, hit.Name)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+func TestEmbeddedIndex_Search(t *testing.T) {
+	idx, _ := openTestIndex(t)
+	checkErr(idx.Index([]IndexedTorrent{
+		indexedTorrent(1, "Ubuntu 18.04 Desktop", "ubuntu-18.04-desktop-amd64.iso"),
+		indexedTorrent(2, "The Show Season 1", "The Show/S01E01 Pilot.mkv", "The Show/S01E02 Desktop.mkv"),
+		indexedTorrent(3, "Debian netinst", "debian-9.4.0-amd64-netinst.iso"),
+	}), t)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"ubuntu", "[Ubuntu 18.04 Desktop]"},
+		{"DESKTOP", "[The Show Season 1 Ubuntu 18.04 Desktop]"},
+		{"name:desktop", "[Ubuntu 18.04 Desktop]"},
+		{"path:desktop -ubuntu", "[The Show Season 1]"},
+		{"pilot", "[The Show Season 1]"},
+		{"\"s01e02 desktop\"", "[The Show Season 1]"},
+		// The phrases do not match across the files.
+		{"\"pilot the show\"", "[]"},
+		{"amd64", "[Debian netinst Ubuntu 18.04 Desktop]"},
+		{"9.4.0", "[Debian netinst]"},
+		{"net*", "[Debian netinst]"},
+		{"path:s01e*", "[The Show Season 1]"},
+		{"debien~", "[Debian netinst]"},
+		{"debien~0", "[]"},
+		{"ubnutu~2 desktop", "[Ubuntu 18.04 Desktop]"},
+		{"fedora", "[]"},
+	}
+	for _, test := range tests {
+		if names := searchNames(t, idx, test.query); names != test.expected {
+			t.Errorf("expected the torrents matching %q to be %s, got %s", test.query, test.expected, names)
+		}
+	}
+
+	// The names count more than the file paths.
+	hits, err := idx.Search("desktop", 1)
+	checkErr(err, t)
+	if len(hits) != 1 || hits[0].ID != 1 || hits[0].Score <= 0 {
+		t.Errorf("expected the most relevant torrent to be #1. Got: %+v", hits)
+	}
+}
+
+func TestEmbeddedIndex_InvalidQueries(t *testing.T) {
+	idx, _ := openTestIndex(t)
+
+	for _, query := range []string{"", "-ubuntu", "\"ubuntu desktop", "name:", "...", "ubuntu~3", "ubuntu-desktop*"} {
+		if _, err := idx.Search(query, 10); err == nil {
+			t.Errorf("expected an error for the query %q", query)
+		}
+	}
+}
+
+func TestEmbeddedIndex_Reindex(t *testing.T) {
+	idx, _ := openTestIndex(t)
+	checkErr(idx.Index([]IndexedTorrent{indexedTorrent(1, "old name")}), t)
+	checkErr(idx.Index([]IndexedTorrent{indexedTorrent(1, "new name")}), t)
+
+	if names := searchNames(t, idx, "name"); names != "[new name]" {
+		t.Errorf("expected the torrent to be replaced, got %s", names)
+	}
+	if names := searchNames(t, idx, "old"); names != "[]" {
+		t.Errorf("expected the old name not to match, got %s", names)
+	}
+}
+
+func TestEmbeddedIndex_Persistence(t *testing.T) {
+	writer, indexPath := openTestIndex(t)
+	checkErr(writer.Index([]IndexedTorrent{indexedTorrent(1, "ubuntu")}), t)
+
+	reader, err := makeEmbeddedIndex(indexPath)
+	checkErr(err, t)
+	defer reader.Close()
+	if names := searchNames(t, reader, "ubuntu"); names != "[ubuntu]" {
+		t.Errorf("expected the torrent to be loaded, got %s", names)
+	}
+
+	// The torrents indexed by the writer afterwards are loaded by the reader too, except for the
+	// incomplete ones.
+	checkErr(writer.Index([]IndexedTorrent{indexedTorrent(2, "debian")}), t)
+	file, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0644)
+	checkErr(err, t)
+	_, err = file.WriteString(`{"ID": 3, "Name": "fedo`)
+	file.Close()
+	checkErr(err, t)
+
+	if names := searchNames(t, reader, "debian"); names != "[debian]" {
+		t.Errorf("expected the new torrent to be loaded, got %s", names)
+	}
+
+	// The incomplete entry is skipped once another one is appended.
+	checkErr(writer.Index([]IndexedTorrent{indexedTorrent(4, "fedora")}), t)
+	if names := searchNames(t, reader, "fedora"); names != "[fedora]" {
+		t.Errorf("expected the torrent after the incomplete one to be loaded, got %s", names)
+	}
+}
+
+func TestWithinEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		max      int
+		expected bool
+	}{
+		{"ubuntu", "ubuntu", 0, true},
+		{"ubuntu", "ubunto", 1, true},
+		{"ubuntu", "ubnutu", 1, false},
+		{"ubuntu", "ubnutu", 2, true},
+		{"ubuntu", "ubuntu1804", 2, false},
+		{"über", "uber", 1, true},
+	}
+	for _, test := range tests {
+		if withinEditDistance(test.a, test.b, test.max) != test.expected {
+			t.Errorf("expected withinEditDistance(%q, %q, %d) to be %t", test.a, test.b, test.max, test.expected)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package persistence
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// IsTransient reports whether the error returned by a Database (or a SearchIndex) is (probably)
+// temporary, such that retrying the same operation later might succeed; e.g. when the SQLite
+// database is locked by another process (such as magneticow), when the connection to the
+// PostgreSQL or MySQL server is lost, or when Elasticsearch is overloaded.
+//
+// All the other errors are considered permanent, which would occur again if the operation was
+// retried (e.g. constraint violations, invalid data, or a corrupt database).
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var esErr *elasticsearchError
+	if errors.As(err, &esErr) {
+		return esErr.transient()
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"40", // transaction rollback (e.g. serialization failure, or deadlock)
+			"53", // insufficient resources (e.g. too many connections)
+			"57": // operator intervention (e.g. the server is shutting down)
+			return true
+		}
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1040, // too many connections
+			1053, // the server is shutting down
+			1205, // lock wait timeout
+			1213: // deadlock
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,44 @@
+package persistence
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{errors.New("something"), false},
+		{driver.ErrBadConn, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, true},
+		{sqlite3.Error{Code: sqlite3.ErrCorrupt}, false},
+		{&pq.Error{Code: "08006"}, true},                                             // connection_failure
+		{&pq.Error{Code: "40P01"}, true},                                             // deadlock_detected
+		{&pq.Error{Code: "23505"}, false},                                            // unique_violation
+		{fmt.Errorf("could not insert torrent: %w", &pq.Error{Code: "57P01"}), true}, // admin_shutdown
+		{mysql.ErrInvalidConn, true},
+		{&mysql.MySQLError{Number: 1213}, true},  // ER_LOCK_DEADLOCK
+		{&mysql.MySQLError{Number: 1062}, false}, // ER_DUP_ENTRY
+		{&elasticsearchError{StatusCode: 429}, true},
+		{fmt.Errorf("could not index the torrents: %w", &elasticsearchError{StatusCode: 503}), true},
+		{&elasticsearchError{StatusCode: 400}, false},
+	}
+
+	for i, test := range tests {
+		if transient := IsTransient(test.err); transient != test.transient {
+			t.Errorf("#%d: expected IsTransient(%v) to be %t", i, test.err, test.transient)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package persistence
+
+import (
+	"database/sql"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// HIGHLIGHT_START and HIGHLIGHT_END enclose the highlighted fragments of the texts returned by the
+// highlighting functions of the databases (e.g. highlight() of SQLite), which are control characters
+// so that they can be told apart from the texts.
+const (
+	HIGHLIGHT_START = "\x01"
+	HIGHLIGHT_END   = "\x02"
+)
+
+// HIGHLIGHT_MAX_SUFFIX is the maximum number of the letters that a word may have after a word of the
+// query for it to be highlighted by highlightWords, so that the inflections (e.g. "episodes" for
+// "episode") that match the query when the words are stemmed are highlighted too.
+const HIGHLIGHT_MAX_SUFFIX = 2
+
+// parseHighlights splits the text (that is highlighted by a database) into its fragments.
+func parseHighlights(text string) MatchedFile {
+	var file MatchedFile
+	highlighted := false
+	for text != "" {
+		end := strings.Index(text, HIGHLIGHT_START)
+		if highlighted {
+			end = strings.Index(text, HIGHLIGHT_END)
+		}
+		if end == -1 {
+			end = len(text)
+		}
+
+		if end > 0 {
+			file.Fragments = append(file.Fragments, Fragment{Text: text[:end], Highlighted: highlighted})
+			file.Path += text[:end]
+		}
+		text = text[end:]
+		if text != "" {
+			text = text[1:]
+		}
+		highlighted = !highlighted
+	}
+	return file
+}
+
+// highlightWords highlights the words of the path that are (or that start with) the words of the
+// query, for the databases that cannot highlight the texts themselves.
+func highlightWords(path string, query string) MatchedFile {
+	words := analyze(query)
+	file := MatchedFile{Path: path}
+
+	isSeparator := func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }
+	for path != "" {
+		// The separators, followed by the next word.
+		separators := strings.IndexFunc(path, func(r rune) bool { return !isSeparator(r) })
+		if separators == -1 {
+			separators = len(path)
+		}
+		if separators > 0 {
+			file.addFragment(path[:separators], false)
+			path = path[separators:]
+		}
+		if path == "" {
+			break
+		}
+
+		end := strings.IndexFunc(path, isSeparator)
+		if end == -1 {
+			end = len(path)
+		}
+		word := strings.ToLower(path[:end])
+		highlighted := false
+		for _, queryWord := range words {
+			if strings.HasPrefix(word, queryWord) &&
+				utf8.RuneCountInString(word)-utf8.RuneCountInString(queryWord) <= HIGHLIGHT_MAX_SUFFIX {
+				highlighted = true
+				break
+			}
+		}
+		file.addFragment(path[:end], highlighted)
+		path = path[end:]
+	}
+	return file
+}
+
+// addFragment appends the text to the last fragment if they are both highlighted or not.
+func (file *MatchedFile) addFragment(text string, highlighted bool) {
+	if n := len(file.Fragments); n > 0 && file.Fragments[n-1].Highlighted == highlighted {
+		file.Fragments[n-1].Text += text
+		return
+	}
+	file.Fragments = append(file.Fragments, Fragment{Text: text, Highlighted: highlighted})
+}
+
+// addMatchedFiles adds the files in the rows (of the IDs of the torrents and the paths of the files,
+// in order) to the torrents, at most MAX_MATCHED_FILES for each, where the paths are highlighted by
+// @highlight.
+func addMatchedFiles(torrents []TorrentMetadata, rows *sql.Rows, highlight func(path string) MatchedFile) error {
+	byID := make(map[uint]*TorrentMetadata, len(torrents))
+	for i := range torrents {
+		byID[torrents[i].ID] = &torrents[i]
+	}
+
+	for rows.Next() {
+		var torrentID uint
+		var path string
+		if err := rows.Scan(&torrentID, &path); err != nil {
+			rows.Close()
+			return err
+		}
+		if torrent, exists := byID[torrentID]; exists && len(torrent.MatchedFiles) < MAX_MATCHED_FILES {
+			torrent.MatchedFiles = append(torrent.MatchedFiles, highlight(path))
+		}
+	}
+
+	return rows.Close()
+}
+
+// torrentIDs returns the IDs of the torrents, as the arguments of a query.
+func torrentIDs(torrents []TorrentMetadata) []interface{} {
+	ids := make([]interface{}, len(torrents))
+	for i, torrent := range torrents {
+		ids[i] = torrent.ID
+	}
+	return ids
+}
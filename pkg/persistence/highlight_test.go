@@ -0,0 +1,62 @@
+package persistence
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHighlights(t *testing.T) {
+	tests := []struct {
+		text      string
+		fragments []Fragment
+	}{
+		{"plain.txt", []Fragment{{Text: "plain.txt"}}},
+		{"\x01Sample\x02.mkv", []Fragment{{Text: "Sample", Highlighted: true}, {Text: ".mkv"}}},
+		{"a/\x01b\x02/\x01c\x02", []Fragment{{Text: "a/"}, {Text: "b", Highlighted: true}, {Text: "/"},
+			{Text: "c", Highlighted: true}}},
+		// The highlights that are not closed extend to the end.
+		{"a \x01b", []Fragment{{Text: "a "}, {Text: "b", Highlighted: true}}},
+	}
+
+	for _, test := range tests {
+		file := parseHighlights(test.text)
+		if !reflect.DeepEqual(file.Fragments, test.fragments) {
+			t.Errorf("expected the fragments of %q to be %+v, got %+v", test.text, test.fragments, file.Fragments)
+		}
+		if expected := fragmentsText(test.fragments); file.Path != expected {
+			t.Errorf("expected the path of %q to be %q, got %q", test.text, expected, file.Path)
+		}
+	}
+}
+
+func TestHighlightWords(t *testing.T) {
+	tests := []struct {
+		path      string
+		query     string
+		fragments []Fragment
+	}{
+		{"Season 1/Sample.mkv", "sample", []Fragment{{Text: "Season 1/"}, {Text: "Sample", Highlighted: true},
+			{Text: ".mkv"}}},
+		{"Episodes/Episode 01.mkv", "+episode", []Fragment{{Text: "Episodes", Highlighted: true}, {Text: "/"},
+			{Text: "Episode", Highlighted: true}, {Text: " 01.mkv"}}},
+		// The words that are much longer than the words of the query are not highlighted.
+		{"Samplerate.txt", "sample", []Fragment{{Text: "Samplerate.txt"}}},
+		{"a b", "a b", []Fragment{{Text: "a", Highlighted: true}, {Text: " "}, {Text: "b", Highlighted: true}}},
+	}
+
+	for _, test := range tests {
+		file := highlightWords(test.path, test.query)
+		if file.Path != test.path || !reflect.DeepEqual(file.Fragments, test.fragments) {
+			t.Errorf("expected the fragments of %q for %q to be %+v, got %+v", test.path, test.query,
+				test.fragments, file)
+		}
+	}
+}
+
+func fragmentsText(fragments []Fragment) string {
+	var text string
+	for _, fragment := range fragments {
+		text += fragment.Text
+	}
+	return text
+}
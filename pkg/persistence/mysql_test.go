@@ -0,0 +1,71 @@
+package persistence
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMySQLDSN(t *testing.T) {
+	tests := []struct {
+		url string
+		dsn string
+	}{
+		{"mysql://localhost/magnetico", "tcp(localhost:3306)/magnetico"},
+		{"mysql://magnetico:secret@db:3307/magnetico?timeout=5s", "magnetico:secret@tcp(db:3307)/magnetico?timeout=5s"},
+	}
+
+	for _, test := range tests {
+		dbURL, err := url.Parse(test.url)
+		checkErr(err, t)
+
+		dsn, err := mysqlDSN(dbURL)
+		if err != nil {
+			t.Errorf("mysqlDSN(%q) returned an error: %s", test.url, err.Error())
+		} else if dsn != test.dsn {
+			t.Errorf("expected mysqlDSN(%q) to be %q, got %q", test.url, test.dsn, dsn)
+		}
+	}
+
+	if _, err := mysqlDSN(&url.URL{Scheme: "mysql", Host: "localhost", Path: "/magnetico", RawQuery: "timeout=forever"}); err == nil {
+		t.Error("expected mysqlDSN to reject invalid parameters")
+	}
+}
+
+func TestMySQLBooleanQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		boolean string
+	}{
+		{"ubuntu desktop", "+ubuntu +desktop"},
+		{"The Lord of the Rings", "+Lord +Rings"},
+		{"-ubuntu* \"desktop\" (amd64)", "+ubuntu +desktop +amd64"},
+		{"a to z", ""},
+		{"Über_Film 1080p", "+Über_Film +1080p"},
+	}
+
+	for _, test := range tests {
+		if boolean := mysqlBooleanQuery(test.query); boolean != test.boolean {
+			t.Errorf("expected mysqlBooleanQuery(%q) to be %q, got %q", test.query, test.boolean, boolean)
+		}
+	}
+}
+
+func TestMySQLSearchQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		boolean string
+	}{
+		{"ubuntu -cam", "+ubuntu -cam"},
+		{`"The Lord of the Rings" -"low quality"`, `+"Lord Rings" -"low quality"`},
+		{"to -cam", ""},
+		{"ubuntu size:>1GB", "+ubuntu"},
+	}
+
+	for _, test := range tests {
+		q, err := ParseSearchQuery(test.query)
+		checkErr(err, t)
+		if boolean := mysqlSearchQuery(q); boolean != test.boolean {
+			t.Errorf("expected mysqlSearchQuery(%q) to be %q, got %q", test.query, test.boolean, boolean)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"net/url"
+	"strings"
+	"text/template"
 	"time"
 	"unicode/utf8"
 
@@ -44,7 +46,11 @@ func (db *postgresDatabase) Engine() databaseEngine {
 }
 
 func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = $1::BYTEA;", infoHash)
+	// A hybrid torrent exists by its truncated v2 infohash too.
+	low, high := infoHashV2Range(infoHash)
+	rows, err := db.conn.Query(`
+		SELECT 1 FROM torrents WHERE info_hash = $1::BYTEA OR info_hash_v2 BETWEEN $2::BYTEA AND $3::BYTEA;`,
+		infoHash, low, high)
 	if err != nil {
 		return false, err
 	}
@@ -53,7 +59,7 @@ func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
 	// return false.
 	exists := rows.Next()
 	if !exists && rows.Err() != nil {
-		return false, err
+		return false, rows.Err()
 	}
 
 	if err = rows.Close(); err != nil {
@@ -63,7 +69,16 @@ func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []File, info InfoMetadata) error {
+	return db.AddNewTorrents([]NewTorrent{{
+		InfoHash:     infoHash,
+		Name:         name,
+		Files:        files,
+		InfoMetadata: info,
+	}})
+}
+
+func (db *postgresDatabase) AddNewTorrents(torrents []NewTorrent) error {
 	tx, err := db.conn.Begin()
 	if err != nil {
 		return err
@@ -71,9 +86,25 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 
 	defer tx.Rollback()
 
+	for _, torrent := range torrents {
+		if err = postgresAddNewTorrent(tx, torrent); err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func postgresAddNewTorrent(tx *sql.Tx, torrent NewTorrent) error {
 	var totalSize uint64
-	for _, files := range files {
-		totalSize += files.Size
+	for _, file := range torrent.Files {
+		if !file.IsPadding() {
+			totalSize += file.Size
+		}
 	}
 
 	if totalSize == 0 {
@@ -81,31 +112,43 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 	}
 
 	var lastInsertId int64
+	name := torrent.Name
 	// we will insert the name as tsvector for easier searching and split on word boundaries
-	err = tx.QueryRow(`
+	err := tx.QueryRow(`
 		INSERT INTO torrents (
 			info_hash,
 			name,
 			total_size,
 			discovered_on,
-			search
-		) VALUES ($1::BYTEA, $2::VARCHAR, $3, $4::TIMESTAMP, to_tsvector(regexp_replace(coalesce($2::VARCHAR, ''), '[^\w]+', ' ', 'gi')))
+			search,
+			piece_length,
+			n_pieces,
+			private,
+			source,
+			info_hash_v2
+		) VALUES ($1::BYTEA, $2::VARCHAR, $3, $4::TIMESTAMP, to_tsvector(regexp_replace(coalesce($2::VARCHAR, ''), '[^\w]+', ' ', 'gi')), $5, $6, $7, $8, $9::BYTEA)
 		ON CONFLICT
 		DO NOTHING
 		RETURNING id;
-	`, infoHash, fixUTF8Encoding(name), totalSize, time.Now()).Scan(&lastInsertId)
-	if err != nil {
-		return fmt.Errorf("could not insert torrent with name %s and bytes % x %s", name, name, err.Error())
+	`, torrent.InfoHash, fixUTF8Encoding(name), totalSize, time.Now().UTC(), torrent.PieceLength, torrent.NPieces,
+		torrent.Private, nullIfEmpty(fixUTF8Encoding(torrent.Source)), torrent.InfoHashV2).Scan(&lastInsertId)
+	// No rows are returned if the torrent already exists (e.g. a hybrid torrent that is fetched
+	// by both of its infohashes at the same time), which is not an error.
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not insert torrent with name %s and bytes % x %w", name, name, err)
 	}
 
-	stmt, err := tx.Prepare(pq.CopyIn("files", "torrent_id", "size", "path"))
+	stmt, err := tx.Prepare(pq.CopyIn("files", "torrent_id", "size", "path", "attributes", "symlink_path"))
 	if err != nil {
 		return err
 	}
-	for _, file := range files {
-		_, err := stmt.Exec(lastInsertId, file.Size, fixUTF8Encoding(file.Path))
+	for _, file := range torrent.Files {
+		_, err := stmt.Exec(lastInsertId, file.Size, fixUTF8Encoding(file.Path), nullIfEmpty(file.Attributes),
+			nullIfEmpty(fixUTF8Encoding(file.SymlinkPath)))
 		if err != nil {
-			return fmt.Errorf("couldn't insert file with path %s and bytes % x %s", file.Path, file.Path, err.Error())
+			return fmt.Errorf("couldn't insert file with path %s and bytes % x %w", file.Path, file.Path, err)
 		}
 	}
 	_, err = stmt.Exec()
@@ -117,11 +160,51 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 		return err
 	}
 
-	err = tx.Commit()
+	if torrent.Info != nil {
+		if err = postgresAddInfoDictionary(tx, torrent.InfoHash, torrent.Info); err != nil {
+			return err
+		}
+	}
+	if torrent.Readme != nil {
+		if err = postgresAddReadme(tx, torrent.InfoHash, torrent.Readme.Path, torrent.Readme.Content); err != nil {
+			return err
+		}
+	}
+	if torrent.MediaInfo != nil {
+		if err = postgresAddMediaInfo(tx, torrent.InfoHash, *torrent.MediaInfo); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) IterateInfoHashes(fn func(infoHash []byte) error) error {
+	rows, err := db.conn.Query("SELECT info_hash FROM torrents;")
 	if err != nil {
 		return err
 	}
-	return nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var infoHash []byte
+		if err = rows.Scan(&infoHash); err != nil {
+			return err
+		}
+		if err = fn(infoHash); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return rows.Close()
+}
+
+func (db *postgresDatabase) Ping() error {
+	return db.conn.Ping()
 }
 
 func (db *postgresDatabase) Close() error {
@@ -129,13 +212,13 @@ func (db *postgresDatabase) Close() error {
 }
 
 func (db *postgresDatabase) GetNumberOfTorrents() (uint, error) {
-	rows, err := db.conn.Query("SELECT MAX(ctid) FROM torrents;")
+	rows, err := db.conn.Query("SELECT COUNT(1) FROM torrents;")
 	if err != nil {
 		return 0, err
 	}
 
 	if rows.Next() != true {
-		fmt.Errorf("No rows returned from `SELECT MAX(ctid)`!")
+		return 0, fmt.Errorf("No rows returned from `SELECT COUNT(1)`")
 	}
 
 	var n uint
@@ -151,7 +234,7 @@ func (db *postgresDatabase) GetNumberOfTorrents() (uint, error) {
 }
 
 func (db *postgresDatabase) GetTotalSizeOfTorrents() (uint64, error) {
-	rows, err := db.conn.Query("SELECT SUM(total_size) FROM torrents;")
+	rows, err := db.conn.Query("SELECT COALESCE(SUM(total_size), 0) FROM torrents;")
 	if err != nil {
 		return 0, err
 	}
@@ -174,6 +257,8 @@ func (db *postgresDatabase) GetTotalSizeOfTorrents() (uint64, error) {
 
 func (db *postgresDatabase) QueryTorrents(
 	query string,
+	mode SearchMode,
+	filter TorrentFilter,
 	epoch int64,
 	orderBy OrderingCriteria,
 	ascending bool,
@@ -182,26 +267,249 @@ func (db *postgresDatabase) QueryTorrents(
 	lastID uint64,
 	backward bool,
 ) ([]TorrentMetadata, error) {
-	if query == "" && orderBy == ByRelevance {
-		return nil, fmt.Errorf("torrents cannot be ordered by \"relevance\" when the query is empty")
+	q, err := ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	q.restrict(filter)
+	if len(q.Terms) == 0 && orderBy == ByRelevance {
+		return nil, fmt.Errorf("torrents cannot be ordered by relevance when the query is empty")
+	}
+	if (lastOrderedValue == 0) != (lastID == 0) {
+		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
+	}
+	if orderBy == ByNSeeders || orderBy == ByNLeechers {
+		return nil, fmt.Errorf("torrents cannot be ordered by the number of seeders or leechers yet")
+	}
+
+	doJoin := len(q.Terms) != 0
+	firstPage := lastID == 0
+
+	// Unlike SQLite, the placeholders of PostgreSQL are numbered, so they are numbered in the order
+	// the arguments are first used by the template; the same argument can be used more than once.
+	var queryArgs []interface{}
+	bind := func(arg interface{}) string {
+		queryArgs = append(queryArgs, arg)
+		return fmt.Sprintf("$%d", len(queryArgs))
+	}
+	tsquery := postgresTSQuery(q, bind)
+	placeholders := make(map[string]string)
+	args := map[string]interface{}{
+		"epoch":            epoch,
+		"lastID":           lastID,
+		"lastOrderedValue": lastOrderedValue,
+		"limit":            limit,
+	}
+
+	// The torrents are selected in a subquery so that the computed columns (which, as in SQLite,
+	// are the Unix time discovered_on, n_files, and rank) can be used for the keyset pagination.
+	// discovered_on is stored in UTC.
+	//
+	// ts_rank is negated so that, like bm25 of SQLite, the more relevant a torrent is the lower its
+	// rank is. When the files are searched too, a torrent is as relevant as its most relevant match.
+	sqlQuery := executeTemplate(`
+		SELECT id
+			 , info_hash
+			 , name
+			 , total_size
+			 , discovered_on
+			 , n_files
+			 , info_hash_v2
+		FROM (
+			SELECT id
+				 , info_hash
+				 , name
+				 , total_size
+				 , extract(epoch FROM discovered_on)::BIGINT AS discovered_on
+				 , `+postgresNFiles+` AS n_files
+				 , info_hash_v2
+			{{ if and .DoJoin .SearchFiles }}
+				 , -GREATEST(
+					ts_rank(torrents.search, {{ tsquery }}),
+					(SELECT COALESCE(MAX(ts_rank(files.search, {{ tsquery }})), 0) FROM files WHERE files.torrent_id = torrents.id AND files.search @@ {{ tsquery }})
+				   ) AS rank
+			{{ else if .DoJoin }}
+				 , -ts_rank(search, {{ tsquery }}) AS rank
+			{{ end }}
+			FROM torrents
+			WHERE discovered_on <= to_timestamp({{ arg "epoch" }}) AT TIME ZONE 'UTC'
+			{{ filters }}
+			{{ if and .DoJoin .SearchFiles }}
+			  AND (
+				torrents.search @@ {{ tsquery }} OR
+				id IN (SELECT torrent_id FROM files WHERE files.search @@ {{ tsquery }})
+				)
+			{{ else if .DoJoin }}
+			  AND search @@ {{ tsquery }}
+			{{ end }}
+		) AS torrents
+	{{ if not .FirstPage }}
+		{{ if .Forward }}
+		WHERE (
+			(id > {{ arg "lastID" }} AND {{ .OrderOn }} = {{ arg "lastOrderedValue" }}) OR
+			({{ .OrderOn }} {{ GTEorLTE .GTELTE }} {{ arg "lastOrderedValue" }})
+			)
+		{{ else }}
+		WHERE (
+			(id < {{ arg "lastID" }} AND {{ .OrderOn }} = {{ arg "lastOrderedValue" }}) OR
+			({{ .OrderOn }} {{ GTEorLTE .GTELTE }} {{ arg "lastOrderedValue" }})
+			)
+		{{ end }}
+	{{ end }}
+		ORDER BY {{ .OrderOn }} {{ AscOrDesc .GTELTE }}, id ASC
+		LIMIT {{ arg "limit" }};
+	`, queryTD{
+		DoJoin:      doJoin,
+		SearchFiles: mode == SearchFiles,
+		FirstPage:   firstPage,
+		OrderOn:     postgresOrderOn(orderBy),
+		Ascending:   ascending,
+		GTELTE:      ascending != backward,
+		Forward:     !backward,
+	}, template.FuncMap{
+		"arg": func(name string) string {
+			if _, ok := placeholders[name]; !ok {
+				placeholders[name] = bind(args[name])
+			}
+			return placeholders[name]
+		},
+		"tsquery": func() string { return tsquery },
+		"filters": func() string {
+			return q.sqlPredicates(bind, postgresNFiles, func(unixTime string) string {
+				return "to_timestamp(" + unixTime + ") AT TIME ZONE 'UTC'"
+			})
+		},
+		"GTEorLTE": func(ascending bool) string {
+			if ascending {
+				return ">"
+			} else {
+				return "<"
+			}
+		},
+		"AscOrDesc": func(ascending bool) string {
+			if ascending {
+				return "ASC"
+			} else {
+				return "DESC"
+			}
+		},
+	})
+
+	rows, err := db.conn.Query(sqlQuery, queryArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("error while querying torrents: %s", err.Error())
+	}
+
+	var torrents []TorrentMetadata
+	for rows.Next() {
+		var torrent TorrentMetadata
+		if err = rows.Scan(&torrent.ID, &torrent.InfoHash, &torrent.Name, &torrent.Size, &torrent.DiscoveredOn, &torrent.NFiles, &torrent.InfoHashV2); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, torrent)
+	}
+
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	if doJoin && mode == SearchFiles && len(torrents) != 0 {
+		queryArgs = nil
+		tsquery := postgresTSQuery(q, bind)
+		placeholders := make([]string, len(torrents))
+		for i, id := range torrentIDs(torrents) {
+			placeholders[i] = bind(id)
+		}
+		rows, err = db.conn.Query(`
+			SELECT torrent_id, path
+			FROM files
+			WHERE search @@ `+tsquery+`
+			  AND torrent_id IN (`+strings.Join(placeholders, ", ")+`)
+			ORDER BY torrent_id, id;`, queryArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("error while querying the matching files: %s", err.Error())
+		}
+		err = addMatchedFiles(torrents, rows, func(path string) MatchedFile {
+			return highlightWords(path, q.includedText())
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// TODO
-	var metadata []TorrentMetadata
+	return torrents, nil
+}
 
-	return metadata, nil
+// postgresNFiles is the number of the (non-padding) files of a torrent, in the queries of the
+// torrents.
+const postgresNFiles = "(SELECT COUNT(1) FROM files WHERE torrents.id = files.torrent_id AND (attributes IS NULL OR strpos(attributes, 'p') = 0))"
+
+// postgresTSQuery returns the expression of the tsquery of the words and the phrases of the query,
+// where @bind returns the placeholder of an argument; each of them is an argument of its own so
+// that none of them is parsed as the syntax of the tsqueries.
+func postgresTSQuery(q SearchQuery, bind func(interface{}) string) string {
+	var words []string
+	var tsqueries []string
+	for _, term := range q.Terms {
+		switch {
+		case term.Excluded && term.Phrase:
+			tsqueries = append(tsqueries, "!!phraseto_tsquery("+bind(term.Text)+")")
+		case term.Excluded:
+			tsqueries = append(tsqueries, "!!plainto_tsquery("+bind(term.Text)+")")
+		case term.Phrase:
+			tsqueries = append(tsqueries, "phraseto_tsquery("+bind(term.Text)+")")
+		default:
+			words = append(words, term.Text)
+		}
+	}
+	if len(words) != 0 {
+		tsqueries = append([]string{"plainto_tsquery(" + bind(strings.Join(words, " ")) + ")"}, tsqueries...)
+	}
+	return "(" + strings.Join(tsqueries, " && ") + ")"
+}
+
+func postgresOrderOn(orderBy OrderingCriteria) string {
+	switch orderBy {
+	case ByRelevance:
+		return "rank"
+
+	case BySize:
+		return "total_size"
+
+	case ByDiscoveredOn:
+		return "discovered_on"
+
+	case ByNFiles:
+		return "n_files"
+
+	default:
+		panic(fmt.Sprintf("unknown orderBy: %v", orderBy))
+	}
 }
 
 func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
+	column := "info_hash"
+	if len(infoHash) == 32 {
+		column = "info_hash_v2"
+	}
+
 	rows, err := db.conn.Query(
-		`SELECT 
+		`SELECT
+			id,
 			info_hash,
 			name,
 			total_size,
-			discovered_on,
-			(SELECT COUNT(1) FROM files WHERE torrent_id = torrents.id) AS n_files
+			extract(epoch FROM discovered_on)::BIGINT,
+			(SELECT COUNT(1) FROM files WHERE torrent_id = torrents.id AND (attributes IS NULL OR strpos(attributes, 'p') = 0)) AS n_files,
+			COALESCE(piece_length, 0),
+			COALESCE(n_pieces, 0),
+			COALESCE(private, FALSE),
+			COALESCE(source, ''),
+			info_hash_v2,
+			COALESCE(last_seen_on, 0),
+			n_announces
 		FROM torrents
-		WHERE info_hash = $1::BYTEA;`,
+		WHERE `+column+` = $1::BYTEA;`,
 		infoHash,
 	)
 	if err != nil {
@@ -209,12 +517,15 @@ func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error
 	}
 
 	if rows.Next() != true {
-		zap.L().Warn("torrent not found")
-		return nil, nil
+		return nil, rows.Close()
 	}
 
 	var tm TorrentMetadata
-	rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles)
+	if err = rows.Scan(&tm.ID, &tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles, &tm.PieceLength,
+		&tm.NPieces, &tm.Private, &tm.Source, &tm.InfoHashV2, &tm.LastSeenOn, &tm.NAnnounces); err != nil {
+		return nil, err
+	}
+
 	if err = rows.Close(); err != nil {
 		return nil, err
 	}
@@ -224,9 +535,12 @@ func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error
 
 func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 	rows, err := db.conn.Query(`
-		SELECT size, path
+		SELECT size, path, COALESCE(attributes, ''), COALESCE(symlink_path, '')
 		FROM files
-		WHERE torrent_id = $1;`,
+		INNER JOIN torrents
+		ON files.torrent_id = torrents.id
+		WHERE torrents.info_hash = $1::BYTEA
+		ORDER BY files.id;`,
 		infoHash)
 	if err != nil {
 		return nil, err
@@ -235,17 +549,366 @@ func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 	var files []File
 	for rows.Next() {
 		var file File
-		rows.Scan(&file.Size, &file.Path)
+		if err = rows.Scan(&file.Size, &file.Path, &file.Attributes, &file.SymlinkPath); err != nil {
+			return nil, err
+		}
 		files = append(files, file)
 	}
 
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
 	return files, nil
 }
 
-func (db *postgresDatabase) GetStatistics(n uint, to string) (*Statistics, error) {
-	// TODO
-	var stats *Statistics
-	return stats, nil
+func (db *postgresDatabase) AddInfoDictionary(infoHash []byte, info []byte) error {
+	return postgresAddInfoDictionary(db.conn, infoHash, info)
+}
+
+func postgresAddInfoDictionary(conn execer, infoHash []byte, info []byte) error {
+	compressed, err := compress(info)
+	if err != nil {
+		return fmt.Errorf("could not compress info dictionary: %s", err.Error())
+	}
+
+	_, err = conn.Exec(`
+		INSERT INTO info_dictionaries (torrent_id, info)
+		SELECT id, $1::BYTEA
+		FROM torrents
+		WHERE info_hash = $2::BYTEA
+		ON CONFLICT (torrent_id)
+		DO UPDATE SET info = EXCLUDED.info;
+	`, compressed, infoHash)
+	return err
+}
+
+func (db *postgresDatabase) GetInfoDictionary(infoHash []byte) ([]byte, error) {
+	rows, err := db.conn.Query(`
+		SELECT info
+		FROM info_dictionaries
+		INNER JOIN torrents
+		ON info_dictionaries.torrent_id = torrents.id
+		WHERE torrents.info_hash = $1::BYTEA;`,
+		infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() != true {
+		return nil, rows.Close()
+	}
+
+	var compressed []byte
+	if err = rows.Scan(&compressed); err != nil {
+		return nil, err
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return decompress(compressed)
+}
+
+func (db *postgresDatabase) AddReadme(infoHash []byte, path string, content string) error {
+	return postgresAddReadme(db.conn, infoHash, path, content)
+}
+
+func postgresAddReadme(conn execer, infoHash []byte, path string, content string) error {
+	_, err := conn.Exec(`
+		UPDATE files
+		SET is_readme = TRUE, content = $1
+		WHERE path = $2 AND torrent_id = (SELECT id FROM torrents WHERE info_hash = $3::BYTEA);
+	`, fixUTF8Encoding(content), fixUTF8Encoding(path), infoHash)
+	return err
+}
+
+func (db *postgresDatabase) GetReadme(infoHash []byte) (*Readme, error) {
+	rows, err := db.conn.Query(`
+		SELECT path, content
+		FROM files
+		INNER JOIN torrents
+		ON files.torrent_id = torrents.id
+		WHERE torrents.info_hash = $1::BYTEA AND files.is_readme IS TRUE;`,
+		infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() != true {
+		return nil, rows.Close()
+	}
+
+	var readme Readme
+	if err = rows.Scan(&readme.Path, &readme.Content); err != nil {
+		return nil, err
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return &readme, nil
+}
+
+func (db *postgresDatabase) AddMediaInfo(infoHash []byte, mediaInfo MediaInfo) error {
+	return postgresAddMediaInfo(db.conn, infoHash, mediaInfo)
+}
+
+func postgresAddMediaInfo(conn execer, infoHash []byte, mediaInfo MediaInfo) error {
+	_, err := conn.Exec(`
+		INSERT INTO media_info (torrent_id, path, format, duration, width, height, video_codec, audio_codec)
+		SELECT id, $1, $2, $3, $4, $5, $6, $7
+		FROM torrents
+		WHERE info_hash = $8::BYTEA
+		ON CONFLICT (torrent_id)
+		DO UPDATE SET
+			path = EXCLUDED.path,
+			format = EXCLUDED.format,
+			duration = EXCLUDED.duration,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			video_codec = EXCLUDED.video_codec,
+			audio_codec = EXCLUDED.audio_codec;
+	`, fixUTF8Encoding(mediaInfo.Path), mediaInfo.Format, mediaInfo.Duration, mediaInfo.Width, mediaInfo.Height,
+		nullIfEmpty(fixUTF8Encoding(mediaInfo.VideoCodec)), nullIfEmpty(fixUTF8Encoding(mediaInfo.AudioCodec)), infoHash)
+	return err
+}
+
+func (db *postgresDatabase) GetMediaInfo(infoHash []byte) (*MediaInfo, error) {
+	rows, err := db.conn.Query(`
+		SELECT
+			path,
+			format,
+			COALESCE(duration, 0),
+			COALESCE(width, 0),
+			COALESCE(height, 0),
+			COALESCE(video_codec, ''),
+			COALESCE(audio_codec, '')
+		FROM media_info
+		INNER JOIN torrents
+		ON media_info.torrent_id = torrents.id
+		WHERE torrents.info_hash = $1::BYTEA;`,
+		infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() != true {
+		return nil, rows.Close()
+	}
+
+	var mi MediaInfo
+	err = rows.Scan(&mi.Path, &mi.Format, &mi.Duration, &mi.Width, &mi.Height, &mi.VideoCodec, &mi.AudioCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return &mi, nil
+}
+
+func (db *postgresDatabase) AddPeerStatistics(stats PeerStatistics) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored, err := storedPeerNames(tx)
+	if err != nil {
+		return err
+	}
+
+	for category, counts := range stats.foldedCategories(stored) {
+		for name, count := range counts {
+			_, err = tx.Exec(`
+				INSERT INTO peer_statistics (category, name, count) VALUES ($1, $2, $3)
+				ON CONFLICT (category, name) DO UPDATE SET count = peer_statistics.count + EXCLUDED.count;
+			`, category, fixUTF8Encoding(name), count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDatabase) GetPeerStatistics() (*PeerStatistics, error) {
+	rows, err := db.conn.Query("SELECT category, name, count FROM peer_statistics;")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := NewPeerStatistics()
+	categories := stats.categories()
+	for rows.Next() {
+		var category, name string
+		var count uint64
+		if err = rows.Scan(&category, &name, &count); err != nil {
+			return nil, err
+		}
+		if counts, ok := categories[category]; ok {
+			counts[name] = count
+		}
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (db *postgresDatabase) AddPendingInfoHash(pending PendingInfoHash) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO pending_infohashes (info_hash, last_attempt, next_attempt, n_attempts, peers)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (info_hash)
+		DO UPDATE SET
+			last_attempt = EXCLUDED.last_attempt,
+			next_attempt = EXCLUDED.next_attempt,
+			n_attempts = EXCLUDED.n_attempts,
+			peers = EXCLUDED.peers;
+	`, pending.InfoHash, pending.LastAttempt, pending.NextAttempt, pending.NAttempts, strings.Join(pending.Peers, "\n"))
+	return err
+}
+
+func (db *postgresDatabase) GetPendingInfoHash(infoHash []byte) (*PendingInfoHash, error) {
+	pendings, err := db.queryPendingInfoHashes(`
+		SELECT info_hash, last_attempt, next_attempt, n_attempts, peers
+		FROM pending_infohashes
+		WHERE info_hash = $1;`,
+		infoHash)
+	if err != nil || len(pendings) == 0 {
+		return nil, err
+	}
+	return &pendings[0], nil
+}
+
+func (db *postgresDatabase) GetDuePendingInfoHashes(now int64, limit uint) ([]PendingInfoHash, error) {
+	return db.queryPendingInfoHashes(`
+		SELECT info_hash, last_attempt, next_attempt, n_attempts, peers
+		FROM pending_infohashes
+		WHERE next_attempt <= $1
+		ORDER BY next_attempt ASC
+		LIMIT $2;`,
+		now, limit)
+}
+
+func (db *postgresDatabase) queryPendingInfoHashes(query string, args ...interface{}) ([]PendingInfoHash, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var pendings []PendingInfoHash
+	for rows.Next() {
+		var pending PendingInfoHash
+		var peers string
+		err = rows.Scan(&pending.InfoHash, &pending.LastAttempt, &pending.NextAttempt, &pending.NAttempts, &peers)
+		if err != nil {
+			return nil, err
+		}
+		if peers != "" {
+			pending.Peers = strings.Split(peers, "\n")
+		}
+		pendings = append(pendings, pending)
+	}
+
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return pendings, nil
+}
+
+func (db *postgresDatabase) DeletePendingInfoHash(infoHash []byte) error {
+	_, err := db.conn.Exec("DELETE FROM pending_infohashes WHERE info_hash = $1;", infoHash)
+	return err
+}
+
+func (db *postgresDatabase) AddAnnounces(announces []Announces) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		UPDATE torrents
+		SET n_announces = n_announces + $1, last_seen_on = GREATEST(last_seen_on, $2)
+		WHERE info_hash = $3::BYTEA OR info_hash_v2 BETWEEN $4::BYTEA AND $5::BYTEA;
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// The v2 swarm of a hybrid torrent announces its truncated v2 infohash.
+	for _, announce := range announces {
+		low, high := infoHashV2Range(announce.InfoHash)
+		if _, err = stmt.Exec(announce.Count, announce.LastSeenOn, announce.InfoHash, low, high); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDatabase) GetStatistics(n uint, from string) (*Statistics, error) {
+	fromTime, granularity, err := ParseISO8601(from)
+	if err != nil {
+		return nil, fmt.Errorf("parsing @from error: %s", err.Error())
+	}
+
+	var interval time.Duration
+	switch granularity {
+	case Hour:
+		interval = time.Hour
+	case Day:
+		interval = 24 * time.Hour
+	case Week:
+		interval = 7 * 24 * time.Hour
+	case Month:
+		interval = 30 * 24 * time.Hour
+	case Year:
+		interval = 365 * 24 * time.Hour
+	}
+
+	var stats Statistics
+	stats.N = n
+
+	// discovered_on is stored in UTC.
+	start := fromTime.UTC()
+	for i := uint(0); i < n; i++ {
+		until := start.Add(interval)
+		var nTorrents, nFiles, totalSize uint64
+
+		err = db.conn.QueryRow(`
+			SELECT COUNT(1)
+				 , COALESCE(SUM(total_size), 0)
+				 , COALESCE(SUM((SELECT COUNT(1) FROM files WHERE files.torrent_id = torrents.id)), 0)
+			FROM torrents
+			WHERE discovered_on > $1::TIMESTAMP
+			AND discovered_on <= $2::TIMESTAMP;
+			`, start, until).Scan(&nTorrents, &totalSize, &nFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.NTorrents = append(stats.NTorrents, nTorrents)
+		stats.NFiles = append(stats.NFiles, nFiles)
+		stats.TotalSize = append(stats.TotalSize, totalSize)
+		start = until
+	}
+
+	return &stats, nil
 }
 
 func (db *postgresDatabase) setupDatabase() error {
@@ -294,7 +957,8 @@ func (db *postgresDatabase) setupDatabase() error {
 		return fmt.Errorf("sql.Rows.Close (SCHEMA_VERSION): %s", err.Error())
 	}
 
-	// at the moment we just have 2 versions (0=no db or 1=current db)
+	// Each case migrates the schema to the next version, and falls through to the next case so that
+	// the database is migrated to the latest version at once.
 	switch userVersion {
 	case "0":
 		// initialise db
@@ -327,6 +991,7 @@ func (db *postgresDatabase) setupDatabase() error {
 		if err != nil {
 			return fmt.Errorf("sql.Tx.Exec (v0 -> v1): %s", err.Error())
 		}
+		fallthrough
 	case "1":
 		zap.L().Warn("Updating database schema from 1 to 2... (this might take a while)")
 		_, err = tx.Exec(`
@@ -336,12 +1001,153 @@ func (db *postgresDatabase) setupDatabase() error {
 			to_date		TIMESTAMP NOT NULL,
 			torrents	BIGINT NOT NULL,
 			size		BIGINT NOT NULL,
-			files		BIGINT NOT NULL,
+			files		BIGINT NOT NULL
 		);
 		UPDATE settings SET value = '2' WHERE name = 'SCHEMA_VERSION';
 		`)
 		if err != nil {
-			return fmt.Errorf("sql.Tx.Exec (v0 -> v1): %s", err.Error())
+			return fmt.Errorf("sql.Tx.Exec (v1 -> v2): %s", err.Error())
+		}
+		fallthrough
+	case "2":
+		zap.L().Warn("Updating database schema from 2 to 3... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS info_dictionaries (
+			torrent_id	INTEGER PRIMARY KEY REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			info		BYTEA NOT NULL
+		);
+		UPDATE settings SET value = '3' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v2 -> v3): %s", err.Error())
+		}
+		fallthrough
+	case "3":
+		zap.L().Warn("Updating database schema from 3 to 4... (this might take a while)")
+		_, err = tx.Exec(`
+		ALTER TABLE torrents ADD COLUMN piece_length BIGINT CHECK (piece_length >= 0) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN n_pieces     INTEGER CHECK (n_pieces >= 0) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN private      BOOLEAN DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN source       VARCHAR DEFAULT NULL;
+		ALTER TABLE files ADD COLUMN attributes   VARCHAR DEFAULT NULL;
+		ALTER TABLE files ADD COLUMN symlink_path VARCHAR DEFAULT NULL;
+		UPDATE settings SET value = '4' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v3 -> v4): %s", err.Error())
+		}
+		fallthrough
+	case "4":
+		zap.L().Warn("Updating database schema from 4 to 5... (this might take a while)")
+		_, err = tx.Exec(`
+		ALTER TABLE torrents ADD COLUMN info_hash_v2 BYTEA UNIQUE CHECK (info_hash_v2 IS NULL OR length(info_hash_v2) = 32) DEFAULT NULL;
+		UPDATE settings SET value = '5' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v4 -> v5): %s", err.Error())
+		}
+		fallthrough
+	case "5":
+		zap.L().Warn("Updating database schema from 5 to 6... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS media_info (
+			torrent_id	INTEGER PRIMARY KEY REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			path		TEXT NOT NULL,
+			format		TEXT NOT NULL,
+			duration	DOUBLE PRECISION CHECK (duration IS NULL OR duration >= 0),
+			width		INTEGER CHECK (width IS NULL OR width >= 0),
+			height		INTEGER CHECK (height IS NULL OR height >= 0),
+			video_codec	TEXT,
+			audio_codec	TEXT
+		);
+		UPDATE settings SET value = '6' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v5 -> v6): %s", err.Error())
+		}
+		fallthrough
+	case "6":
+		zap.L().Warn("Updating database schema from 6 to 7... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS peer_statistics (
+			category	TEXT NOT NULL,
+			name		TEXT NOT NULL,
+			count		BIGINT NOT NULL CHECK (count >= 0),
+			PRIMARY KEY (category, name)
+		);
+		UPDATE settings SET value = '7' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v6 -> v7): %s", err.Error())
+		}
+		fallthrough
+	case "7":
+		zap.L().Warn("Updating database schema from 7 to 8... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pending_infohashes (
+			info_hash		BYTEA NOT NULL PRIMARY KEY CHECK(length(info_hash) = 20),
+			last_attempt	BIGINT NOT NULL,
+			next_attempt	BIGINT NOT NULL,
+			n_attempts		INTEGER NOT NULL CHECK(n_attempts >= 0),
+			peers			TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS next_attempt_index ON pending_infohashes (next_attempt);
+		UPDATE settings SET value = '8' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v7 -> v8): %s", err.Error())
+		}
+		fallthrough
+	case "8":
+		zap.L().Warn("Updating database schema from 8 to 9... (this might take a while)")
+		_, err = tx.Exec(`
+		ALTER TABLE torrents ADD COLUMN last_seen_on BIGINT CHECK (last_seen_on IS NULL OR last_seen_on > 0) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN n_announces  BIGINT NOT NULL CHECK (n_announces >= 0) DEFAULT 0;
+		UPDATE settings SET value = '9' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v8 -> v9): %s", err.Error())
+		}
+		fallthrough
+	case "9":
+		// The paths of the (non-padding) files are searched as the names of the torrents are, but
+		// their tsvectors are computed by a trigger as the files are copied in.
+		zap.L().Warn("Updating database schema from 9 to 10... (this might take a while)")
+		_, err = tx.Exec(`
+		ALTER TABLE files ADD COLUMN search tsvector;
+		UPDATE files SET search = to_tsvector(regexp_replace(path, '[^\w]+', ' ', 'gi')) WHERE attributes IS NULL OR strpos(attributes, 'p') = 0;
+		CREATE INDEX files_idx ON files USING gin(search);
+
+		CREATE FUNCTION files_search_trigger() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.attributes IS NULL OR strpos(NEW.attributes, 'p') = 0 THEN
+				NEW.search := to_tsvector(regexp_replace(NEW.path, '[^\w]+', ' ', 'gi'));
+			ELSE
+				NEW.search := NULL;
+			END IF;
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER files_search BEFORE INSERT OR UPDATE OF path, attributes ON files
+			FOR EACH ROW EXECUTE PROCEDURE files_search_trigger();
+
+		UPDATE settings SET value = '10' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v9 -> v10): %s", err.Error())
+		}
+		fallthrough
+	case "10":
+		// The torrents are filtered (see TorrentFilter) and ordered by their sizes and their dates
+		// of discovery; their files are looked up by readme_index already.
+		zap.L().Warn("Updating database schema from 10 to 11... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS total_size_index ON torrents (total_size);
+		CREATE INDEX IF NOT EXISTS discovered_on_index ON torrents (discovered_on);
+		UPDATE settings SET value = '11' WHERE name = 'SCHEMA_VERSION';
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v10 -> v11): %s", err.Error())
 		}
 	}
 
@@ -380,14 +1186,16 @@ func (db *postgresDatabase) GenerateStatisticData(from time.Time) error {
 	}
 	defer tx.Rollback()
 
+	// discovered_on is stored in UTC.
+	from = from.UTC()
 	until := from.Add(duration)
 	var nTorrents, nFiles, totalSize uint64
 
-	row := db.conn.QueryRow(`
+	row := tx.QueryRow(`
 			SELECT COUNT(id)
 			FROM torrents
-			WHERE discovered_on > ?
-			AND discovered_on <= ?
+			WHERE discovered_on > $1::TIMESTAMP
+			AND discovered_on <= $2::TIMESTAMP
 			`,
 		from, until)
 	err = row.Scan(&nTorrents)
@@ -396,23 +1204,23 @@ func (db *postgresDatabase) GenerateStatisticData(from time.Time) error {
 	}
 
 	if nTorrents != 0 {
-		err = db.conn.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT COUNT(f.id)
 			FROM files f
 			INNER JOIN torrents t
 			ON f.torrent_id = t.id
-			WHERE t.discovered_on > ?
-			AND t.discovered_on <= ?
+			WHERE t.discovered_on > $1::TIMESTAMP
+			AND t.discovered_on <= $2::TIMESTAMP
 			`, from, until).Scan(&nFiles)
 		if err != nil {
 			return err
 		}
 
-		err = db.conn.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT SUM(total_size)
 			FROM torrents
-			WHERE discovered_on > ?
-			AND discovered_on <= ? 
+			WHERE discovered_on > $1::TIMESTAMP
+			AND discovered_on <= $2::TIMESTAMP
 			`, from, until).Scan(&totalSize)
 		if err != nil {
 			return err
@@ -426,13 +1234,13 @@ func (db *postgresDatabase) GenerateStatisticData(from time.Time) error {
 			torrents,
 			files,
 			size
-		) VALUES (?, ?, ?, ?, ?);
+		) VALUES ($1, $2, $3, $4, $5);
 	`, from, until, nTorrents, nFiles, totalSize)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func (db *postgresDatabase) GetFirstTorrentDate() (*time.Time, error) {
@@ -0,0 +1,507 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SearchQuery is a query of QueryTorrents, as parsed by ParseSearchQuery. A query consists of words
+// and "exact phrases", all of which the torrents must match, that can be excluded (-cam or
+// -"low quality"), and of filters:
+//
+//	size:>1GB           the total size of the torrent, in B, KB, MB, GB, TB (powers of 1000) or in
+//	                    KiB, MiB, GiB, TiB (powers of 1024)
+//	files:<10           the number of the (non-padding) files of the torrent
+//	discovered:2026-09  the day, the month, or the year (in UTC) the torrent is discovered on
+//	ext:mkv,mp4         the extension of any of the files of the torrent, one of those given
+//
+// where the sizes, the numbers of the files and the dates are compared with >, >=, <, <= or =
+// (which is the default), or given as inclusive ranges such as 1GB..2GB (either of whose ends can
+// be left out). The filters must all match too.
+type SearchQuery struct {
+	Terms  []SearchTerm
+	Filter TorrentFilter
+	// Extensions are the (lower case) extensions of the ext: filters; for each of the filters, the
+	// torrent must have a file with one of its extensions.
+	Extensions [][]string
+}
+
+// SearchTerm is a word or an exact phrase of a SearchQuery.
+type SearchTerm struct {
+	// Text is the word as it is given (which might contain punctuation, e.g. the operators of the
+	// search indices), or the phrase without its quotes.
+	Text     string
+	Phrase   bool
+	Excluded bool
+}
+
+// TorrentFilter restricts the torrents by their metadata, where the bounds are inclusive and the
+// zero bounds are not restricting.
+type TorrentFilter struct {
+	MinSize uint64
+	MaxSize uint64
+	// MinDiscoveredOn and MaxDiscoveredOn are Unix times.
+	MinDiscoveredOn int64
+	MaxDiscoveredOn int64
+	MinNFiles       uint
+	MaxNFiles       uint
+	// Category restricts the torrents to those that have a file of the category, unless it is
+	// AnyCategory.
+	Category Category
+}
+
+// Category is a kind of the files of the torrents, as told by their extensions.
+type Category uint8
+
+const (
+	AnyCategory Category = iota
+	VideoCategory
+	AudioCategory
+	ImageCategory
+	DocumentCategory
+	SoftwareCategory
+	ArchiveCategory
+)
+
+// Categories are the categories (except for AnyCategory) in the order they are listed to the user.
+var Categories = []Category{VideoCategory, AudioCategory, ImageCategory, DocumentCategory, SoftwareCategory, ArchiveCategory}
+
+var categoryNames = map[Category]string{
+	AnyCategory:      "",
+	VideoCategory:    "video",
+	AudioCategory:    "audio",
+	ImageCategory:    "image",
+	DocumentCategory: "document",
+	SoftwareCategory: "software",
+	ArchiveCategory:  "archive",
+}
+
+// categoryExtensions are the (lower case) extensions of the files of each of the categories.
+var categoryExtensions = map[Category][]string{
+	VideoCategory:    {"mkv", "mp4", "avi", "mov", "wmv", "flv", "webm", "m4v", "mpg", "mpeg", "ts", "m2ts", "vob"},
+	AudioCategory:    {"mp3", "flac", "wav", "aac", "ogg", "opus", "m4a", "wma", "ape"},
+	ImageCategory:    {"jpg", "jpeg", "png", "gif", "bmp", "webp", "tif", "tiff", "heic"},
+	DocumentCategory: {"pdf", "epub", "mobi", "azw3", "djvu", "doc", "docx", "cbr", "cbz"},
+	SoftwareCategory: {"exe", "msi", "dmg", "apk", "deb", "rpm", "appimage", "iso"},
+	ArchiveCategory:  {"zip", "rar", "7z", "tar", "gz", "bz2", "xz"},
+}
+
+func (c Category) String() string {
+	return categoryNames[c]
+}
+
+// ParseCategory returns the category of the given name (see Category.String), where the empty
+// name is of AnyCategory.
+func ParseCategory(name string) (Category, error) {
+	for category, categoryName := range categoryNames {
+		if categoryName == name {
+			return category, nil
+		}
+	}
+	return AnyCategory, fmt.Errorf("unknown category %q", name)
+}
+
+// QueryError is the error of a malformed query, whose message is meant to be shown to the user.
+type QueryError struct {
+	// Position is the index of the character (not of the byte) of the query where the error is.
+	Position int
+	Message  string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query (at character %d): %s", e.Position+1, e.Message)
+}
+
+// queryFilters are the names of the filters of the queries, mapped to their parsers. The other
+// words with colons (e.g. "name:ubuntu" of the embedded index) are words to search for.
+var queryFilters = map[string]func(query *SearchQuery, value string) string{
+	"size":       parseSizeFilter,
+	"files":      parseFilesFilter,
+	"discovered": parseDiscoveredFilter,
+	"ext":        parseExtFilter,
+}
+
+// querySizeUnits are the units of the sizes in the queries, in lower case.
+var querySizeUnits = map[string]uint64{
+	"": 1, "b": 1,
+	"k": 1e3, "kb": 1e3, "m": 1e6, "mb": 1e6, "g": 1e9, "gb": 1e9, "t": 1e12, "tb": 1e12,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// ParseSearchQuery parses the query (see SearchQuery), and returns a *QueryError if it is malformed.
+// The words that cannot match anything as they contain no letters or digits (e.g. "&") are
+// dropped.
+func ParseSearchQuery(query string) (SearchQuery, error) {
+	var q SearchQuery
+
+	rest := query
+	for {
+		trimmed := strings.TrimLeftFunc(rest, unicode.IsSpace)
+		position := utf8.RuneCountInString(query[:len(query)-len(trimmed)])
+		rest = trimmed
+		if rest == "" {
+			break
+		}
+
+		var term SearchTerm
+		if rest[0] == '-' {
+			term.Excluded = true
+			rest = rest[1:]
+		}
+
+		if rest != "" && rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return SearchQuery{}, &QueryError{position, `unterminated phrase, the closing quote (") is missing`}
+			}
+			term.Text, term.Phrase, rest = rest[1:end+1], true, rest[end+2:]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end == -1 {
+				end = len(rest)
+			}
+			term.Text, rest = rest[:end], rest[end:]
+
+			if colon := strings.IndexByte(term.Text, ':'); colon != -1 {
+				name := strings.ToLower(term.Text[:colon])
+				if parse, isFilter := queryFilters[name]; isFilter {
+					token := term.Text
+					if term.Excluded {
+						token = "-" + token
+					}
+					value := term.Text[colon+1:]
+					var message string
+					switch {
+					case term.Excluded:
+						message = fmt.Sprintf("filters cannot be excluded (%s)", token)
+					case value == "":
+						message = fmt.Sprintf("the value of the filter %s: is missing (e.g. %s)", name, queryFilterExamples[name])
+					default:
+						message = parse(&q, value)
+					}
+					if message != "" {
+						return SearchQuery{}, &QueryError{position, message}
+					}
+					continue
+				}
+			}
+		}
+
+		if len(analyze(term.Text)) != 0 {
+			q.Terms = append(q.Terms, term)
+		}
+	}
+
+	if len(q.Terms) != 0 && len(q.included()) == 0 {
+		return SearchQuery{}, &QueryError{0, "the query cannot consist of excluded words only"}
+	}
+
+	return q, nil
+}
+
+// queryFilterExamples are the examples of the values of the filters, for the error messages.
+var queryFilterExamples = map[string]string{
+	"size":       "size:>1GB, size:<=700MiB or size:1GB..2GB",
+	"files":      "files:<10 or files:2..5",
+	"discovered": "discovered:2026, discovered:>=2026-09 or discovered:2026-09-01..2026-09-15",
+	"ext":        "ext:mkv or ext:mkv,mp4",
+}
+
+// errEmptyRange is returned by parseQueryRange if the range is empty, and errInvalidRange if the
+// value is invalid.
+var (
+	errEmptyRange   = errors.New("empty range")
+	errInvalidRange = errors.New("invalid range")
+)
+
+func parseSizeFilter(q *SearchQuery, value string) string {
+	min, max, err := parseQueryRange(value, func(bound string) (int64, int64, bool) {
+		i := strings.LastIndexFunc(bound, func(r rune) bool { return unicode.IsDigit(r) || r == '.' }) + 1
+		unit, exists := querySizeUnits[strings.ToLower(bound[i:])]
+		if !exists {
+			return 0, 0, false
+		}
+		number, err := strconv.ParseFloat(bound[:i], 64)
+		if err != nil || number < 0 || number*float64(unit) >= math.MaxInt64 {
+			return 0, 0, false
+		}
+		size := int64(math.Round(number * float64(unit)))
+		return size, size, true
+	})
+	switch err {
+	case errInvalidRange:
+		return fmt.Sprintf("invalid size filter size:%s (e.g. %s, where the units are B, KB, MB, GB, TB, KiB, MiB, GiB and TiB)",
+			value, queryFilterExamples["size"])
+	case errEmptyRange:
+		return fmt.Sprintf("size:%s matches no torrents", value)
+	}
+	q.Filter = q.Filter.intersect(TorrentFilter{MinSize: uint64(min), MaxSize: uint64(max)})
+	return ""
+}
+
+func parseFilesFilter(q *SearchQuery, value string) string {
+	min, max, err := parseQueryRange(value, func(bound string) (int64, int64, bool) {
+		n, err := strconv.ParseInt(bound, 10, 32)
+		return n, n, err == nil && n >= 0
+	})
+	switch err {
+	case errInvalidRange:
+		return fmt.Sprintf("invalid number of files filter files:%s (e.g. %s)", value, queryFilterExamples["files"])
+	case errEmptyRange:
+		return fmt.Sprintf("files:%s matches no torrents", value)
+	}
+	q.Filter = q.Filter.intersect(TorrentFilter{MinNFiles: uint(min), MaxNFiles: uint(max)})
+	return ""
+}
+
+func parseDiscoveredFilter(q *SearchQuery, value string) string {
+	min, max, err := parseQueryRange(value, func(bound string) (int64, int64, bool) {
+		for _, layout := range []struct {
+			layout string
+			years  int
+			months int
+			days   int
+		}{{"2006", 1, 0, 0}, {"2006-01", 0, 1, 0}, {"2006-01-02", 0, 0, 1}} {
+			if start, err := time.Parse(layout.layout, bound); err == nil {
+				end := start.AddDate(layout.years, layout.months, layout.days)
+				return start.Unix(), end.Unix() - 1, start.Unix() > 0
+			}
+		}
+		return 0, 0, false
+	})
+	switch err {
+	case errInvalidRange:
+		return fmt.Sprintf("invalid date filter discovered:%s (e.g. %s, where the dates are in UTC)",
+			value, queryFilterExamples["discovered"])
+	case errEmptyRange:
+		return fmt.Sprintf("discovered:%s matches no torrents", value)
+	}
+	q.Filter = q.Filter.intersect(TorrentFilter{MinDiscoveredOn: min, MaxDiscoveredOn: max})
+	return ""
+}
+
+func parseExtFilter(q *SearchQuery, value string) string {
+	var extensions []string
+	for _, extension := range strings.Split(value, ",") {
+		extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+		valid := extension != "" && len(extension) <= 16
+		for _, r := range extension {
+			valid = valid && r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+		}
+		if !valid {
+			return fmt.Sprintf("invalid extension %q in ext:%s (e.g. %s)", extension, value, queryFilterExamples["ext"])
+		}
+		extensions = append(extensions, extension)
+	}
+	q.Extensions = append(q.Extensions, extensions)
+	return ""
+}
+
+// parseQueryRange parses a comparison (e.g. >=1GB) or a range (e.g. 1GB..2GB) into its inclusive
+// bounds, where @parseBound parses a value into the (inclusive) range that it stands for (e.g. a
+// month), and reports whether it is valid. As in TorrentFilter, the bounds that do not restrict
+// are 0; the values are positive otherwise.
+func parseQueryRange(value string, parseBound func(string) (int64, int64, bool)) (min int64, max int64, err error) {
+	min, max = 0, math.MaxInt64
+
+	if dots := strings.Index(value, ".."); dots != -1 {
+		start, end := value[:dots], value[dots+2:]
+		if start == "" && end == "" {
+			return 0, 0, errInvalidRange
+		}
+		var ok bool
+		if start != "" {
+			if min, _, ok = parseBound(start); !ok {
+				return 0, 0, errInvalidRange
+			}
+		}
+		if end != "" {
+			if _, max, ok = parseBound(end); !ok {
+				return 0, 0, errInvalidRange
+			}
+		}
+	} else {
+		operator := value[:len(value)-len(strings.TrimLeft(value, "<>="))]
+		lo, hi, ok := parseBound(value[len(operator):])
+		if !ok {
+			return 0, 0, errInvalidRange
+		}
+		switch operator {
+		case ">":
+			min = hi + 1
+		case ">=":
+			min = lo
+		case "<":
+			max = lo - 1
+		case "<=":
+			max = hi
+		case "", "=":
+			min, max = lo, hi
+		default:
+			return 0, 0, errInvalidRange
+		}
+	}
+
+	if max < 1 || max < min {
+		return 0, 0, errEmptyRange
+	}
+	if max == math.MaxInt64 {
+		max = 0
+	}
+	return min, max, nil
+}
+
+// restrict restricts the query to the torrents that the filter matches too.
+func (q *SearchQuery) restrict(filter TorrentFilter) {
+	q.Filter = q.Filter.intersect(filter)
+	if filter.Category != AnyCategory {
+		q.Extensions = append(q.Extensions, categoryExtensions[filter.Category])
+	}
+}
+
+// intersect returns the filter that matches the torrents that both of the filters match, except
+// for their categories (see SearchQuery.restrict), hence the Category of the result is
+// AnyCategory.
+func (f TorrentFilter) intersect(g TorrentFilter) TorrentFilter {
+	maxUint64 := func(a, b uint64) uint64 {
+		if a > b {
+			return a
+		}
+		return b
+	}
+	// The smaller bound, where 0 is unbounded.
+	minBound := func(a, b uint64) uint64 {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+
+	return TorrentFilter{
+		MinSize:         maxUint64(f.MinSize, g.MinSize),
+		MaxSize:         minBound(f.MaxSize, g.MaxSize),
+		MinDiscoveredOn: int64(maxUint64(uint64(f.MinDiscoveredOn), uint64(g.MinDiscoveredOn))),
+		MaxDiscoveredOn: int64(minBound(uint64(f.MaxDiscoveredOn), uint64(g.MaxDiscoveredOn))),
+		MinNFiles:       uint(maxUint64(uint64(f.MinNFiles), uint64(g.MinNFiles))),
+		MaxNFiles:       uint(minBound(uint64(f.MaxNFiles), uint64(g.MaxNFiles))),
+	}
+}
+
+// matches reports whether the filter matches the torrent, regardless of its Category (which depends
+// on the files of the torrent).
+func (f TorrentFilter) matches(torrent TorrentMetadata) bool {
+	return torrent.Size >= f.MinSize && (f.MaxSize == 0 || torrent.Size <= f.MaxSize) &&
+		torrent.DiscoveredOn >= f.MinDiscoveredOn && (f.MaxDiscoveredOn == 0 || torrent.DiscoveredOn <= f.MaxDiscoveredOn) &&
+		torrent.NFiles >= f.MinNFiles && (f.MaxNFiles == 0 || torrent.NFiles <= f.MaxNFiles)
+}
+
+// included returns the terms that are not excluded.
+func (q SearchQuery) included() []SearchTerm {
+	var terms []SearchTerm
+	for _, term := range q.Terms {
+		if !term.Excluded {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// Text returns the words and the phrases of the query, without its filters.
+func (q SearchQuery) Text() string {
+	terms := make([]string, len(q.Terms))
+	for i, term := range q.Terms {
+		if term.Phrase {
+			terms[i] = `"` + term.Text + `"`
+		} else {
+			terms[i] = term.Text
+		}
+		if term.Excluded {
+			terms[i] = "-" + terms[i]
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// includedText returns the words and the phrases of the query that are not excluded, without
+// their operators, e.g. to highlight them.
+func (q SearchQuery) includedText() string {
+	var texts []string
+	for _, term := range q.included() {
+		texts = append(texts, term.Text)
+	}
+	return strings.Join(texts, " ")
+}
+
+// fts5Query converts the words and the phrases of the query to an FTS5 query of SQLite, where every
+// one of them is a (quoted) phrase so that its punctuation is never taken as an operator.
+func (q SearchQuery) fts5Query() string {
+	quote := func(term SearchTerm) string {
+		return `"` + strings.Replace(term.Text, `"`, `""`, -1) + `"`
+	}
+
+	var included, excluded []string
+	for _, term := range q.Terms {
+		if term.Excluded {
+			excluded = append(excluded, "NOT "+quote(term))
+		} else {
+			included = append(included, quote(term))
+		}
+	}
+	if len(excluded) == 0 {
+		return strings.Join(included, " ")
+	}
+	return "(" + strings.Join(included, " ") + ") " + strings.Join(excluded, " ")
+}
+
+// sqlPredicates returns the conditions of the filters of the query (each preceded by AND) for the
+// SQL queries of the torrents, where @arg returns the placeholder of an argument, @nFiles is the
+// expression of the number of the (non-padding) files of a torrent in the engine, and
+// @fromUnixTime converts (the placeholder of) a Unix time to the type of discovered_on. The
+// conditions on total_size and discovered_on compare the columns as they are, so that their
+// indices can be used.
+func (q SearchQuery) sqlPredicates(arg func(interface{}) string, nFiles string, fromUnixTime func(string) string) string {
+	var predicates []string
+	f := q.Filter
+
+	if f.MinSize != 0 {
+		predicates = append(predicates, "total_size >= "+arg(int64(f.MinSize)))
+	}
+	if f.MaxSize != 0 {
+		predicates = append(predicates, "total_size <= "+arg(int64(f.MaxSize)))
+	}
+	if f.MinDiscoveredOn != 0 {
+		predicates = append(predicates, "discovered_on >= "+fromUnixTime(arg(f.MinDiscoveredOn)))
+	}
+	if f.MaxDiscoveredOn != 0 {
+		predicates = append(predicates, "discovered_on <= "+fromUnixTime(arg(f.MaxDiscoveredOn)))
+	}
+	if f.MinNFiles != 0 {
+		predicates = append(predicates, nFiles+" >= "+arg(int64(f.MinNFiles)))
+	}
+	if f.MaxNFiles != 0 {
+		predicates = append(predicates, nFiles+" <= "+arg(int64(f.MaxNFiles)))
+	}
+
+	for _, extensions := range q.Extensions {
+		likes := make([]string, len(extensions))
+		for i, extension := range extensions {
+			// The extensions consist of ASCII letters and digits only, hence there is nothing to
+			// escape in the patterns and lower() is the same in all the engines.
+			likes[i] = "lower(files.path) LIKE " + arg("%."+extension)
+		}
+		predicates = append(predicates, "EXISTS (SELECT 1 FROM files WHERE files.torrent_id = torrents.id AND ("+
+			strings.Join(likes, " OR ")+"))")
+	}
+
+	var sql string
+	for _, predicate := range predicates {
+		sql += " AND " + predicate
+	}
+	return sql
+}
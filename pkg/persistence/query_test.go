@@ -0,0 +1,149 @@
+package persistence
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	september := time.Date(2026, time.September, 1, 0, 0, 0, 0, time.UTC).Unix()
+	october := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	tests := []struct {
+		query string
+		q     SearchQuery
+	}{
+		{"", SearchQuery{}},
+		{`ubuntu -cam "exact phrase" -"low quality"`, SearchQuery{Terms: []SearchTerm{
+			{Text: "ubuntu"}, {Text: "cam", Excluded: true}, {Text: "exact phrase", Phrase: true},
+			{Text: "low quality", Phrase: true, Excluded: true},
+		}}},
+		// The words without letters or digits are dropped, and the other punctuation is kept.
+		{`don't & ubun* name:ubuntu`, SearchQuery{Terms: []SearchTerm{
+			{Text: "don't"}, {Text: "ubun*"}, {Text: "name:ubuntu"},
+		}}},
+		{"size:>1GB size:<=2GiB", SearchQuery{Filter: TorrentFilter{MinSize: 1e9 + 1, MaxSize: 2 << 30}}},
+		{"SIZE:1.5mb", SearchQuery{Filter: TorrentFilter{MinSize: 1500000, MaxSize: 1500000}}},
+		{"size:1KiB..", SearchQuery{Filter: TorrentFilter{MinSize: 1024}}},
+		{"files:<10", SearchQuery{Filter: TorrentFilter{MaxNFiles: 9}}},
+		{"files:2..5 files:>=3", SearchQuery{Filter: TorrentFilter{MinNFiles: 3, MaxNFiles: 5}}},
+		{"discovered:2026-09", SearchQuery{Filter: TorrentFilter{MinDiscoveredOn: september, MaxDiscoveredOn: october - 1}}},
+		{"discovered:>2026-08", SearchQuery{Filter: TorrentFilter{MinDiscoveredOn: september}}},
+		{"discovered:<2026-10-01", SearchQuery{Filter: TorrentFilter{MaxDiscoveredOn: october - 1}}},
+		{"discovered:2026-09-01..2026-09-30", SearchQuery{Filter: TorrentFilter{MinDiscoveredOn: september, MaxDiscoveredOn: october - 1}}},
+		{"ext:MKV,.mp4 ext:srt", SearchQuery{Extensions: [][]string{{"mkv", "mp4"}, {"srt"}}}},
+	}
+
+	for _, test := range tests {
+		q, err := ParseSearchQuery(test.query)
+		if err != nil {
+			t.Errorf("ParseSearchQuery(%q) returned an error: %s", test.query, err.Error())
+		} else if !reflect.DeepEqual(q, test.q) {
+			t.Errorf("expected ParseSearchQuery(%q) to be %+v, got %+v", test.query, test.q, q)
+		}
+	}
+}
+
+func TestParseSearchQuery_Errors(t *testing.T) {
+	tests := []struct {
+		query    string
+		position int
+		message  string
+	}{
+		{`ubuntu "desktop`, 7, "unterminated phrase"},
+		{"-cam -ts", 0, "excluded words only"},
+		{"ubuntu -size:>1GB", 7, "cannot be excluded"},
+		{"size:", 0, "is missing"},
+		{"size:>1XB", 0, "invalid size"},
+		{"size:1GB..1MB", 0, "matches no torrents"},
+		{"size:<1", 0, "matches no torrents"},
+		{"size:=>1GB", 0, "invalid size"},
+		{"files:<1", 0, "matches no torrents"},
+		{"files:many", 0, "invalid number of files"},
+		{"discovered:2026-13", 0, "invalid date"},
+		{"discovered:..", 0, "invalid date"},
+		{"ünïcode ext:m*v", 8, "invalid extension"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseSearchQuery(test.query)
+		queryErr, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("expected ParseSearchQuery(%q) to return a QueryError, got %v", test.query, err)
+			continue
+		}
+		if queryErr.Position != test.position || !strings.Contains(queryErr.Message, test.message) {
+			t.Errorf("expected the error of %q to contain %q at %d, got %q at %d", test.query, test.message,
+				test.position, queryErr.Message, queryErr.Position)
+		}
+	}
+}
+
+func TestSearchQuery_Text(t *testing.T) {
+	q, err := ParseSearchQuery(`ubuntu size:>1GB -cam  "exact phrase" ext:iso -"low quality"`)
+	checkErr(err, t)
+	if text := q.Text(); text != `ubuntu -cam "exact phrase" -"low quality"` {
+		t.Errorf("expected the text to be without the filters, got %q", text)
+	}
+	if text := q.fts5Query(); text != `("ubuntu" "exact phrase") NOT "cam" NOT "low quality"` {
+		t.Errorf("expected the FTS5 query to be quoted, got %q", text)
+	}
+
+	q, err = ParseSearchQuery(`ubuntu"`)
+	checkErr(err, t)
+	if text := q.fts5Query(); text != `"ubuntu"""` {
+		t.Errorf("expected the quotes to be escaped, got %q", text)
+	}
+}
+
+func TestTorrentFilter_Matches(t *testing.T) {
+	torrent := TorrentMetadata{Size: 100, DiscoveredOn: 1500000000, NFiles: 3}
+
+	tests := []struct {
+		filter  TorrentFilter
+		matches bool
+	}{
+		{TorrentFilter{}, true},
+		{TorrentFilter{MinSize: 100, MaxSize: 100}, true},
+		{TorrentFilter{MinSize: 101}, false},
+		{TorrentFilter{MaxDiscoveredOn: 1499999999}, false},
+		{TorrentFilter{MinNFiles: 1, MaxNFiles: 3}, true},
+		{TorrentFilter{MaxNFiles: 2}, false},
+	}
+
+	for _, test := range tests {
+		if matches := test.filter.matches(torrent); matches != test.matches {
+			t.Errorf("expected %+v to match %t, got %t", test.filter, test.matches, matches)
+		}
+	}
+}
+
+func TestSearchQuery_Restrict(t *testing.T) {
+	q, err := ParseSearchQuery("ubuntu size:>1GB files:<10 ext:iso")
+	checkErr(err, t)
+	q.restrict(TorrentFilter{MinSize: 1, MaxSize: 2e9, MinNFiles: 2, Category: SoftwareCategory})
+
+	expected := TorrentFilter{MinSize: 1e9 + 1, MaxSize: 2e9, MinNFiles: 2, MaxNFiles: 9}
+	if q.Filter != expected {
+		t.Errorf("expected the filters to be intersected to %+v, got %+v", expected, q.Filter)
+	}
+	if len(q.Extensions) != 2 || !reflect.DeepEqual(q.Extensions[1], categoryExtensions[SoftwareCategory]) {
+		t.Errorf("expected the extensions of the category to be required, got %v", q.Extensions)
+	}
+}
+
+func TestParseCategory(t *testing.T) {
+	for _, category := range append(Categories, AnyCategory) {
+		if parsed, err := ParseCategory(category.String()); err != nil || parsed != category {
+			t.Errorf("expected %q to be parsed as %d, got %d (%v)", category.String(), category, parsed, err)
+		}
+		if category != AnyCategory && len(categoryExtensions[category]) == 0 {
+			t.Errorf("expected the category %q to have extensions", category.String())
+		}
+	}
+	if _, err := ParseCategory("movies"); err == nil {
+		t.Error("expected an error for an unknown category")
+	}
+}
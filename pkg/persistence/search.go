@@ -0,0 +1,286 @@
+package persistence
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// SEARCH_INDEX_MAX_HITS is the maximum number of the hits of a query that are ordered and paginated
+// by an indexed database, i.e. only the SEARCH_INDEX_MAX_HITS most relevant torrents of a query can
+// be browsed.
+const SEARCH_INDEX_MAX_HITS = 10000
+
+// MAX_UNINDEXED_TORRENTS is the maximum number of the torrents whose indexing failed that are kept
+// to be indexed again, beyond which the oldest of them are dropped (and are not searchable until
+// they are added again).
+const MAX_UNINDEXED_TORRENTS = 10000
+
+// SearchIndex is a full-text index of the names and the file paths of the torrents, which is kept
+// apart from the Database that stores them (see WithSearchIndex).
+type SearchIndex interface {
+	// Index adds the torrents to the index, replacing those that are already in it.
+	Index(torrents []IndexedTorrent) error
+	// Search returns at most @limit torrents that match the query, the most relevant first. The
+	// syntax of the query depends on the index; e.g. see the embedded index.
+	Search(query string, limit uint) ([]SearchHit, error)
+	Close() error
+}
+
+// IndexedTorrent is a torrent as it is stored in a SearchIndex, i.e. its metadata (as it is in the
+// database when it is indexed) and the paths of its (non-padding) files.
+type IndexedTorrent struct {
+	TorrentMetadata
+	Paths []string
+}
+
+// SearchHit is a torrent that matches a query, where the higher the Score is the more relevant the
+// torrent is.
+type SearchHit struct {
+	TorrentMetadata
+	Score float64
+}
+
+// MakeSearchIndex opens the search index at the given URL, which is either file:///path/to/index
+// for an embedded index, or http(s)://host:9200/index for an index in Elasticsearch.
+func MakeSearchIndex(indexURL *url.URL) (SearchIndex, error) {
+	switch indexURL.Scheme {
+	case "file":
+		return makeEmbeddedIndex(indexURL.Path)
+
+	case "http", "https":
+		return makeElasticsearchIndex(indexURL)
+
+	default:
+		return nil, fmt.Errorf("unknown URI scheme (search index)!")
+	}
+}
+
+// indexedDatabase is a Database that keeps a SearchIndex in sync with the torrents that are added
+// to it, and that searches for the torrents in the SearchIndex instead.
+type indexedDatabase struct {
+	Database
+	index SearchIndex
+	// unindexed are the torrents that are added to the database but whose indexing failed, which
+	// are indexed again along with the torrents that are added next.
+	unindexed *unindexedTorrents
+}
+
+type unindexedTorrents struct {
+	sync.Mutex
+	torrents []NewTorrent
+}
+
+// WithSearchIndex returns the database such that the torrents added to it are indexed, and the
+// torrents are searched for in the index. Only the torrents that are added through the returned
+// database are indexed.
+func WithSearchIndex(db Database, index SearchIndex) Database {
+	return indexedDatabase{db, index, &unindexedTorrents{}}
+}
+
+func (db indexedDatabase) AddNewTorrent(infoHash []byte, name string, files []File, info InfoMetadata) error {
+	if err := db.Database.AddNewTorrent(infoHash, name, files, info); err != nil {
+		return err
+	}
+	db.indexOrRetry([]NewTorrent{{InfoHash: infoHash, Name: name, Files: files}})
+	return nil
+}
+
+func (db indexedDatabase) AddNewTorrents(torrents []NewTorrent) error {
+	if err := db.Database.AddNewTorrents(torrents); err != nil {
+		return err
+	}
+	db.indexOrRetry(torrents)
+	return nil
+}
+
+// indexOrRetry indexes the torrents along with those whose indexing failed before. As the torrents
+// are in the database already, a failure is not an error of adding them (which would make them be
+// written again); instead it is logged, and if it is transient (see IsTransient) the torrents are
+// kept to be indexed again the next time.
+func (db indexedDatabase) indexOrRetry(torrents []NewTorrent) {
+	db.unindexed.Lock()
+	defer db.unindexed.Unlock()
+
+	// Only what indexTorrents needs is kept, as the info dictionaries might be large.
+	pending := db.unindexed.torrents
+	for _, torrent := range torrents {
+		pending = append(pending, NewTorrent{InfoHash: torrent.InfoHash, Name: torrent.Name, Files: torrent.Files})
+	}
+
+	err := db.indexTorrents(pending)
+	switch {
+	case err == nil:
+		db.unindexed.torrents = nil
+
+	case !IsTransient(err):
+		// The torrents would fail to be indexed again, along with the next ones.
+		zap.L().Error("Could not index the torrents, dropping!", zap.Int("torrents", len(pending)), zap.Error(err))
+		db.unindexed.torrents = nil
+
+	default:
+		if len(pending) > MAX_UNINDEXED_TORRENTS {
+			zap.L().Warn("Too many torrents could not be indexed, dropping the oldest of them!",
+				zap.Int("dropped", len(pending)-MAX_UNINDEXED_TORRENTS))
+			pending = append([]NewTorrent{}, pending[len(pending)-MAX_UNINDEXED_TORRENTS:]...)
+		}
+		zap.L().Error("Could not index the torrents, will retry with the next ones.",
+			zap.Int("torrents", len(pending)), zap.Error(err))
+		db.unindexed.torrents = pending
+	}
+}
+
+// indexTorrents indexes the torrents as they are in the database. The torrents that are skipped by
+// the database (e.g. the empty ones) are not indexed, whereas those that already exist are indexed
+// again (so that the torrents whose indexing failed are indexed when they are added again).
+func (db indexedDatabase) indexTorrents(torrents []NewTorrent) error {
+	indexed := make([]IndexedTorrent, 0, len(torrents))
+	for _, torrent := range torrents {
+		metadata, err := db.Database.GetTorrent(torrent.InfoHash)
+		if err != nil {
+			return fmt.Errorf("could not get torrent %x: %w", torrent.InfoHash, err)
+		}
+		if metadata == nil {
+			continue
+		}
+
+		paths := make([]string, 0, len(torrent.Files))
+		for _, file := range torrent.Files {
+			if !file.IsPadding() {
+				paths = append(paths, file.Path)
+			}
+		}
+		indexed = append(indexed, IndexedTorrent{TorrentMetadata: *metadata, Paths: paths})
+	}
+
+	if len(indexed) == 0 {
+		return nil
+	}
+	if err := db.index.Index(indexed); err != nil {
+		return fmt.Errorf("could not index the torrents: %w", err)
+	}
+	return nil
+}
+
+// QueryTorrents searches for the words and the phrases of the query in the index (in its syntax, see
+// SearchQuery.Text), filters the hits by the filters of the query and by the filter, and orders and
+// paginates the hits (of which there are at most SEARCH_INDEX_MAX_HITS) exactly as the databases
+// do. The relevance of a hit is its negated score, so that (as with the databases) the more
+// relevant a torrent is the lower its relevance is.
+//
+// The torrents are searched for in the database instead if the query has no words, or if the
+// extensions of the files are required (which are not in the hits), e.g. by a Category. The paths
+// of the files are indexed too but cannot be highlighted, hence the torrents are searched for in
+// the database also when their files are searched (see SearchFiles).
+func (db indexedDatabase) QueryTorrents(
+	query string,
+	mode SearchMode,
+	filter TorrentFilter,
+	epoch int64,
+	orderBy OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue uint64,
+	lastID uint64,
+	backward bool,
+) ([]TorrentMetadata, error) {
+	q, err := ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	q.restrict(filter)
+	if len(q.Terms) == 0 || len(q.Extensions) != 0 || mode == SearchFiles {
+		return db.Database.QueryTorrents(query, mode, filter, epoch, orderBy, ascending, limit, lastOrderedValue, lastID, backward)
+	}
+	if (lastOrderedValue == 0) != (lastID == 0) {
+		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
+	}
+	if orderBy == ByNSeeders || orderBy == ByNLeechers {
+		return nil, fmt.Errorf("torrents cannot be ordered by the number of seeders or leechers yet")
+	}
+
+	hits, err := db.index.Search(q.Text(), SEARCH_INDEX_MAX_HITS)
+	if err != nil {
+		return nil, err
+	}
+
+	orderedValue := func(hit SearchHit) float64 {
+		switch orderBy {
+		case ByRelevance:
+			return -hit.Score
+		case BySize:
+			return float64(hit.Size)
+		case ByDiscoveredOn:
+			return float64(hit.DiscoveredOn)
+		case ByNFiles:
+			return float64(hit.NFiles)
+		default:
+			panic(fmt.Sprintf("unknown orderBy: %v", orderBy))
+		}
+	}
+
+	// The relevance of the last torrent cannot be given as a lastOrderedValue, hence it is that of
+	// the hit with the lastID (and if there is no such hit, there are no more torrents either).
+	pivot := float64(lastOrderedValue)
+	if lastID != 0 && orderBy == ByRelevance {
+		pivot = math.NaN()
+		for _, hit := range hits {
+			if uint64(hit.ID) == lastID {
+				pivot = orderedValue(hit)
+				break
+			}
+		}
+		if math.IsNaN(pivot) {
+			return nil, nil
+		}
+	}
+
+	greater := ascending != backward
+	var torrents []SearchHit
+	for _, hit := range hits {
+		if hit.DiscoveredOn > epoch || !q.Filter.matches(hit.TorrentMetadata) {
+			continue
+		}
+		if lastID != 0 {
+			value := orderedValue(hit)
+			afterPivot := (greater && value > pivot) || (!greater && value < pivot)
+			if value == pivot {
+				afterPivot = (!backward && uint64(hit.ID) > lastID) || (backward && uint64(hit.ID) < lastID)
+			}
+			if !afterPivot {
+				continue
+			}
+		}
+		torrents = append(torrents, hit)
+	}
+
+	sort.SliceStable(torrents, func(i, j int) bool {
+		vi, vj := orderedValue(torrents[i]), orderedValue(torrents[j])
+		if vi != vj {
+			return (greater && vi < vj) || (!greater && vi > vj)
+		}
+		return torrents[i].ID < torrents[j].ID
+	})
+
+	if uint(len(torrents)) > limit {
+		torrents = torrents[:limit]
+	}
+
+	var metadata []TorrentMetadata
+	for _, torrent := range torrents {
+		metadata = append(metadata, torrent.TorrentMetadata)
+	}
+	return metadata, nil
+}
+
+func (db indexedDatabase) Close() error {
+	if err := db.index.Close(); err != nil {
+		db.Database.Close()
+		return err
+	}
+	return db.Database.Close()
+}
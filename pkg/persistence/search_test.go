@@ -0,0 +1,101 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIndexedDatabase(t *testing.T) {
+	db, closeDB := openIndexedTestDatabase(t)
+	defer closeDB()
+
+	checkErr(db.AddNewTorrents([]NewTorrent{
+		{InfoHash: conformanceInfoHash(1), Name: "The Show Season 1", Files: []File{
+			{Path: "S01E01 Pilot.mkv", Size: 10},
+			{Path: ".pad/1", Size: 1, Attributes: "p"},
+			{Path: "S01E02 Finale.mkv", Size: 10},
+		}},
+		{InfoHash: conformanceInfoHash(2), Name: "The Show Pilot", Files: []File{{Path: "pilot.mkv", Size: 30}}},
+		// Empty torrents are neither added nor indexed.
+		{InfoHash: conformanceInfoHash(3), Name: "Pilot", Files: []File{{Path: "pilot.mkv"}}},
+	}), t)
+
+	// The file paths are searched too, and the torrents are as they are in the database.
+	torrents, err := db.QueryTorrents("pilot", SearchNames, TorrentFilter{}, time.Now().Unix()+1, BySize, true, 10, 0, 0, false)
+	checkErr(err, t)
+	if len(torrents) != 2 || torrents[0].Name != "The Show Season 1" || torrents[0].Size != 20 ||
+		torrents[0].NFiles != 2 || torrents[0].ID == 0 || torrents[1].Name != "The Show Pilot" {
+		t.Fatalf("torrents mismatch. Got: %+v", torrents)
+	}
+
+	// The padding files are not indexed.
+	if names := fmt.Sprint(queryNames(t, db, "pad", BySize, true, 10, nil, false)); names != "[]" {
+		t.Errorf("expected the padding files not to match, got %s", names)
+	}
+
+	// The pages by relevance continue after the torrent of the lastID.
+	first, err := db.QueryTorrents("pilot", SearchNames, TorrentFilter{}, time.Now().Unix()+1, ByRelevance, true, 1, 0, 0, false)
+	checkErr(err, t)
+	if len(first) != 1 || first[0].Name != "The Show Pilot" {
+		t.Fatalf("expected the most relevant torrent to be the one with pilot in its name. Got: %+v", first)
+	}
+	second, err := db.QueryTorrents("pilot", SearchNames, TorrentFilter{}, time.Now().Unix()+1, ByRelevance, true, 1, 1, uint64(first[0].ID), false)
+	checkErr(err, t)
+	if len(second) != 1 || second[0].Name != "The Show Season 1" {
+		t.Errorf("expected the second page to be the other torrent. Got: %+v", second)
+	}
+
+	if _, err = db.QueryTorrents("\"pilot", SearchNames, TorrentFilter{}, time.Now().Unix()+1, ByRelevance, true, 1, 0, 0, false); err == nil {
+		t.Error("expected an error for an invalid query")
+	}
+}
+
+// flakyIndex is a SearchIndex whose Index fails with the error, unless it is nil.
+type flakyIndex struct {
+	SearchIndex
+	err error
+}
+
+func (index *flakyIndex) Index(torrents []IndexedTorrent) error {
+	if index.err != nil {
+		return index.err
+	}
+	return index.SearchIndex.Index(torrents)
+}
+
+func TestIndexedDatabase_IndexFailure(t *testing.T) {
+	db, closeDB := openIndexedTestDatabase(t)
+	defer closeDB()
+	index := &flakyIndex{SearchIndex: db.(indexedDatabase).index, err: &elasticsearchError{StatusCode: 503}}
+	db = indexedDatabase{db.(indexedDatabase).Database, index, &unindexedTorrents{}}
+
+	// The torrents are added even though they cannot be indexed.
+	checkErr(db.AddNewTorrents([]NewTorrent{
+		{InfoHash: conformanceInfoHash(1), Name: "Ubuntu 18.04", Files: []File{{Path: "ubuntu.iso", Size: 10}}},
+	}), t)
+	exists, err := db.DoesTorrentExist(conformanceInfoHash(1))
+	checkErr(err, t)
+	if !exists {
+		t.Fatal("expected the torrent to be added")
+	}
+
+	// ... and are indexed along with the next ones, once the index is available again.
+	index.err = nil
+	checkErr(db.AddNewTorrent(conformanceInfoHash(2), "Ubuntu 20.04", []File{{Path: "ubuntu.iso", Size: 20}},
+		InfoMetadata{}), t)
+	if names := fmt.Sprint(queryNames(t, db, "ubuntu", BySize, true, 10, nil, false)); names != "[Ubuntu 18.04 Ubuntu 20.04]" {
+		t.Errorf("expected both torrents to be indexed, got %s", names)
+	}
+
+	// The torrents whose indexing fails permanently are not indexed again.
+	index.err = &elasticsearchError{StatusCode: 400}
+	checkErr(db.AddNewTorrent(conformanceInfoHash(3), "Ubuntu 22.04", []File{{Path: "ubuntu.iso", Size: 30}},
+		InfoMetadata{}), t)
+	index.err = nil
+	checkErr(db.AddNewTorrent(conformanceInfoHash(4), "Ubuntu 24.04", []File{{Path: "ubuntu.iso", Size: 40}},
+		InfoMetadata{}), t)
+	if names := fmt.Sprint(queryNames(t, db, "ubuntu", BySize, true, 10, nil, false)); names != "[Ubuntu 18.04 Ubuntu 20.04 Ubuntu 24.04]" {
+		t.Errorf("expected the torrent that failed permanently not to be indexed, got %s", names)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 	"text/template"
 	"time"
 
@@ -51,7 +52,10 @@ func (db *sqlite3Database) Engine() databaseEngine {
 }
 
 func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = ?;", infoHash)
+	// A hybrid torrent exists by its truncated v2 infohash too.
+	low, high := infoHashV2Range(infoHash)
+	rows, err := db.conn.Query(`
+		SELECT 1 FROM torrents WHERE info_hash = ? OR info_hash_v2 BETWEEN ? AND ?;`, infoHash, low, high)
 	if err != nil {
 		return false, err
 	}
@@ -60,7 +64,7 @@ func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
 	// return false.
 	exists := rows.Next()
 	if !exists && rows.Err() != nil {
-		return false, err
+		return false, rows.Err()
 	}
 
 	if err = rows.Close(); err != nil {
@@ -70,7 +74,16 @@ func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []File, info InfoMetadata) error {
+	return db.AddNewTorrents([]NewTorrent{{
+		InfoHash:     infoHash,
+		Name:         name,
+		Files:        files,
+		InfoMetadata: info,
+	}})
+}
+
+func (db *sqlite3Database) AddNewTorrents(torrents []NewTorrent) error {
 	tx, err := db.conn.Begin()
 	if err != nil {
 		return err
@@ -81,9 +94,27 @@ func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []F
 	// is nice.
 	defer tx.Rollback()
 
+	for _, torrent := range torrents {
+		if err = sqlite3AddNewTorrent(tx, torrent); err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func sqlite3AddNewTorrent(tx *sql.Tx, torrent NewTorrent) error {
+	// Padding files are not a part of the content, so they are not counted towards the total size.
 	var totalSize uint64 = 0
-	for _, file := range files {
-		totalSize += uint64(file.Size)
+	for _, file := range torrent.Files {
+		if !file.IsPadding() {
+			totalSize += uint64(file.Size)
+		}
 	}
 
 	// This is a workaround for a bug: the database will not accept total_size to be zero.
@@ -103,33 +134,87 @@ func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []F
 			info_hash,
 			name,
 			total_size,
-			discovered_on
-		) VALUES (?, ?, ?, ?);
-	`, infoHash, name, totalSize, time.Now().Unix())
+			discovered_on,
+			piece_length,
+			n_pieces,
+			private,
+			source,
+			info_hash_v2
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`, torrent.InfoHash, torrent.Name, totalSize, time.Now().Unix(), torrent.PieceLength,
+		torrent.NPieces, torrent.Private, nullIfEmpty(torrent.Source), torrent.InfoHashV2)
 	if err != nil {
 		return err
 	}
 
+	// If the torrent is ignored (i.e. it already exists), LastInsertId would be the id of the
+	// previous insertion, so bail out before attaching the files to a wrong torrent.
+	var rowsAffected int64
+	if rowsAffected, err = res.RowsAffected(); err != nil {
+		return fmt.Errorf("sql.Result.RowsAffected()!  %s", err.Error())
+	} else if rowsAffected == 0 {
+		return nil
+	}
+
 	var lastInsertId int64
 	if lastInsertId, err = res.LastInsertId(); err != nil {
 		return fmt.Errorf("sql.Result.LastInsertId()!  %s", err.Error())
 	}
 
-	for _, file := range files {
-		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path) VALUES (?, ?, ?);",
-			lastInsertId, file.Size, file.Path,
+	for _, file := range torrent.Files {
+		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path, attributes, symlink_path) VALUES (?, ?, ?, ?, ?);",
+			lastInsertId, file.Size, file.Path, nullIfEmpty(file.Attributes), nullIfEmpty(file.SymlinkPath),
 		)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = tx.Commit()
+	if torrent.Info != nil {
+		if err = sqlite3AddInfoDictionary(tx, torrent.InfoHash, torrent.Info); err != nil {
+			return err
+		}
+	}
+	if torrent.Readme != nil {
+		if err = sqlite3AddReadme(tx, torrent.InfoHash, torrent.Readme.Path, torrent.Readme.Content); err != nil {
+			return err
+		}
+	}
+	if torrent.MediaInfo != nil {
+		if err = sqlite3AddMediaInfo(tx, torrent.InfoHash, *torrent.MediaInfo); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) IterateInfoHashes(fn func(infoHash []byte) error) error {
+	rows, err := db.conn.Query("SELECT info_hash FROM torrents;")
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	return nil
+	for rows.Next() {
+		var infoHash []byte
+		if err = rows.Scan(&infoHash); err != nil {
+			return err
+		}
+		if err = fn(infoHash); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return rows.Close()
+}
+
+func (db *sqlite3Database) Ping() error {
+	return db.conn.Ping()
 }
 
 func (db *sqlite3Database) Close() error {
@@ -160,7 +245,7 @@ func (db *sqlite3Database) GetNumberOfTorrents() (uint, error) {
 }
 
 func (db *sqlite3Database) GetTotalSizeOfTorrents() (uint64, error) {
-	rows, err := db.conn.Query("SELECT SUM(total_size) FROM torrents;")
+	rows, err := db.conn.Query("SELECT COALESCE(SUM(total_size), 0) FROM torrents;")
 	if err != nil {
 		return 0, err
 	}
@@ -181,17 +266,24 @@ func (db *sqlite3Database) GetTotalSizeOfTorrents() (uint64, error) {
 	return n, nil
 }
 
+// sqlite3NFiles is the number of the (non-padding) files of a torrent, in the queries of the
+// torrents.
+const sqlite3NFiles = "(SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id AND (attributes IS NULL OR instr(attributes, 'p') = 0))"
+
 type queryTD struct {
-	DoJoin    bool
-	FirstPage bool
-	OrderOn   string
-	Ascending bool
-	GTELTE    bool
-	Forward   bool
+	DoJoin      bool
+	SearchFiles bool
+	FirstPage   bool
+	OrderOn     string
+	Ascending   bool
+	GTELTE      bool
+	Forward     bool
 }
 
 func (db *sqlite3Database) QueryTorrents(
 	query string,
+	mode SearchMode,
+	filter TorrentFilter,
 	epoch int64,
 	orderBy OrderingCriteria,
 	ascending bool,
@@ -200,15 +292,25 @@ func (db *sqlite3Database) QueryTorrents(
 	lastID uint64,
 	backward bool,
 ) ([]TorrentMetadata, error) {
-	if query == "" && orderBy == ByRelevance {
+	q, err := ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	q.restrict(filter)
+	if len(q.Terms) == 0 && orderBy == ByRelevance {
 		return nil, fmt.Errorf("torrents cannot be ordered by relevance when the query is empty")
 	}
 	if (lastOrderedValue == 0) != (lastID == 0) {
 		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
 	}
+	if orderBy == ByNSeeders || orderBy == ByNLeechers {
+		return nil, fmt.Errorf("torrents cannot be ordered by the number of seeders or leechers yet")
+	}
 
-	doJoin := query != ""
+	doJoin := len(q.Terms) != 0
 	firstPage := lastID == 0
+	matchQuery := q.fts5Query()
+	var filterArgs []interface{}
 
 	// executeTemplate is used to prepare the SQL query, WITH PLACEHOLDERS FOR USER INPUT.
 	sqlQuery := executeTemplate(`
@@ -217,17 +319,38 @@ func (db *sqlite3Database) QueryTorrents(
 			 , name
 			 , total_size
 			 , discovered_on
-			 , (SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files
+			 , `+sqlite3NFiles+` AS n_files
+			 , info_hash_v2
 		FROM torrents
 	{{ if .DoJoin }}
 		INNER JOIN (
+		{{ if .SearchFiles }}
+			-- The torrents whose names or files match, as relevant as their most relevant match.
+			SELECT id
+				 , MIN(rank) AS rank
+			FROM (
+				SELECT rowid AS id
+					 , bm25(torrents_idx) AS rank
+				FROM torrents_idx
+				WHERE torrents_idx MATCH ?
+				UNION ALL
+				SELECT files.torrent_id AS id
+					 , bm25(files_idx) AS rank
+				FROM files_idx
+				INNER JOIN files ON files.id = files_idx.rowid
+				WHERE files_idx MATCH ?
+			)
+			GROUP BY id
+		{{ else }}
 			SELECT rowid AS id
 				 , bm25(torrents_idx) AS rank
 			FROM torrents_idx
 			WHERE torrents_idx MATCH ?
+		{{ end }}
 		) AS idx USING(id)
 	{{ end }}
 		WHERE discovered_on <= ?
+		{{ filters }}
 	{{ if not .FirstPage }}
 		{{ if .Forward }}
 			  AND (
@@ -244,13 +367,20 @@ func (db *sqlite3Database) QueryTorrents(
 		ORDER BY {{ .OrderOn }} {{ AscOrDesc .GTELTE }}, id ASC
 		LIMIT ?;	
 	`, queryTD{
-		DoJoin:    doJoin,    // if there is a query, do join
-		FirstPage: firstPage, // lastID != nil implies that lastOrderedValue != nil as well
-		OrderOn:   orderOn(orderBy),
-		Ascending: ascending,
-		GTELTE:    ascending != backward,
-		Forward:   !backward,
+		DoJoin:      doJoin, // if there is a query, do join
+		SearchFiles: mode == SearchFiles,
+		FirstPage:   firstPage, // lastID != nil implies that lastOrderedValue != nil as well
+		OrderOn:     orderOn(orderBy),
+		Ascending:   ascending,
+		GTELTE:      ascending != backward,
+		Forward:     !backward,
 	}, template.FuncMap{
+		"filters": func() string {
+			return q.sqlPredicates(func(arg interface{}) string {
+				filterArgs = append(filterArgs, arg)
+				return "?"
+			}, sqlite3NFiles, func(unixTime string) string { return unixTime })
+		},
 		"GTEorLTE": func(ascending bool) string {
 			// TODO: or maybe vice versa idk
 			if ascending {
@@ -271,9 +401,13 @@ func (db *sqlite3Database) QueryTorrents(
 	// Prepare query
 	queryArgs := make([]interface{}, 0)
 	if doJoin {
-		queryArgs = append(queryArgs, query)
+		queryArgs = append(queryArgs, matchQuery)
+		if mode == SearchFiles {
+			queryArgs = append(queryArgs, matchQuery)
+		}
 	}
 	queryArgs = append(queryArgs, epoch)
+	queryArgs = append(queryArgs, filterArgs...)
 	if !firstPage {
 		queryArgs = append(queryArgs, lastID)
 		queryArgs = append(queryArgs, lastOrderedValue)
@@ -289,7 +423,7 @@ func (db *sqlite3Database) QueryTorrents(
 	var torrents []TorrentMetadata
 	for rows.Next() {
 		var torrent TorrentMetadata
-		if err = rows.Scan(&torrent.ID, &torrent.InfoHash, &torrent.Name, &torrent.Size, &torrent.DiscoveredOn, &torrent.NFiles); err != nil {
+		if err = rows.Scan(&torrent.ID, &torrent.InfoHash, &torrent.Name, &torrent.Size, &torrent.DiscoveredOn, &torrent.NFiles, &torrent.InfoHashV2); err != nil {
 			return nil, err
 		}
 		torrents = append(torrents, torrent)
@@ -299,6 +433,24 @@ func (db *sqlite3Database) QueryTorrents(
 		return nil, err
 	}
 
+	if doJoin && mode == SearchFiles && len(torrents) != 0 {
+		rows, err = db.conn.Query(`
+			SELECT files.torrent_id
+				 , highlight(files_idx, 0, char(1), char(2))
+			FROM files_idx
+			INNER JOIN files ON files.id = files_idx.rowid
+			WHERE files_idx MATCH ?
+			  AND files.torrent_id IN (?`+strings.Repeat(", ?", len(torrents)-1)+`)
+			ORDER BY files.torrent_id, files.id;`,
+			append([]interface{}{matchQuery}, torrentIDs(torrents)...)...)
+		if err != nil {
+			return nil, fmt.Errorf("error while querying the matching files: %s", err.Error())
+		}
+		if err = addMatchedFiles(torrents, rows, parseHighlights); err != nil {
+			return nil, err
+		}
+	}
+
 	return torrents, nil
 }
 
@@ -322,6 +474,11 @@ func orderOn(orderBy OrderingCriteria) string {
 }
 
 func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
+	column := "info_hash"
+	if len(infoHash) == 32 {
+		column = "info_hash_v2"
+	}
+
 	rows, err := db.conn.Query(`
 		SELECT
 			id,
@@ -329,21 +486,30 @@ func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 			name,
 			total_size,
 			discovered_on,
-			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id) AS n_files
+			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id AND (attributes IS NULL OR instr(attributes, 'p') = 0)) AS n_files,
+			COALESCE(piece_length, 0),
+			COALESCE(n_pieces, 0),
+			COALESCE(private, 0),
+			COALESCE(source, ''),
+			info_hash_v2,
+			COALESCE(last_seen_on, 0),
+			n_announces
 		FROM torrents
-		WHERE info_hash = ?`,
+		WHERE `+column+` = ?`,
 		infoHash,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	if rows.Next() != true {
 		return nil, nil
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.ID, &tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
+	if err = rows.Scan(&tm.ID, &tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles,
+		&tm.PieceLength, &tm.NPieces, &tm.Private, &tm.Source, &tm.InfoHashV2, &tm.LastSeenOn, &tm.NAnnounces); err != nil {
 		return nil, err
 	}
 
@@ -356,11 +522,12 @@ func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 
 func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
 	rows, err := db.conn.Query(`
-		SELECT size, path 
+		SELECT size, path, COALESCE(attributes, ''), COALESCE(symlink_path, '')
 		FROM files
 		INNER JOIN torrents
 		ON files.torrent_id = torrents.id
-		WHERE torrents.info_hash = ?;
+		WHERE torrents.info_hash = ?
+		ORDER BY files.id;
 		`, infoHash)
 	if err != nil {
 		return nil, err
@@ -369,7 +536,7 @@ func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
 	var files []File
 	for rows.Next() {
 		var file File
-		if err = rows.Scan(&file.Size, &file.Path); err != nil {
+		if err = rows.Scan(&file.Size, &file.Path, &file.Attributes, &file.SymlinkPath); err != nil {
 			return nil, err
 		}
 		files = append(files, file)
@@ -382,6 +549,292 @@ func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
 	return files, nil
 }
 
+func (db *sqlite3Database) AddInfoDictionary(infoHash []byte, info []byte) error {
+	return sqlite3AddInfoDictionary(db.conn, infoHash, info)
+}
+
+func sqlite3AddInfoDictionary(conn execer, infoHash []byte, info []byte) error {
+	compressed, err := compress(info)
+	if err != nil {
+		return fmt.Errorf("could not compress info dictionary: %s", err.Error())
+	}
+
+	_, err = conn.Exec(`
+		INSERT OR REPLACE INTO info_dictionaries (torrent_id, info)
+		SELECT id, ?
+		FROM torrents
+		WHERE info_hash = ?;
+	`, compressed, infoHash)
+	return err
+}
+
+func (db *sqlite3Database) GetInfoDictionary(infoHash []byte) ([]byte, error) {
+	rows, err := db.conn.Query(`
+		SELECT info
+		FROM info_dictionaries
+		INNER JOIN torrents
+		ON info_dictionaries.torrent_id = torrents.id
+		WHERE torrents.info_hash = ?;
+		`, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() != true {
+		return nil, rows.Close()
+	}
+
+	var compressed []byte
+	if err = rows.Scan(&compressed); err != nil {
+		return nil, err
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return decompress(compressed)
+}
+
+func (db *sqlite3Database) AddReadme(infoHash []byte, path string, content string) error {
+	return sqlite3AddReadme(db.conn, infoHash, path, content)
+}
+
+func sqlite3AddReadme(conn execer, infoHash []byte, path string, content string) error {
+	_, err := conn.Exec(`
+		UPDATE files
+		SET is_readme = 1, content = ?
+		WHERE path = ? AND torrent_id = (SELECT id FROM torrents WHERE info_hash = ?);
+	`, content, path, infoHash)
+	return err
+}
+
+func (db *sqlite3Database) GetReadme(infoHash []byte) (*Readme, error) {
+	rows, err := db.conn.Query(`
+		SELECT path, content
+		FROM files
+		INNER JOIN torrents
+		ON files.torrent_id = torrents.id
+		WHERE torrents.info_hash = ? AND files.is_readme = 1;
+		`, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() != true {
+		return nil, rows.Close()
+	}
+
+	var readme Readme
+	if err = rows.Scan(&readme.Path, &readme.Content); err != nil {
+		return nil, err
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return &readme, nil
+}
+
+func (db *sqlite3Database) AddMediaInfo(infoHash []byte, mediaInfo MediaInfo) error {
+	return sqlite3AddMediaInfo(db.conn, infoHash, mediaInfo)
+}
+
+func sqlite3AddMediaInfo(conn execer, infoHash []byte, mediaInfo MediaInfo) error {
+	_, err := conn.Exec(`
+		INSERT OR REPLACE INTO media_info (torrent_id, path, format, duration, width, height, video_codec, audio_codec)
+		SELECT id, ?, ?, ?, ?, ?, ?, ?
+		FROM torrents
+		WHERE info_hash = ?;
+	`, mediaInfo.Path, mediaInfo.Format, mediaInfo.Duration, mediaInfo.Width, mediaInfo.Height,
+		nullIfEmpty(mediaInfo.VideoCodec), nullIfEmpty(mediaInfo.AudioCodec), infoHash)
+	return err
+}
+
+func (db *sqlite3Database) GetMediaInfo(infoHash []byte) (*MediaInfo, error) {
+	rows, err := db.conn.Query(`
+		SELECT
+			path,
+			format,
+			COALESCE(duration, 0),
+			COALESCE(width, 0),
+			COALESCE(height, 0),
+			COALESCE(video_codec, ''),
+			COALESCE(audio_codec, '')
+		FROM media_info
+		INNER JOIN torrents
+		ON media_info.torrent_id = torrents.id
+		WHERE torrents.info_hash = ?;
+		`, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() != true {
+		return nil, rows.Close()
+	}
+
+	var mi MediaInfo
+	err = rows.Scan(&mi.Path, &mi.Format, &mi.Duration, &mi.Width, &mi.Height, &mi.VideoCodec, &mi.AudioCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return &mi, nil
+}
+
+func (db *sqlite3Database) AddPeerStatistics(stats PeerStatistics) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	// If everything goes as planned and no error occurs, we will commit the transaction before
+	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
+	// committed transaction. BUT, if an error occurs, we'll get our transaction rollback'ed, which
+	// is nice.
+	defer tx.Rollback()
+
+	stored, err := storedPeerNames(tx)
+	if err != nil {
+		return err
+	}
+
+	for category, counts := range stats.foldedCategories(stored) {
+		for name, count := range counts {
+			_, err = tx.Exec(`
+				INSERT INTO peer_statistics (category, name, count) VALUES (?, ?, ?)
+				ON CONFLICT (category, name) DO UPDATE SET count = count + excluded.count;
+			`, category, name, count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqlite3Database) GetPeerStatistics() (*PeerStatistics, error) {
+	rows, err := db.conn.Query("SELECT category, name, count FROM peer_statistics;")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := NewPeerStatistics()
+	categories := stats.categories()
+	for rows.Next() {
+		var category, name string
+		var count uint64
+		if err = rows.Scan(&category, &name, &count); err != nil {
+			return nil, err
+		}
+		if counts, ok := categories[category]; ok {
+			counts[name] = count
+		}
+	}
+
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (db *sqlite3Database) AddPendingInfoHash(pending PendingInfoHash) error {
+	_, err := db.conn.Exec(`
+		INSERT OR REPLACE INTO pending_infohashes (info_hash, last_attempt, next_attempt, n_attempts, peers)
+		VALUES (?, ?, ?, ?, ?);
+	`, pending.InfoHash, pending.LastAttempt, pending.NextAttempt, pending.NAttempts, strings.Join(pending.Peers, "\n"))
+	return err
+}
+
+func (db *sqlite3Database) GetPendingInfoHash(infoHash []byte) (*PendingInfoHash, error) {
+	pendings, err := db.queryPendingInfoHashes(`
+		SELECT info_hash, last_attempt, next_attempt, n_attempts, peers
+		FROM pending_infohashes
+		WHERE info_hash = ?;
+		`, infoHash)
+	if err != nil || len(pendings) == 0 {
+		return nil, err
+	}
+	return &pendings[0], nil
+}
+
+func (db *sqlite3Database) GetDuePendingInfoHashes(now int64, limit uint) ([]PendingInfoHash, error) {
+	return db.queryPendingInfoHashes(`
+		SELECT info_hash, last_attempt, next_attempt, n_attempts, peers
+		FROM pending_infohashes
+		WHERE next_attempt <= ?
+		ORDER BY next_attempt ASC
+		LIMIT ?;
+		`, now, limit)
+}
+
+func (db *sqlite3Database) queryPendingInfoHashes(query string, args ...interface{}) ([]PendingInfoHash, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var pendings []PendingInfoHash
+	for rows.Next() {
+		var pending PendingInfoHash
+		var peers string
+		err = rows.Scan(&pending.InfoHash, &pending.LastAttempt, &pending.NextAttempt, &pending.NAttempts, &peers)
+		if err != nil {
+			return nil, err
+		}
+		if peers != "" {
+			pending.Peers = strings.Split(peers, "\n")
+		}
+		pendings = append(pendings, pending)
+	}
+
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return pendings, nil
+}
+
+func (db *sqlite3Database) DeletePendingInfoHash(infoHash []byte) error {
+	_, err := db.conn.Exec("DELETE FROM pending_infohashes WHERE info_hash = ?;", infoHash)
+	return err
+}
+
+func (db *sqlite3Database) AddAnnounces(announces []Announces) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		UPDATE torrents
+		SET n_announces = n_announces + ?, last_seen_on = MAX(COALESCE(last_seen_on, 0), ?)
+		WHERE info_hash = ? OR info_hash_v2 BETWEEN ? AND ?;
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// The v2 swarm of a hybrid torrent announces its truncated v2 infohash.
+	for _, announce := range announces {
+		low, high := infoHashV2Range(announce.InfoHash)
+		if _, err = stmt.Exec(announce.Count, announce.LastSeenOn, announce.InfoHash, low, high); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (db *sqlite3Database) GetStatistics(n uint, from string) (*Statistics, error) {
 	from_time, granularity, err := ParseISO8601(from)
 	if err != nil {
@@ -659,8 +1112,10 @@ func (db *sqlite3Database) setupDatabase() error {
 		PRAGMA user_version = 4;
 		`)
 		if err != nil {
-			return fmt.Errorf("sql.Tx.Exec (v2 -> v3): %s", err.Error())
+			return fmt.Errorf("sql.Tx.Exec (v3 -> v4): %s", err.Error())
 		}
+		fallthrough
+
 	case 4:
 		// Upgrade from user_version 4 to 5
 		// Changes:
@@ -679,7 +1134,225 @@ func (db *sqlite3Database) setupDatabase() error {
 		PRAGMA user_version = 5;
 		`)
 		if err != nil {
-			return fmt.Errorf("sql.Tx.Exec (v2 -> v3): %s", err.Error())
+			return fmt.Errorf("sql.Tx.Exec (v4 -> v5): %s", err.Error())
+		}
+		fallthrough
+
+	case 5:
+		// Upgrade from user_version 5 to 6
+		// Changes:
+		//   * Add table for the (compressed) raw info dictionaries of the torrents, so that the
+		//     .torrent files can be reconstructed and fields can be re-derived without re-fetching.
+		zap.L().Warn("Updating database schema from 5 to 6... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS info_dictionaries (
+			torrent_id	INTEGER PRIMARY KEY REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			info		BLOB NOT NULL
+		);
+
+		PRAGMA user_version = 6;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v5 -> v6): %s", err.Error())
+		}
+		fallthrough
+
+	case 6:
+		// Upgrade from user_version 6 to 7
+		// Changes:
+		//   * Added `piece_length`, `n_pieces`, `private`, and `source` columns to the `torrents`
+		//     table.
+		//   * Added `attributes` (BEP 47) and `symlink_path` columns to the `files` table.
+		//
+		// All of them are NULL for the torrents that are added before the upgrade.
+		zap.L().Warn("Updating database schema from 6 to 7... (this might take a while)")
+		_, err = tx.Exec(`
+		ALTER TABLE torrents ADD COLUMN piece_length INTEGER CHECK (piece_length >= 0) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN n_pieces     INTEGER CHECK (n_pieces >= 0) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN private      INTEGER CHECK (private IN (0, 1)) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN source       TEXT DEFAULT NULL;
+
+		ALTER TABLE files ADD COLUMN attributes   TEXT DEFAULT NULL;
+		ALTER TABLE files ADD COLUMN symlink_path TEXT DEFAULT NULL;
+
+		PRAGMA user_version = 7;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v6 -> v7): %s", err.Error())
+		}
+		fallthrough
+
+	case 7:
+		// Upgrade from user_version 7 to 8
+		// Changes:
+		//   * Added `info_hash_v2` column to the `torrents` table, for the (full) SHA-256 infohashes
+		//     of BEP 52 v2 and hybrid torrents, and the unique index on it (remember that SQLite
+		//     treats each NULL value as distinct).
+		zap.L().Warn("Updating database schema from 7 to 8... (this might take a while)")
+		_, err = tx.Exec(`
+		ALTER TABLE torrents ADD COLUMN info_hash_v2 BLOB CHECK (info_hash_v2 IS NULL OR length(info_hash_v2) = 32) DEFAULT NULL;
+		CREATE UNIQUE INDEX info_hash_v2_index ON torrents (info_hash_v2);
+
+		PRAGMA user_version = 8;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v7 -> v8): %s", err.Error())
+		}
+		fallthrough
+
+	case 8:
+		// Upgrade from user_version 8 to 9
+		// Changes:
+		//   * Add table for the media information (duration, resolution, codecs...) probed from a
+		//     video or an image file of the torrents.
+		zap.L().Warn("Updating database schema from 8 to 9... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS media_info (
+			torrent_id	INTEGER PRIMARY KEY REFERENCES torrents ON DELETE CASCADE ON UPDATE RESTRICT,
+			path		TEXT NOT NULL,
+			format		TEXT NOT NULL,
+			duration	REAL CHECK (duration IS NULL OR duration >= 0),
+			width		INTEGER CHECK (width IS NULL OR width >= 0),
+			height		INTEGER CHECK (height IS NULL OR height >= 0),
+			video_codec	TEXT,
+			audio_codec	TEXT
+		);
+
+		PRAGMA user_version = 9;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v8 -> v9): %s", err.Error())
+		}
+		fallthrough
+
+	case 9:
+		// Upgrade from user_version 9 to 10
+		// Changes:
+		//   * Add table for the numbers of peers by the fingerprints of their clients (see
+		//     PeerStatistics).
+		zap.L().Warn("Updating database schema from 9 to 10... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS peer_statistics (
+			category	TEXT NOT NULL,
+			name		TEXT NOT NULL,
+			count		INTEGER NOT NULL CHECK (count >= 0),
+			PRIMARY KEY (category, name)
+		);
+
+		PRAGMA user_version = 10;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v9 -> v10): %s", err.Error())
+		}
+		fallthrough
+
+	case 10:
+		// Upgrade from user_version 10 to 11
+		// Changes:
+		//   * Add table for the infohashes whose metadata could not be fetched yet, to be retried
+		//     later (see PendingInfoHash).
+		zap.L().Warn("Updating database schema from 10 to 11... (this might take a while)")
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pending_infohashes (
+			info_hash		BLOB NOT NULL PRIMARY KEY CHECK(length(info_hash) == 20),
+			last_attempt	INTEGER NOT NULL,
+			next_attempt	INTEGER NOT NULL,
+			n_attempts		INTEGER NOT NULL CHECK(n_attempts >= 0),
+			peers			TEXT NOT NULL
+		);
+		CREATE INDEX next_attempt_index ON pending_infohashes (next_attempt);
+
+		PRAGMA user_version = 11;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v10 -> v11): %s", err.Error())
+		}
+		fallthrough
+
+	case 11:
+		// Upgrade from user_version 11 to 12
+		// Changes:
+		//   * Added `last_seen_on` and `n_announces` columns to the `torrents` table, for the
+		//     history of the announces of the torrents in the DHT (after their discovery).
+		zap.L().Warn("Updating database schema from 11 to 12... (this might take a while)")
+		_, err = tx.Exec(`
+		ALTER TABLE torrents ADD COLUMN last_seen_on INTEGER CHECK (last_seen_on IS NULL OR last_seen_on > 0) DEFAULT NULL;
+		ALTER TABLE torrents ADD COLUMN n_announces  INTEGER NOT NULL CHECK (n_announces >= 0) DEFAULT 0;
+
+		PRAGMA user_version = 12;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v11 -> v12): %s", err.Error())
+		}
+		fallthrough
+
+	case 12:
+		// Upgrade from user_version 12 to 13
+		// Changes:
+		//   * Created `files_idx` FTS5 virtual table for the paths of the (non-padding) files, to
+		//     search for the torrents by their files too (see SearchFiles).
+		zap.L().Warn("Updating database schema from 12 to 13... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE VIRTUAL TABLE files_idx USING fts5(path, content='files', content_rowid='id', tokenize="porter unicode61 separators ' !""#$%&''()*+,-./:;<=>?@[\]^_` + "`" + `{|}~'");
+
+			-- Populate the index
+			INSERT INTO files_idx(rowid, path) SELECT id, path FROM files WHERE attributes IS NULL OR instr(attributes, 'p') = 0;
+
+			-- Triggers to keep the FTS index up to date. The rows that are not in the index must not
+			-- be deleted from it, hence the conditions.
+			CREATE TRIGGER files_ai AFTER INSERT ON files WHEN new.attributes IS NULL OR instr(new.attributes, 'p') = 0 BEGIN
+			  INSERT INTO files_idx(rowid, path) VALUES (new.id, new.path);
+			END;
+			CREATE TRIGGER files_ad AFTER DELETE ON files WHEN old.attributes IS NULL OR instr(old.attributes, 'p') = 0 BEGIN
+			  INSERT INTO files_idx(files_idx, rowid, path) VALUES('delete', old.id, old.path);
+			END;
+			CREATE TRIGGER files_au AFTER UPDATE OF path, attributes ON files BEGIN
+			  INSERT INTO files_idx(files_idx, rowid, path) SELECT 'delete', old.id, old.path WHERE old.attributes IS NULL OR instr(old.attributes, 'p') = 0;
+			  INSERT INTO files_idx(rowid, path) SELECT new.id, new.path WHERE new.attributes IS NULL OR instr(new.attributes, 'p') = 0;
+			END;
+
+			PRAGMA user_version = 13;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v12 -> v13): %s", err.Error())
+		}
+		fallthrough
+
+	case 13:
+		// Upgrade from user_version 13 to 14
+		// Changes:
+		//   * Created indices on `total_size` and `discovered_on` of the torrents, for the filters
+		//     of QueryTorrents (see TorrentFilter) and for ordering the torrents by them. The files
+		//     of a torrent (which are counted and whose extensions are filtered) are looked up by
+		//     `readme_index` already.
+		zap.L().Warn("Updating database schema from 13 to 14... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE INDEX total_size_index ON torrents (total_size);
+			CREATE INDEX discovered_on_index ON torrents (discovered_on);
+			PRAGMA user_version = 14;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v13 -> v14): %s", err.Error())
+		}
+		fallthrough
+
+	case 14:
+		// Upgrade from user_version 14 to 15
+		// Changes:
+		//   * Recreated the `torrents_au` trigger to fire only when the name of a torrent is
+		//     updated, as the announces (see AddAnnounces) update the torrents in batches and
+		//     reindexing their unchanged names churns `torrents_idx`.
+		zap.L().Warn("Updating database schema from 14 to 15...")
+		_, err = tx.Exec(`
+			DROP TRIGGER torrents_au;
+			CREATE TRIGGER torrents_au AFTER UPDATE OF name ON torrents BEGIN
+			  INSERT INTO torrents_idx(torrents_idx, rowid, name) VALUES('delete', old.id, old.name);
+			  INSERT INTO torrents_idx(rowid, name) VALUES (new.id, new.name);
+			END;
+			PRAGMA user_version = 15;
+		`)
+		if err != nil {
+			return fmt.Errorf("sql.Tx.Exec (v14 -> v15): %s", err.Error())
 		}
 	}
 
@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"bytes"
 	"encoding/hex"
 	"net/url"
 	"os"
@@ -12,9 +13,12 @@ import (
 )
 
 const (
-	HASH = "e4be9e4db876e3e3179778b03e906297be5c8dbe"
-	NAME = "ubuntu-18.04-desktop-amd64.iso"
-	SIZE = 1921843200
+	HASH    = "e4be9e4db876e3e3179778b03e906297be5c8dbe"
+	HASH_V2 = "caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	NAME    = "ubuntu-18.04-desktop-amd64.iso"
+	SIZE    = 1921843200
+
+	PIECE_LENGTH = 512 * 1024
 )
 
 func TestSqlite3Database_AddNewTorrent(t *testing.T) {
@@ -24,6 +28,60 @@ func TestSqlite3Database_AddNewTorrent(t *testing.T) {
 	addTorrent(db, t)
 }
 
+func TestSqlite3Database_AddNewTorrents(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+	otherInfoHash := make([]byte, 20)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	addTorrent(db, t)
+
+	checkErr(db.AddNewTorrents([]NewTorrent{
+		// Already exists, hence must be skipped without attaching its files to another torrent.
+		{InfoHash: infoHash, Name: "duplicate", Files: []File{{Path: "duplicate", Size: 1}}},
+		{
+			InfoHash: otherInfoHash,
+			Name:     "other",
+			Files:    []File{{Path: "README", Size: 5}, {Path: "other.mkv", Size: 100}},
+			Info:     []byte("d4:name5:othere"),
+			Readme:   &Readme{Path: "README", Content: "hello"},
+		},
+	}), t)
+
+	files, err := db.GetFiles(infoHash)
+	checkErr(err, t)
+	if len(files) != 1 || files[0].Path != NAME {
+		t.Fatalf("files of the existing torrent are changed. Got: %v", files)
+	}
+
+	files, err = db.GetFiles(otherInfoHash)
+	checkErr(err, t)
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files of the new torrent. Got: %v", files)
+	}
+	info, err := db.GetInfoDictionary(otherInfoHash)
+	checkErr(err, t)
+	if string(info) != "d4:name5:othere" {
+		t.Fatalf("info dictionary mismatch. Got: %q", info)
+	}
+	readme, err := db.GetReadme(otherInfoHash)
+	checkErr(err, t)
+	if readme == nil || readme.Content != "hello" {
+		t.Fatalf("readme mismatch. Got: %v", readme)
+	}
+
+	var infoHashes [][]byte
+	checkErr(db.IterateInfoHashes(func(infoHash []byte) error {
+		infoHashes = append(infoHashes, infoHash)
+		return nil
+	}), t)
+	if len(infoHashes) != 2 {
+		t.Fatalf("expected to iterate over 2 infohashes. Got: %d", len(infoHashes))
+	}
+}
+
 func TestSqlite3Database_DoesTorrentExist(t *testing.T) {
 	infoHash, err := hex.DecodeString(HASH)
 
@@ -79,6 +137,14 @@ func TestSqlite3Database_GetTorrent(t *testing.T) {
 	if metadata.NFiles != 1 {
 		t.Fatalf("filenumber mismatch. Expected: 1, Got: %d", metadata.NFiles)
 	}
+
+	if metadata.PieceLength != PIECE_LENGTH {
+		t.Fatalf("piece length mismatch. Expected: %d, Got: %d", PIECE_LENGTH, metadata.PieceLength)
+	}
+
+	if metadata.Private {
+		t.Fatal("expected torrent to be public")
+	}
 	now := time.Now().Unix()
 
 	if metadata.DiscoveredOn > now {
@@ -112,6 +178,271 @@ func TestSqlite3Database_GetFiles(t *testing.T) {
 	}
 }
 
+func TestSqlite3Database_PaddingFiles(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	files := []File{
+		{Path: "a.mkv", Size: SIZE - 1024},
+		{Path: ".pad/1024", Size: 1024, Attributes: "p"},
+		{Path: "b.nfo", Size: 1024, Attributes: "h"},
+	}
+	err = db.AddNewTorrent(infoHash, NAME, files, InfoMetadata{})
+	checkErr(err, t)
+
+	metadata, err := db.GetTorrent(infoHash)
+	checkErr(err, t)
+
+	if metadata.Size != SIZE {
+		t.Fatalf("Size mismatch. Expected: %d, Got: %d", SIZE, metadata.Size)
+	}
+
+	if metadata.NFiles != 2 {
+		t.Fatalf("filenumber mismatch. Expected: 2, Got: %d", metadata.NFiles)
+	}
+
+	tFiles, err := db.GetFiles(infoHash)
+	checkErr(err, t)
+
+	if len(tFiles) != 3 {
+		t.Fatalf("filenumber mismatch. Expected: 3, Got: %d", len(tFiles))
+	}
+
+	if !tFiles[1].IsPadding() || tFiles[2].Attributes != "h" {
+		t.Fatalf("attributes mismatch. Got: %v", tFiles)
+	}
+}
+
+func TestSqlite3Database_GetTorrentByInfoHashV2(t *testing.T) {
+	infoHashV2, err := hex.DecodeString(HASH_V2)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	files := []File{{Path: NAME, Size: SIZE}}
+	err = db.AddNewTorrent(infoHashV2[:20], NAME, files, InfoMetadata{InfoHashV2: infoHashV2})
+	checkErr(err, t)
+
+	metadata, err := db.GetTorrent(infoHashV2)
+	checkErr(err, t)
+	if metadata == nil {
+		t.Fatal("expected torrent to exist")
+	}
+
+	if !bytes.Equal(metadata.InfoHash, infoHashV2[:20]) || !bytes.Equal(metadata.InfoHashV2, infoHashV2) {
+		t.Fatalf("infohash mismatch. Got: %x and %x", metadata.InfoHash, metadata.InfoHashV2)
+	}
+
+	if metadata.HasV1() {
+		t.Fatal("expected torrent to be v2-only")
+	}
+}
+
+func TestSqlite3Database_GetInfoDictionary(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	info, err := db.GetInfoDictionary(infoHash)
+	checkErr(err, t)
+	if info != nil {
+		t.Fatal("expected info dictionary to not exist")
+	}
+
+	addTorrent(db, t)
+
+	expected := []byte("d6:lengthi1921843200e4:name30:ubuntu-18.04-desktop-amd64.isoe")
+	err = db.AddInfoDictionary(infoHash, expected)
+	checkErr(err, t)
+
+	info, err = db.GetInfoDictionary(infoHash)
+	checkErr(err, t)
+	if !bytes.Equal(info, expected) {
+		t.Fatalf("info dictionary mismatch. Expected: %s, Got: %s", expected, info)
+	}
+}
+
+func TestSqlite3Database_GetReadme(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	addTorrent(db, t)
+
+	readme, err := db.GetReadme(infoHash)
+	checkErr(err, t)
+	if readme != nil {
+		t.Fatal("expected readme to not exist")
+	}
+
+	err = db.AddReadme(infoHash, NAME, "Ubuntu is a Linux distribution.")
+	checkErr(err, t)
+
+	readme, err = db.GetReadme(infoHash)
+	checkErr(err, t)
+	if readme == nil {
+		t.Fatal("expected readme to exist")
+	}
+	if readme.Path != NAME || readme.Content != "Ubuntu is a Linux distribution." {
+		t.Fatalf("readme mismatch. Got: %+v", *readme)
+	}
+}
+
+func TestSqlite3Database_GetMediaInfo(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	addTorrent(db, t)
+
+	mediaInfo, err := db.GetMediaInfo(infoHash)
+	checkErr(err, t)
+	if mediaInfo != nil {
+		t.Fatal("expected media info to not exist")
+	}
+
+	expected := MediaInfo{
+		Path:       NAME,
+		Format:     "mp4",
+		Duration:   5400.5,
+		Width:      1920,
+		Height:     1080,
+		VideoCodec: "avc1",
+	}
+	err = db.AddMediaInfo(infoHash, expected)
+	checkErr(err, t)
+
+	mediaInfo, err = db.GetMediaInfo(infoHash)
+	checkErr(err, t)
+	if mediaInfo == nil || *mediaInfo != expected {
+		t.Fatalf("media info mismatch. Expected: %+v, Got: %+v", expected, mediaInfo)
+	}
+}
+
+func TestSqlite3Database_GetPeerStatistics(t *testing.T) {
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	stats := NewPeerStatistics()
+	stats.Clients["qB"] = 2
+	stats.Extensions["ut_metadata"] = 3
+	checkErr(db.AddPeerStatistics(stats), t)
+
+	stats = NewPeerStatistics()
+	stats.Clients["qB"] = 1
+	stats.Clients["UT"] = 1
+	checkErr(db.AddPeerStatistics(stats), t)
+
+	got, err := db.GetPeerStatistics()
+	checkErr(err, t)
+	if got.Clients["qB"] != 3 || got.Clients["UT"] != 1 || got.Extensions["ut_metadata"] != 3 {
+		t.Fatalf("peer statistics mismatch. Got: %+v", *got)
+	}
+}
+
+func TestSqlite3Database_PendingInfoHashes(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	pending, err := db.GetPendingInfoHash(infoHash)
+	checkErr(err, t)
+	if pending != nil {
+		t.Fatal("expected infohash to not be pending")
+	}
+
+	expected := PendingInfoHash{
+		InfoHash:    infoHash,
+		LastAttempt: 1000,
+		NextAttempt: 1060,
+		NAttempts:   1,
+		Peers:       []string{"127.0.0.1:6881", "[::1]:6881"},
+	}
+	checkErr(db.AddPendingInfoHash(expected), t)
+
+	pending, err = db.GetPendingInfoHash(infoHash)
+	checkErr(err, t)
+	if pending == nil || pending.NAttempts != 1 || len(pending.Peers) != 2 || pending.Peers[1] != "[::1]:6881" {
+		t.Fatalf("pending infohash mismatch. Expected: %+v, Got: %+v", expected, pending)
+	}
+
+	pendings, err := db.GetDuePendingInfoHashes(1059, 10)
+	checkErr(err, t)
+	if len(pendings) != 0 {
+		t.Fatalf("expected no due infohashes, got %d", len(pendings))
+	}
+	pendings, err = db.GetDuePendingInfoHashes(1060, 10)
+	checkErr(err, t)
+	if len(pendings) != 1 || !bytes.Equal(pendings[0].InfoHash, infoHash) {
+		t.Fatalf("expected the infohash to be due, got %+v", pendings)
+	}
+
+	checkErr(db.DeletePendingInfoHash(infoHash), t)
+	pending, err = db.GetPendingInfoHash(infoHash)
+	checkErr(err, t)
+	if pending != nil {
+		t.Fatal("expected infohash to be deleted")
+	}
+}
+
+func TestSqlite3Database_AddAnnounces(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	addTorrent(db, t)
+
+	checkErr(db.AddAnnounces([]Announces{
+		{InfoHash: infoHash, Count: 3, LastSeenOn: 2000},
+		{InfoHash: make([]byte, 20), Count: 1, LastSeenOn: 2000}, // does not exist
+	}), t)
+	checkErr(db.AddAnnounces([]Announces{{InfoHash: infoHash, Count: 2, LastSeenOn: 1500}}), t)
+
+	torrent, err := db.GetTorrent(infoHash)
+	checkErr(err, t)
+	if torrent.NAnnounces != 5 || torrent.LastSeenOn != 2000 {
+		t.Fatalf("announces mismatch. Got: %d announces, last seen on %d", torrent.NAnnounces, torrent.LastSeenOn)
+	}
+}
+
+func TestSqlite3Database_AddAnnouncesKeepsIndex(t *testing.T) {
+	infoHash, err := hex.DecodeString(HASH)
+	checkErr(err, t)
+
+	tearDown, db := setupTest(t)
+	defer tearDown(t)
+
+	addTorrent(db, t)
+
+	// The blocks of the full-text index, which change whenever a row is (re)indexed.
+	index := func() string {
+		var blocks string
+		checkErr(db.(*sqlite3Database).conn.QueryRow(
+			"SELECT group_concat(hex(block)) FROM (SELECT block FROM torrents_idx_data ORDER BY id)").Scan(&blocks), t)
+		return blocks
+	}
+
+	before := index()
+	checkErr(db.AddAnnounces([]Announces{{InfoHash: infoHash, Count: 3, LastSeenOn: 2000}}), t)
+	if index() != before {
+		t.Error("expected the announces to leave the full-text index untouched")
+	}
+}
+
 func TestSqlite3Database_GetStatistics(t *testing.T) {
 	tearDown, db := setupTest(t)
 	defer tearDown(t)
@@ -173,7 +504,10 @@ func addTorrent(db Database, t *testing.T) {
 	}
 	files = append(files, file)
 
-	err = db.AddNewTorrent(infoHash, NAME, files)
+	err = db.AddNewTorrent(infoHash, NAME, files, InfoMetadata{
+		PieceLength: PIECE_LENGTH,
+		NPieces:     SIZE / PIECE_LENGTH,
+	})
 	checkErr(err, t)
 }
 